@@ -199,6 +199,18 @@ istio-cni ${ISTIO_OUT}/istio-cni:
 istio-cni-repair ${ISTIO_OUT}/istio-cni-repair:
 	common/scripts/gobuild.sh ${ISTIO_OUT}/istio-cni-repair ./cmd/istio-cni-repair
 
+.PHONY: istio-cni-capture
+istio-cni-capture ${ISTIO_OUT}/istio-cni-capture:
+	common/scripts/gobuild.sh ${ISTIO_OUT}/istio-cni-capture ./cmd/istio-cni-capture
+
+.PHONY: istio-cni-webhook
+istio-cni-webhook ${ISTIO_OUT}/istio-cni-webhook:
+	common/scripts/gobuild.sh ${ISTIO_OUT}/istio-cni-webhook ./cmd/istio-cni-webhook
+
+.PHONY: istio-cni-explain
+istio-cni-explain ${ISTIO_OUT}/istio-cni-explain:
+	common/scripts/gobuild.sh ${ISTIO_OUT}/istio-cni-explain ./cmd/istio-cni-explain
+
 # Non-static istio-cnis. These are typically a build artifact.
 ${ISTIO_OUT}/istio-cni-linux: depend
 	STATIC=0 GOOS=linux   common/scripts/gobuild.sh $@ ./cmd/istio-cni
@@ -211,7 +223,7 @@ ${ISTIO_OUT}/istio-cni-linux: depend
 
 .PHONY: build
 # Build will rebuild the go binaries.
-build: depend istio-cni istio-cni-repair
+build: depend istio-cni istio-cni-repair istio-cni-capture istio-cni-webhook istio-cni-explain
 
 # istio-cni-all makes all of the non-static istio-cni executables for each supported OS
 .PHONY: istio-cni-all
@@ -0,0 +1,241 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// A command to program Istio traffic capture into a network namespace without
+// a CNI invocation, e.g. for VMs, bare-metal mesh members or test rigs.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+
+	"istio.io/cni/pkg/capture"
+	"istio.io/cni/pkg/redirect"
+	"istio.io/pkg/log"
+)
+
+const usage = `Usage: istio-cni-capture [flags] program|verify|render|remove
+
+Actions:
+  program  Add the capture rules to the network namespace
+  verify   Check that the rules in the network namespace match the redirect
+  render   Print the commands program would run, without running them
+  remove   Delete the capture rules from the network namespace
+
+Flags:
+`
+
+var (
+	loggingOptions = log.DefaultOptions()
+	envKeyReplacer = strings.NewReplacer("-", "_")
+
+	// redirectFlags maps flag names to the Redirect fields they set.
+	redirectFlags = []struct {
+		name  string
+		val   string
+		usage string
+		field func(r *redirect.Redirect) *string
+	}{
+		{"target-port", redirect.DefaultRedirectToPort, "Port the proxy listens on for captured outbound traffic",
+			func(r *redirect.Redirect) *string { return &r.TargetPort }},
+		{"redirect-mode", redirect.DefaultRedirectMode, "Inbound capture mode, REDIRECT or TPROXY",
+			func(r *redirect.Redirect) *string { return &r.RedirectMode }},
+		{"no-redirect-uid", redirect.DefaultNoRedirectUID, "UID of the proxy, whose traffic is not captured",
+			func(r *redirect.Redirect) *string { return &r.NoRedirectUID }},
+		{"exclude-outbound-uids", "", "Comma separated UIDs, besides the proxy's, whose outbound traffic is not captured",
+			func(r *redirect.Redirect) *string { return &r.ExcludeOutboundUIDs }},
+		{"exclude-outbound-gids", "", "Comma separated GIDs, besides the proxy's, whose outbound traffic is not captured",
+			func(r *redirect.Redirect) *string { return &r.ExcludeOutboundGIDs }},
+		{"include-ip-cidrs", redirect.DefaultRedirectIPCidr, "Comma separated outbound CIDRs to capture, or '*'",
+			func(r *redirect.Redirect) *string { return &r.IncludeIPCidrs }},
+		{"include-ports", "*", "Comma separated inbound ports to capture, or '*'",
+			func(r *redirect.Redirect) *string { return &r.IncludePorts }},
+		{"exclude-ip-cidrs", redirect.DefaultRedirectExcludeIPCidr, "Comma separated outbound CIDRs not to capture",
+			func(r *redirect.Redirect) *string { return &r.ExcludeIPCidrs }},
+		{"exclude-inbound-ports", redirect.DefaultProxyInboundPorts, "Comma separated inbound ports not to capture",
+			func(r *redirect.Redirect) *string { return &r.ExcludeInboundPorts }},
+		{"exclude-inbound-source-ip-cidrs", "", "Comma separated source CIDRs whose inbound traffic is not captured",
+			func(r *redirect.Redirect) *string { return &r.ExcludeInboundSourceIPCidrs }},
+		{"exclude-outbound-ports", redirect.DefaultRedirectExcludePort, "Comma separated outbound ports not to capture",
+			func(r *redirect.Redirect) *string { return &r.ExcludeOutboundPorts }},
+		{"include-outbound-ports", "", "Comma separated outbound ports or ranges, e.g. 8000-8100, the only ones captured",
+			func(r *redirect.Redirect) *string { return &r.IncludeOutboundPorts }},
+		{"kubevirt-interfaces", redirect.DefaultKubevirtInterfaces, "Comma separated interfaces whose inbound traffic is captured as outbound",
+			func(r *redirect.Redirect) *string { return &r.KubevirtInterfaces }},
+		{"exclude-interfaces", "", "Comma separated interfaces whose traffic is not captured",
+			func(r *redirect.Redirect) *string { return &r.ExcludeInterfaces }},
+		{"inbound-port-targets", "", "Comma separated PORT:TARGET mappings redirecting inbound ports to other proxy listeners",
+			func(r *redirect.Redirect) *string { return &r.InboundPortTargets }},
+		{"tproxy-mark", "", "Firewall mark of the packets captured in TPROXY mode (1337 if unset)",
+			func(r *redirect.Redirect) *string { return &r.TproxyMark }},
+		{"tproxy-mask", "", "Bits of the packet mark used by TPROXY mode (all if unset)",
+			func(r *redirect.Redirect) *string { return &r.TproxyMask }},
+		{"tproxy-route-table", "", "Routing table delivering the packets captured in TPROXY mode (133 if unset)",
+			func(r *redirect.Redirect) *string { return &r.TproxyRouteTable }},
+	}
+
+	// redirectBoolFlags maps flag names to the boolean Redirect fields they set.
+	redirectBoolFlags = []struct {
+		name  string
+		usage string
+		field func(r *redirect.Redirect) *bool
+	}{
+		{"outbound-tproxy", "Keep the original source address of the proxy's connections to the app in TPROXY mode",
+			func(r *redirect.Redirect) *bool { return &r.OutboundTproxy }},
+		{"egress-lockdown", "Drop the outbound traffic which is neither captured, sent by the proxy nor excluded",
+			func(r *redirect.Redirect) *bool { return &r.EgressLockdown }},
+		{"egress-lockdown-reject-udp", "With --egress-lockdown, also reject outbound UDP other than DNS",
+			func(r *redirect.Redirect) *bool { return &r.EgressLockdownRejectUDP }},
+	}
+)
+
+// Parse command line options
+func parseFlags() (action string, netns string, mgr capture.InterceptRuleMgr, rdrct *redirect.Redirect) {
+	pflag.String("netns", "", "Path of the network namespace, e.g. /var/run/netns/foo (current namespace if unset)")
+	pflag.String("redirect-file", "", "JSON file holding the redirect; flags given explicitly override its values")
+	pflag.String("intercept-type", capture.DefaultInterceptRuleMgrType, "Type of InterceptRuleMgr used to program the rules")
+	pflag.String("bin-dir", capture.DefaultBinDir, "Directory holding istio-iptables.sh")
+	pflag.String("iptables-backend", capture.BackendAuto, "iptables backend programming the rules: legacy, nft or auto to detect it from the node's rules")
+	pflag.Duration("timeout", capture.DefaultProgramTimeout, "Time the program and verify actions may take; program is cleaned up when cancelled")
+	for _, f := range redirectFlags {
+		pflag.String(f.name, f.val, f.usage)
+	}
+	for _, f := range redirectBoolFlags {
+		pflag.Bool(f.name, false, f.usage)
+	}
+	pflag.Bool("help", false, "Print usage information")
+	pflag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		pflag.PrintDefaults()
+	}
+
+	pflag.Parse()
+	if err := viper.BindPFlags(pflag.CommandLine); err != nil {
+		log.Fatalf("Error parsing command line args: %v", err)
+	}
+
+	if viper.GetBool("help") {
+		pflag.Usage()
+		os.Exit(0)
+	}
+	if pflag.NArg() != 1 {
+		pflag.Usage()
+		os.Exit(2)
+	}
+	action = pflag.Arg(0)
+
+	viper.SetEnvPrefix("CAPTURE")
+	viper.SetEnvKeyReplacer(envKeyReplacer)
+	viper.AutomaticEnv()
+
+	interceptType := viper.GetString("intercept-type")
+	ctor := capture.GetInterceptRuleMgrCtor(interceptType)
+	if ctor == nil {
+		log.Fatalf("Unknown intercept type %q", interceptType)
+	}
+	backend := viper.GetString("iptables-backend")
+	if err := capture.ValidateBackend(backend); err != nil {
+		log.Fatalf("Invalid iptables backend: %v", err)
+	}
+	mgr = ctor(&capture.Config{BinDir: viper.GetString("bin-dir"), Backend: backend})
+
+	var err error
+	if rdrct, err = loadRedirect(viper.GetString("redirect-file")); err != nil {
+		log.Fatalf("Could not load redirect: %v", err)
+	}
+	return action, viper.GetString("netns"), mgr, rdrct
+}
+
+// loadRedirect builds the redirect from the flag defaults, the redirect file if
+// set, then the flags and environment variables set explicitly.
+func loadRedirect(file string) (*redirect.Redirect, error) {
+	rdrct := &redirect.Redirect{}
+	for _, f := range redirectFlags {
+		*f.field(rdrct) = f.val
+	}
+	if file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, rdrct); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", file, err)
+		}
+	}
+	for _, f := range redirectFlags {
+		if file == "" || pflag.CommandLine.Changed(f.name) || os.Getenv(envName(f.name)) != "" {
+			*f.field(rdrct) = viper.GetString(f.name)
+		}
+	}
+	for _, f := range redirectBoolFlags {
+		if file == "" || pflag.CommandLine.Changed(f.name) || os.Getenv(envName(f.name)) != "" {
+			*f.field(rdrct) = viper.GetBool(f.name)
+		}
+	}
+	// The plugin would not capture a pod with an invalid redirect.
+	if err := rdrct.Validate(); err != nil {
+		return nil, err
+	}
+	return rdrct, nil
+}
+
+// envName returns the environment variable viper reads flag from.
+func envName(flag string) string {
+	return "CAPTURE_" + envKeyReplacer.Replace(strings.ToUpper(flag))
+}
+
+func main() {
+	loggingOptions.OutputPaths = []string{"stderr"}
+	loggingOptions.JSONEncoding = true
+	if err := log.Configure(loggingOptions); err != nil {
+		os.Exit(1)
+	}
+
+	action, netns, mgr, rdrct := parseFlags()
+	log.Infof("Running %s in netns %q with redirect %+v", action, netns, *rdrct)
+
+	var err error
+	switch action {
+	case "program":
+		ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("timeout"))
+		err = mgr.Program(ctx, netns, rdrct)
+		cancel()
+	case "verify":
+		ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("timeout"))
+		err = mgr.Verify(ctx, netns, rdrct)
+		cancel()
+	case "render":
+		var cmds []string
+		if cmds, err = mgr.Render(netns, rdrct); err == nil {
+			for _, cmd := range cmds {
+				fmt.Println(cmd)
+			}
+		}
+	case "remove":
+		err = mgr.Remove(netns, rdrct)
+	default:
+		pflag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatalf("%s failed: %v", action, err)
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"go.uber.org/multierr"
+	corev1 "k8s.io/api/core/v1"
+
+	"istio.io/api/annotation"
+	"istio.io/cni/pkg/capture"
+	"istio.io/cni/pkg/plan"
+	"istio.io/cni/pkg/policy"
+	"istio.io/cni/pkg/redirect"
+)
+
+// pluginConf is the istio-cni plugin config, less the CNI settings.
+type pluginConf struct {
+	Type string `json:"type"`
+	plan.Config
+}
+
+// parsePluginConf returns the istio-cni plugin config from a CNI conflist, or
+// from a single plugin config.
+func parsePluginConf(data []byte) (*pluginConf, error) {
+	list := struct {
+		Plugins []json.RawMessage `json:"plugins"`
+	}{}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	if list.Plugins == nil {
+		list.Plugins = []json.RawMessage{data}
+	}
+	for _, raw := range list.Plugins {
+		conf := &pluginConf{}
+		if err := json.Unmarshal(raw, conf); err != nil {
+			return nil, err
+		}
+		if conf.Type == "istio-cni" {
+			return conf, nil
+		}
+	}
+	return nil, fmt.Errorf("no istio-cni plugin in the CNI config")
+}
+
+// explainer reports what istio-cni would do when adding a pod.
+type explainer struct {
+	conf *pluginConf
+	mgr  capture.InterceptRuleMgr
+	// mesh is the mesh config giving the redirect defaults, if any.
+	mesh *redirect.MeshConfig
+}
+
+func (e *explainer) explain(w io.Writer, pod *corev1.Pod, ns *corev1.Namespace) {
+	p := policy.NewPod(pod)
+	if p.Namespace == "" && ns != nil {
+		p.Namespace = ns.Name
+	}
+	fmt.Fprintf(w, "Pod %s/%s\n\n", p.Namespace, p.Name)
+
+	capturePolicy, err := e.conf.CompilePolicy()
+	if err != nil {
+		fmt.Fprintf(w, "Invalid policy: %v\n", err)
+		return
+	}
+	var pns *policy.Namespace
+	if ns != nil {
+		pns = policy.NewNamespace(ns)
+	}
+	decision, err := capturePolicy.Evaluate(p, pns)
+	if err != nil {
+		fmt.Fprintf(w, "Policy error: %v\n", err)
+		if ns == nil && capturePolicy.NeedsNamespaceMetadata() {
+			fmt.Fprintf(w, "  the policy reads namespace metadata, pass the namespace with --namespace\n")
+		}
+		return
+	}
+	if decision.Capture {
+		fmt.Fprintf(w, "Captured: yes\n")
+	} else {
+		fmt.Fprintf(w, "Captured: no\n")
+	}
+	fmt.Fprintf(w, "  %s: %s\n", decision.Rule, decision.Description)
+
+	layers, err := e.conf.Layers(pns, p.Annotations, decision.Redirect)
+	if err != nil {
+		fmt.Fprintf(w, "\nInvalid %v\n", err)
+		return
+	}
+	// The Kubernetes Service and node addresses are only known at ADD time.
+	autoExcluded, err := e.conf.AutoExclude.CIDRs()
+	if err != nil {
+		fmt.Fprintf(w, "\nInvalid %v\n", err)
+		return
+	}
+	var lookedUp []string
+	if e.conf.AutoExclude.KubernetesService {
+		lookedUp = append(lookedUp, "the kubernetes Service")
+	}
+	if e.conf.AutoExclude.NodeIP {
+		lookedUp = append(lookedUp, "the node IPs")
+	}
+	pl, err := e.conf.Resolve(plan.Input{Mesh: e.mesh, Layers: layers, AutoExcluded: autoExcluded, Pod: p})
+	if err != nil {
+		fmt.Fprintf(w, "\nInvalid redirect, capture is skipped:\n")
+		for _, e := range multierr.Errors(err) {
+			fmt.Fprintf(w, "  %v\n", e)
+		}
+		return
+	}
+	rdrct := pl.Redirect
+
+	fmt.Fprintf(w, "\nRedirect:\n")
+	if e.mesh != nil {
+		fmt.Fprintf(w, "  defaults from mesh config %+v\n", *e.mesh)
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, f := range []struct{ name, val string }{
+		{"targetPort", rdrct.TargetPort},
+		{"redirectMode", rdrct.RedirectMode},
+		{"noRedirectUID", rdrct.NoRedirectUID},
+		{"excludeOutboundUIDs", rdrct.ExcludeOutboundUIDs},
+		{"excludeOutboundGIDs", rdrct.ExcludeOutboundGIDs},
+		{"includeIPCidrs", rdrct.IncludeIPCidrs},
+		{"includePorts", rdrct.IncludePorts},
+		{"excludeIPCidrs", rdrct.ExcludeIPCidrs},
+		{"excludeInboundPorts", rdrct.ExcludeInboundPorts},
+		{"excludeInboundSourceIPCidrs", rdrct.ExcludeInboundSourceIPCidrs},
+		{"excludeOutboundPorts", rdrct.ExcludeOutboundPorts},
+		{"includeOutboundPorts", rdrct.IncludeOutboundPorts},
+		{"kubevirtInterfaces", rdrct.KubevirtInterfaces},
+		{"excludeInterfaces", rdrct.ExcludeInterfaces},
+		{"inboundPortTargets", rdrct.InboundPortTargets},
+		{"egressLockdown", strconv.FormatBool(rdrct.EgressLockdown)},
+		{"egressLockdownRejectUDP", strconv.FormatBool(rdrct.EgressLockdownRejectUDP)},
+	} {
+		param, _ := redirect.Lookup(f.name)
+		source := string(redirect.SourceDefault)
+		switch pl.Sources[f.name] {
+		case redirect.SourceConfig:
+			source = "config redirect_defaults"
+		case redirect.SourceNamespace:
+			source = fmt.Sprintf("%s %s", redirect.SourceNamespace, param.Key)
+		case redirect.SourceAnnotation:
+			source = fmt.Sprintf("%s %s", redirect.SourceAnnotation, param.Key)
+			if _, ok := decision.Redirect[param.Key]; ok {
+				source = fmt.Sprintf("policy rule %s", decision.Rule)
+			}
+		}
+		for _, added := range pl.Added[f.name] {
+			source += ", " + added
+		}
+		fmt.Fprintf(tw, "  %s\t%q\t%s\n", f.name, f.val, source)
+	}
+	tw.Flush()
+	if len(lookedUp) > 0 {
+		fmt.Fprintf(w, "  excludeIPCidrs also gets %s at ADD time\n", strings.Join(lookedUp, " and "))
+	}
+	fmt.Fprintf(w, "  excludeInterfaces also gets the pod's interfaces other than the primary one at ADD time\n")
+	if len(pl.ProbePorts) > 0 {
+		fmt.Fprintf(w, "  excludeInboundPorts gets the probe ports %s as %s is false\n",
+			strings.Join(pl.ProbePorts, ","), annotation.SidecarRewriteAppHTTPProbers.Name)
+	}
+	if rdrct.RedirectMode == redirect.ModeTPROXY {
+		fmt.Fprintf(w, "  TPROXY mark %q, mask %q, route table %q, outbound %t from config tproxy\n",
+			rdrct.TproxyMark, rdrct.TproxyMask, rdrct.TproxyRouteTable, rdrct.OutboundTproxy)
+	}
+
+	if conflicts := pl.Conflicts; len(conflicts) > 0 {
+		mode := e.conf.ProxyPorts.Conflicts
+		if mode == "" {
+			mode = plan.PortConflictsWarn
+		}
+		fmt.Fprintf(w, "\nPort conflicts, config proxy_ports conflicts %q:\n", mode)
+		for _, c := range conflicts {
+			fmt.Fprintf(w, "  %s\n", c)
+		}
+	}
+
+	if !decision.Capture {
+		return
+	}
+	fmt.Fprintf(w, "\nRules:\n")
+	cmds, err := e.mgr.Render("", rdrct)
+	if err != nil {
+		fmt.Fprintf(w, "  unavailable: %v\n", err)
+		return
+	}
+	for _, cmd := range cmds {
+		fmt.Fprintf(w, "  %s\n", cmd)
+	}
+}
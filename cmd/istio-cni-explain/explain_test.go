@@ -0,0 +1,182 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	"istio.io/cni/pkg/capture"
+	"istio.io/cni/pkg/policy"
+	"istio.io/cni/pkg/redirect"
+)
+
+func testExplain(t *testing.T, ns *corev1.Namespace, mesh *redirect.MeshConfig) string {
+	t.Helper()
+	pod := &corev1.Pod{}
+	readManifest("testdata/pod.yaml", pod)
+	return testExplainPod(t, pod, ns, mesh)
+}
+
+func testExplainPod(t *testing.T, pod *corev1.Pod, ns *corev1.Namespace, mesh *redirect.MeshConfig) string {
+	t.Helper()
+	data, err := ioutil.ReadFile("testdata/istio-cni.conflist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf, err := parsePluginConf(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := &explainer{
+		conf: conf,
+		mgr:  capture.IptablesInterceptRuleMgrCtor(&capture.Config{BinDir: "../../tools/packaging/common"}),
+		mesh: mesh,
+	}
+	var out bytes.Buffer
+	e.explain(&out, pod, ns)
+	return out.String()
+}
+
+func TestExplainCapturedPod(t *testing.T) {
+	ns := &corev1.Namespace{}
+	readManifest("testdata/namespace.yaml", ns)
+	out := testExplain(t, ns, nil)
+
+	// Ignore the column alignment of the redirect table.
+	words := strings.Join(strings.Fields(out), " ")
+	for _, want := range []string{
+		"Pod bookinfo/productpage",
+		"Captured: yes bookinfo-mysql: bookinfo talks to mysql directly",
+		`excludeOutboundPorts "3306" policy rule bookinfo-mysql`,
+		`includePorts "9080" annotation traffic.sidecar.istio.io/includeInboundPorts`,
+		`excludeIPCidrs "10.0.0.1/32,169.254.0.0/16" config redirect_defaults, auto_exclude`,
+		"excludeIPCidrs also gets the kubernetes Service at ADD time",
+		`excludeInboundPorts "9443,15020,15021,15090" namespace traffic.sidecar.istio.io/excludeInboundPorts`,
+		"iptables -t nat -A ISTIO_INBOUND -p tcp --dport 9080 -j ISTIO_IN_REDIRECT",
+	} {
+		if !strings.Contains(words, want) {
+			t.Errorf("expected output to contain %q, got:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "Port conflicts") {
+		t.Errorf("expected the istio-proxy ports to be ignored, got:\n%s", out)
+	}
+}
+
+func TestExplainPortConflicts(t *testing.T) {
+	pod := &corev1.Pod{}
+	readManifest("testdata/pod.yaml", pod)
+	pod.Spec.Containers[0].Ports = append(pod.Spec.Containers[0].Ports, corev1.ContainerPort{ContainerPort: 15000})
+	out := testExplainPod(t, pod, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "bookinfo"}}, nil)
+	want := "Port conflicts, config proxy_ports conflicts \"warn\":\n  port 15000 of container productpage is reserved by the proxy\n"
+	if !strings.Contains(out, want) {
+		t.Fatalf("expected output to contain %q, got:\n%s", want, out)
+	}
+}
+
+func TestExplainProbePorts(t *testing.T) {
+	pod := &corev1.Pod{}
+	readManifest("testdata/pod.yaml", pod)
+	pod.Annotations["sidecar.istio.io/rewriteAppHTTPProbers"] = "false"
+	pod.Spec.Containers[0].Ports[0].Name = "http"
+	pod.Spec.Containers[0].ReadinessProbe = &corev1.Probe{Handler: corev1.Handler{
+		HTTPGet: &corev1.HTTPGetAction{Path: "/health", Port: intstr.FromString("http")},
+	}}
+	out := testExplainPod(t, pod, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "bookinfo"}}, nil)
+	words := strings.Join(strings.Fields(out), " ")
+	for _, want := range []string{
+		`includePorts "" annotation traffic.sidecar.istio.io/includeInboundPorts, probe ports`,
+		`excludeInboundPorts "15020,15021,15090,9080" default, probe ports`,
+		"excludeInboundPorts gets the probe ports 9080 as sidecar.istio.io/rewriteAppHTTPProbers is false",
+	} {
+		if !strings.Contains(words, want) {
+			t.Errorf("expected output to contain %q, got:\n%s", want, out)
+		}
+	}
+}
+
+func TestExplainMeshConfig(t *testing.T) {
+	cm := &corev1.ConfigMap{}
+	readManifest("testdata/istio-configmap.yaml", cm)
+	mesh, err := redirect.ParseMeshConfig(cm.Data[redirect.MeshConfigKey])
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := testExplain(t, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "bookinfo"}}, mesh)
+	words := strings.Join(strings.Fields(out), " ")
+	for _, want := range []string{
+		`excludeInboundPorts "15120,15021,15090" default`,
+		`excludeOutboundPorts "15120" default`,
+		`targetPort "15101" default`,
+	} {
+		if !strings.Contains(words, want) {
+			t.Errorf("expected output to contain %q, got:\n%s", want, out)
+		}
+	}
+}
+
+func TestExplainExcludedNamespace(t *testing.T) {
+	out := testExplain(t, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "kube-system"}}, nil)
+	if !strings.Contains(out, "Captured: no\n  namespace: ") || strings.Contains(out, "Rules:") {
+		t.Fatalf("expected namespace exclusion without rules, got:\n%s", out)
+	}
+}
+
+func TestExplainExcludedNamespaceAheadOfRules(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/istio-cni.conflist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf, err := parsePluginConf(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.Policy = []policy.Rule{{Name: "all", Match: "true", Action: policy.ActionInclude}}
+	pod := &corev1.Pod{}
+	readManifest("testdata/pod.yaml", pod)
+	pod.Namespace = "kube-system"
+	var out bytes.Buffer
+	(&explainer{conf: conf}).explain(&out, pod, nil)
+	if !strings.Contains(out.String(), "Captured: no\n  namespace: ") {
+		t.Fatalf("expected exclude_namespaces to win over the include rule, got:\n%s", out.String())
+	}
+}
+
+func TestLoadMeshConfig(t *testing.T) {
+	conf := &pluginConf{}
+	mesh, err := loadMeshConfig(conf, "testdata/istio-configmap.yaml")
+	if err != nil || mesh == nil || mesh.ProxyListenPort != 15101 {
+		t.Fatalf("expected the ConfigMap manifest without mesh_config_file, got %+v, %v", mesh, err)
+	}
+
+	conf.MeshConfigFile = "testdata/mesh.yaml"
+	mesh, err = loadMeshConfig(conf, "testdata/istio-configmap.yaml")
+	if err != nil || mesh == nil || mesh.ProxyListenPort != 15102 {
+		t.Fatalf("expected the plugin's mesh_config_file, got %+v, %v", mesh, err)
+	}
+
+	conf.MeshConfigFile = "testdata/missing.yaml"
+	if mesh, err = loadMeshConfig(conf, "testdata/istio-configmap.yaml"); err != nil || mesh != nil {
+		t.Fatalf("expected the built-in defaults like the plugin, got %+v, %v", mesh, err)
+	}
+}
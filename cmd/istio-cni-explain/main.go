@@ -0,0 +1,144 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// A command which explains, from a pod manifest, whether istio-cni would
+// capture the pod's traffic, with which parameters and which rules.
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+
+	"istio.io/cni/pkg/capture"
+	"istio.io/cni/pkg/redirect"
+	"istio.io/pkg/log"
+)
+
+var (
+	loggingOptions = log.DefaultOptions()
+)
+
+// Parse command line options
+func parseFlags() {
+	pflag.String("pod", "", "Pod manifest, YAML or JSON (required)")
+	pflag.String("namespace", "", "Namespace manifest of the pod, YAML or JSON")
+	pflag.String("cni-config", "", "CNI conflist or config holding the istio-cni plugin")
+	pflag.String("mesh-config", "", "The istio ConfigMap manifest, whose mesh config gives the redirect defaults")
+	pflag.String("bin-dir", "", "Directory holding istio-iptables.sh (default: cni_bin_dir of the CNI config, or "+
+		capture.DefaultBinDir+")")
+	pflag.Bool("help", false, "Print usage information")
+
+	pflag.Parse()
+	if err := viper.BindPFlags(pflag.CommandLine); err != nil {
+		log.Fatalf("Error parsing command line args: %v", err)
+	}
+
+	if viper.GetBool("help") || viper.GetString("pod") == "" {
+		pflag.Usage()
+		os.Exit(0)
+	}
+}
+
+// loadMeshConfig returns the mesh config of the plugin's mesh_config_file,
+// read as the plugin does, or else of the istio ConfigMap manifest at
+// configMapPath, if any. Like the plugin, a mesh_config_file which can't be
+// read or parsed is logged and the built-in defaults used.
+func loadMeshConfig(conf *pluginConf, configMapPath string) (*redirect.MeshConfig, error) {
+	if conf.MeshConfigFile != "" {
+		mesh, err := conf.ReadMeshConfigFile()
+		if err != nil {
+			log.Warnf("Failed to load mesh_config_file, the plugin uses the built-in defaults: %v", err)
+			return nil, nil
+		}
+		return mesh, nil
+	}
+	if configMapPath == "" {
+		return nil, nil
+	}
+	cm := &corev1.ConfigMap{}
+	readManifest(configMapPath, cm)
+	mesh, err := redirect.ParseMeshConfig(cm.Data[redirect.MeshConfigKey])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", configMapPath, err)
+	}
+	return mesh, nil
+}
+
+// readManifest decodes the YAML or JSON manifest at path into obj.
+func readManifest(path string, obj interface{}) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if err := yaml.Unmarshal(data, obj); err != nil {
+		log.Fatalf("Failed to parse %s: %v", path, err)
+	}
+}
+
+func main() {
+	loggingOptions.OutputPaths = []string{"stderr"}
+	loggingOptions.JSONEncoding = true
+	if err := log.Configure(loggingOptions); err != nil {
+		os.Exit(1)
+	}
+
+	parseFlags()
+
+	pod := &corev1.Pod{}
+	readManifest(viper.GetString("pod"), pod)
+	var ns *corev1.Namespace
+	if path := viper.GetString("namespace"); path != "" {
+		ns = &corev1.Namespace{}
+		readManifest(path, ns)
+	}
+	conf := &pluginConf{}
+	if path := viper.GetString("cni-config"); path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		if conf, err = parsePluginConf(data); err != nil {
+			log.Fatalf("Failed to parse %s: %v", path, err)
+		}
+		if err := conf.Validate(); err != nil {
+			log.Fatalf("Invalid %s: %v", path, err)
+		}
+	}
+
+	interceptType := conf.Kubernetes.InterceptRuleMgrType
+	if interceptType == "" {
+		interceptType = capture.DefaultInterceptRuleMgrType
+	}
+	ctor := capture.GetInterceptRuleMgrCtor(interceptType)
+	if ctor == nil {
+		log.Fatalf("Unknown intercept type %q", interceptType)
+	}
+	binDir := viper.GetString("bin-dir")
+	if binDir == "" {
+		binDir = conf.Kubernetes.CniBinDir
+	}
+
+	mesh, err := loadMeshConfig(conf, viper.GetString("mesh-config"))
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	e := &explainer{conf: conf, mgr: ctor(&capture.Config{BinDir: binDir}), mesh: mesh}
+	e.explain(os.Stdout, pod, ns)
+}
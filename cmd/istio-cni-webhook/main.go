@@ -0,0 +1,81 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// A validating admission webhook server which rejects, or warns about, pods
+// with invalid traffic annotations before they are created.
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+
+	"istio.io/cni/pkg/webhook"
+	"istio.io/pkg/log"
+)
+
+var (
+	loggingOptions = log.DefaultOptions()
+)
+
+// Parse command line options
+func parseFlags() {
+	pflag.Int("port", 9443, "Port to serve the webhook on")
+	pflag.String("tls-cert-file", "/etc/webhook/certs/cert.pem", "TLS certificate presented to the API server")
+	pflag.String("tls-key-file", "/etc/webhook/certs/key.pem", "Private key of the TLS certificate")
+	pflag.String("mode", webhook.ModeReject,
+		"What to do with pods with invalid traffic annotations: reject them, or warn and admit them")
+	pflag.Bool("help", false, "Print usage information")
+
+	pflag.Parse()
+	if err := viper.BindPFlags(pflag.CommandLine); err != nil {
+		log.Fatalf("Error parsing command line args: %v", err)
+	}
+
+	if viper.GetBool("help") {
+		pflag.Usage()
+		os.Exit(0)
+	}
+
+	viper.SetEnvPrefix("WEBHOOK")
+	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	viper.AutomaticEnv()
+}
+
+func main() {
+	loggingOptions.OutputPaths = []string{"stderr"}
+	loggingOptions.JSONEncoding = true
+	if err := log.Configure(loggingOptions); err != nil {
+		os.Exit(1)
+	}
+
+	parseFlags()
+
+	server, err := webhook.NewServer(viper.GetString("mode"))
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/validate", server)
+	mux.HandleFunc("/ready", func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) })
+
+	addr := fmt.Sprintf(":%d", viper.GetInt("port"))
+	log.Infof("Serving traffic annotation validation on %s in %s mode", addr, server.Mode)
+	err = http.ListenAndServeTLS(addr, viper.GetString("tls-cert-file"), viper.GetString("tls-key-file"), mux)
+	log.Fatalf("Webhook server stopped: %v", err)
+}
@@ -0,0 +1,57 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+
+	"k8s.io/client-go/kubernetes"
+
+	"istio.io/pkg/log"
+)
+
+// autoExcludeCIDRs returns the CIDRs of the destinations selected by the
+// auto_exclude plugin config. The Kubernetes Service and node addresses are
+// looked up with client, and skipped without one.
+func autoExcludeCIDRs(conf *PluginConf, client *kubernetes.Clientset) ([]string, error) {
+	ae := conf.AutoExclude
+	if !ae.KubernetesService && !ae.NodeIP {
+		return ae.CIDRs()
+	}
+	if client == nil {
+		log.Warnf("Skipping auto_exclude of the kubernetes Service and node IP without Kubernetes")
+		return ae.CIDRs()
+	}
+
+	var ips []string
+	if ae.KubernetesService {
+		svcIPs, err := getKubeServiceIPs(client, "default", "kubernetes")
+		if err != nil {
+			return nil, fmt.Errorf("auto_exclude kubernetes_service: %v", err)
+		}
+		ips = append(ips, svcIPs...)
+	}
+	if ae.NodeIP {
+		if conf.Kubernetes.NodeName == "" {
+			return nil, fmt.Errorf("auto_exclude node_ip needs kubernetes node_name")
+		}
+		nodeIPs, err := getKubeNodeIPs(client, conf.Kubernetes.NodeName)
+		if err != nil {
+			return nil, fmt.Errorf("auto_exclude node_ip: %v", err)
+		}
+		ips = append(ips, nodeIPs...)
+	}
+	return ae.CIDRs(ips...)
+}
@@ -0,0 +1,81 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/containernetworking/cni/pkg/types/current"
+)
+
+const (
+	// networkStatusKey is the Multus annotation listing the interfaces of
+	// every network attached to the pod.
+	networkStatusKey = "k8s.v1.cni.cncf.io/network-status"
+	// legacyNetworkStatusKey is the name used by Multus before 3.7.
+	legacyNetworkStatusKey = "k8s.v1.cni.cncf.io/networks-status"
+)
+
+// networkStatus is an entry of the Multus network status annotation.
+type networkStatus struct {
+	Interface string `json:"interface"`
+}
+
+// podInterfaces returns the names of the pod's interfaces listed in the CNI
+// result of the previous plugins and in the Multus network status annotation.
+// Multus only sets the annotation once every network is attached, so it is
+// usually missing on the first ADD of a pod. An invalid annotation is returned
+// as an error along with the interfaces of prevResult.
+func podInterfaces(prevResult *current.Result, annotations map[string]string) ([]string, error) {
+	interfaces := resultInterfaces(prevResult)
+	seen := map[string]bool{}
+	for _, name := range interfaces {
+		seen[name] = true
+	}
+	for _, key := range []string{networkStatusKey, legacyNetworkStatusKey} {
+		val, ok := annotations[key]
+		if !ok {
+			continue
+		}
+		var statuses []networkStatus
+		if err := json.Unmarshal([]byte(val), &statuses); err != nil {
+			return interfaces, fmt.Errorf("invalid %s annotation: %v", key, err)
+		}
+		for _, status := range statuses {
+			if status.Interface != "" && !seen[status.Interface] {
+				seen[status.Interface] = true
+				interfaces = append(interfaces, status.Interface)
+			}
+		}
+		break
+	}
+	return interfaces, nil
+}
+
+// resultInterfaces returns the names of the pod's interfaces in a CNI result.
+func resultInterfaces(result *current.Result) []string {
+	if result == nil {
+		return nil
+	}
+	var interfaces []string
+	for _, iface := range result.Interfaces {
+		// Interfaces without a sandbox are on the host, e.g. a bridge.
+		if iface != nil && iface.Sandbox != "" {
+			interfaces = append(interfaces, iface.Name)
+		}
+	}
+	return interfaces
+}
@@ -15,11 +15,16 @@
 package main
 
 import (
+	"fmt"
+
 	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
 
+	"istio.io/cni/pkg/policy"
+	"istio.io/cni/pkg/redirect"
 	"istio.io/pkg/log"
 )
 
@@ -29,6 +34,18 @@ var newKubeClient = newK8sClient
 // getKubePodInfo is a unit test override variable for interface create.
 var getKubePodInfo = getK8sPodInfo
 
+// getKubeNamespace is a unit test override variable for interface create.
+var getKubeNamespace = getCachedK8sNamespace
+
+// getKubeMeshConfig is a unit test override variable for interface create.
+var getKubeMeshConfig = getK8sMeshConfig
+
+// getKubeServiceIPs is a unit test override variable for interface create.
+var getKubeServiceIPs = getK8sServiceIPs
+
+// getKubeNodeIPs is a unit test override variable for interface create.
+var getKubeNodeIPs = getK8sNodeIPs
+
 // newK8sClient returns a Kubernetes client
 func newK8sClient(conf PluginConf) (*kubernetes.Clientset, error) {
 	// Some config can be passed in a kubeconfig file
@@ -54,30 +71,77 @@ func newK8sClient(conf PluginConf) (*kubernetes.Clientset, error) {
 }
 
 // getK8sPodInfo returns information of a POD
-func getK8sPodInfo(client *kubernetes.Clientset, podName, podNamespace string) (containers []string,
-	initContainers map[string]struct{}, labels map[string]string, annotations map[string]string, err error) {
+func getK8sPodInfo(client *kubernetes.Clientset, podName, podNamespace string) (*policy.Pod, error) {
 	pod, err := client.CoreV1().Pods(podNamespace).Get(podName, metav1.GetOptions{})
 	log.Infof("pod info %+v", pod)
 	if err != nil {
-		return nil, nil, nil, nil, err
+		return nil, err
 	}
 
-	initContainers = map[string]struct{}{}
-	for _, initContainer := range pod.Spec.InitContainers {
-		initContainers[initContainer.Name] = struct{}{}
-	}
-	containers = make([]string, len(pod.Spec.Containers))
-	for containerIdx, container := range pod.Spec.Containers {
+	for _, container := range pod.Spec.Containers {
 		log.Debug("Inspecting container",
 			zap.String("pod", podName),
 			zap.String("container", container.Name))
-		containers[containerIdx] = container.Name
+	}
+	return policy.NewPod(pod), nil
+}
+
+// getK8sNamespace returns the metadata of a namespace
+func getK8sNamespace(client *kubernetes.Clientset, name string) (*policy.Namespace, error) {
+	ns, err := client.CoreV1().Namespaces().Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return policy.NewNamespace(ns), nil
+}
+
+// getK8sMeshConfig returns the mesh config held in the "mesh" key of a
+// ConfigMap
+func getK8sMeshConfig(client *kubernetes.Clientset, namespace, name string) (string, error) {
+	cm, err := client.CoreV1().ConfigMaps(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	mesh, ok := cm.Data[redirect.MeshConfigKey]
+	if !ok {
+		return "", fmt.Errorf("ConfigMap %s/%s has no %q key", namespace, name, redirect.MeshConfigKey)
+	}
+	return mesh, nil
+}
 
-		if container.Name == "istio-proxy" {
-			// don't include ports from istio-proxy in the redirect ports
-			continue
+// getK8sServiceIPs returns the ClusterIP and endpoint addresses of a Service
+func getK8sServiceIPs(client *kubernetes.Clientset, namespace, name string) ([]string, error) {
+	svc, err := client.CoreV1().Services(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var ips []string
+	if svc.Spec.ClusterIP != "" && svc.Spec.ClusterIP != corev1.ClusterIPNone {
+		ips = append(ips, svc.Spec.ClusterIP)
+	}
+	eps, err := client.CoreV1().Endpoints(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, subset := range eps.Subsets {
+		for _, addr := range subset.Addresses {
+			ips = append(ips, addr.IP)
 		}
 	}
+	return ips, nil
+}
 
-	return containers, initContainers, pod.Labels, pod.Annotations, nil
+// getK8sNodeIPs returns the internal and external addresses of a node
+func getK8sNodeIPs(client *kubernetes.Clientset, name string) ([]string, error) {
+	node, err := client.CoreV1().Nodes().Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var ips []string
+	for _, addr := range node.Status.Addresses {
+		if addr.Type == corev1.NodeInternalIP || addr.Type == corev1.NodeExternalIP {
+			ips = append(ips, addr.Address)
+		}
+	}
+	return ips, nil
 }
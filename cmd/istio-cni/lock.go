@@ -0,0 +1,111 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// containerLockDir holds the lock files serializing the commands of each
+// container.
+var containerLockDir = "/var/run/istio-cni"
+
+// lockPollInterval is how often lockContainer retries a lock held by another
+// ADD.
+var lockPollInterval = 50 * time.Millisecond
+
+// lockContainer blocks until it holds the lock of containerID, so concurrent
+// ADDs of the same container program its netns one at a time, or until ctx is
+// done. The returned func releases the lock.
+func lockContainer(ctx context.Context, containerID string) (func(), error) {
+	if containerID == "" || filepath.Base(containerID) != containerID {
+		return nil, fmt.Errorf("invalid container id %q", containerID)
+	}
+	if err := os.MkdirAll(containerLockDir, 0755); err != nil {
+		return nil, err
+	}
+	for {
+		lock, err := flockFile(ctx, containerLockPath(containerID))
+		if err != nil {
+			return nil, err
+		}
+		// A DEL may have unlinked the file while we waited for its lock, and a
+		// later command would then lock a new file at the same path. Only the
+		// lock of the file still at the path counts.
+		if lockIsLinked(lock) {
+			return func() {
+				syscall.Flock(int(lock.Fd()), syscall.LOCK_UN) // nolint: errcheck
+				lock.Close()
+			}, nil
+		}
+		lock.Close()
+	}
+}
+
+// flockFile opens path and waits for an exclusive lock on it.
+func flockFile(ctx context.Context, path string) (*os.File, error) {
+	lock, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			return lock, nil
+		}
+		if err != syscall.EWOULDBLOCK {
+			lock.Close()
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			lock.Close()
+			return nil, fmt.Errorf("waiting for a concurrent command of the container: %v", ctx.Err())
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
+
+// lockIsLinked reports whether lock is still the file at its path.
+func lockIsLinked(lock *os.File) bool {
+	held, err := lock.Stat()
+	if err != nil {
+		return false
+	}
+	linked, err := os.Stat(lock.Name())
+	return err == nil && os.SameFile(held, linked)
+}
+
+// removeContainerLock deletes the lock file of a deleted container. It takes
+// the lock first, so that it never unlinks a file a concurrent command holds:
+// commands waiting for the lock then find the file unlinked, and retry on a
+// new one.
+func removeContainerLock(ctx context.Context, containerID string) error {
+	unlock, err := lockContainer(ctx, containerID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return os.Remove(containerLockPath(containerID))
+}
+
+func containerLockPath(containerID string) string {
+	return filepath.Join(containerLockDir, containerID+".lock")
+}
@@ -0,0 +1,108 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLockContainerSerializes(t *testing.T) {
+	unlock, err := lockContainer(context.Background(), "abc123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	locked := make(chan struct{})
+	go func() {
+		unlockSecond, err := lockContainer(context.Background(), "abc123")
+		if err != nil {
+			t.Error(err)
+			close(locked)
+			return
+		}
+		close(locked)
+		unlockSecond()
+	}()
+	select {
+	case <-locked:
+		t.Fatalf("expected the second lock to wait for the first")
+	case <-time.After(100 * time.Millisecond):
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := lockContainer(ctx, "abc123"); err == nil {
+		t.Fatalf("expected waiting for the lock to time out")
+	}
+	unlock()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the second lock after the first was released")
+	}
+
+	unlockOther, err := lockContainer(context.Background(), "def456")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlockOther()
+	if err := removeContainerLock(context.Background(), "def456"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(containerLockPath("def456")); !os.IsNotExist(err) {
+		t.Fatalf("expected the lock file to be removed, got %v", err)
+	}
+	if _, err := lockContainer(context.Background(), "../abc123"); err == nil {
+		t.Fatalf("expected a container id with a path to be rejected")
+	}
+}
+
+func TestRemoveContainerLockWithWaiter(t *testing.T) {
+	unlock, err := lockContainer(context.Background(), "ghi789")
+	if err != nil {
+		t.Fatal(err)
+	}
+	locked := make(chan func())
+	go func() {
+		unlockWaiter, err := lockContainer(context.Background(), "ghi789")
+		if err != nil {
+			t.Error(err)
+		}
+		locked <- unlockWaiter
+	}()
+	removed := make(chan error)
+	go func() {
+		removed <- removeContainerLock(context.Background(), "ghi789")
+	}()
+	time.Sleep(100 * time.Millisecond)
+	unlock()
+
+	// Whether or not the DEL unlinked the file first, the waiter must hold
+	// the lock of the file now at the path.
+	unlockWaiter := <-locked
+	if unlockWaiter == nil {
+		t.FailNow()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := lockContainer(ctx, "ghi789"); err == nil {
+		t.Fatalf("expected the waiter to still hold the lock of the container")
+	}
+	unlockWaiter()
+	if err := <-removed; err != nil {
+		t.Fatal(err)
+	}
+}
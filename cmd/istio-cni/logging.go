@@ -0,0 +1,226 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+
+	"github.com/natefinch/lumberjack"
+	"go.uber.org/zap"
+
+	"istio.io/pkg/log"
+)
+
+const (
+	// logSinkScheme is the zap sink scheme used for all plugin log output so
+	// that correlation fields can be added to every line.
+	logSinkScheme = "istio-cni"
+
+	defaultLogMaxSize    = 10
+	defaultLogMaxBackups = 5
+	defaultLogMaxAge     = 7
+)
+
+var (
+	logLevels = map[string]log.Level{
+		"debug": log.DebugLevel,
+		"info":  log.InfoLevel,
+		"warn":  log.WarnLevel,
+		"error": log.ErrorLevel,
+		"fatal": log.FatalLevel,
+		"none":  log.NoneLevel,
+	}
+
+	// logCorrelation holds the pre-encoded JSON fields prepended to every log
+	// line written by this invocation of the plugin.
+	logCorrelation []byte
+)
+
+// Logging holds the plugin's log sink configuration
+type Logging struct {
+	// File is a node path the plugin appends its log lines to, in addition to stderr.
+	File string `json:"file"`
+	// MaxSize is the size in megabytes at which File is rotated.
+	MaxSize int `json:"max_size"`
+	// MaxBackups is the number of rotated files to keep.
+	MaxBackups int `json:"max_backups"`
+	// MaxAge is the number of days to keep rotated files.
+	MaxAge int `json:"max_age"`
+	// NamespaceLevels overrides log_level for pods in the given namespaces.
+	NamespaceLevels map[string]string `json:"namespace_levels"`
+}
+
+func init() {
+	if err := zap.RegisterSink(logSinkScheme, newLogSink); err != nil {
+		panic(err)
+	}
+}
+
+// correlatedSink prepends the invocation's correlation fields to every JSON
+// encoded log line.
+type correlatedSink struct {
+	zap.Sink
+	fields []byte
+}
+
+func (s *correlatedSink) Write(p []byte) (int, error) {
+	if len(s.fields) == 0 || len(p) < 2 || p[0] != '{' {
+		return s.Sink.Write(p)
+	}
+	var buf bytes.Buffer
+	buf.Grow(len(p) + len(s.fields) + 1)
+	buf.WriteByte('{')
+	buf.Write(s.fields)
+	if p[1] != '}' {
+		buf.WriteByte(',')
+	}
+	buf.Write(p[1:])
+	if _, err := s.Sink.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+type rotatingSink struct {
+	*lumberjack.Logger
+}
+
+func (rotatingSink) Sync() error {
+	return nil
+}
+
+type stderrSink struct {
+	*os.File
+}
+
+// Close is a no-op so that reconfiguring the logger does not close stderr.
+func (stderrSink) Close() error {
+	return nil
+}
+
+// newLogSink builds the sink for a logSinkScheme URL, either "istio-cni:stderr"
+// or "istio-cni:///path/to/file?max_size=10&max_backups=5&max_age=7".
+func newLogSink(u *url.URL) (zap.Sink, error) {
+	if u.Opaque == "stderr" {
+		return &correlatedSink{Sink: stderrSink{os.Stderr}, fields: logCorrelation}, nil
+	}
+	if u.Path == "" {
+		return nil, fmt.Errorf("no log file path in %q", u.String())
+	}
+	query := u.Query()
+	lj := &lumberjack.Logger{Filename: u.Path}
+	for _, opt := range []struct {
+		name string
+		val  *int
+	}{
+		{"max_size", &lj.MaxSize},
+		{"max_backups", &lj.MaxBackups},
+		{"max_age", &lj.MaxAge},
+	} {
+		if v := query.Get(opt.name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q for log file %s: %v", opt.name, v, u.Path, err)
+			}
+			*opt.val = n
+		}
+	}
+	return &correlatedSink{Sink: rotatingSink{lj}, fields: logCorrelation}, nil
+}
+
+// logFileURL returns the sink URL for the rotated log file described by l.
+func logFileURL(l Logging) string {
+	maxSize, maxBackups, maxAge := l.MaxSize, l.MaxBackups, l.MaxAge
+	if maxSize <= 0 {
+		maxSize = defaultLogMaxSize
+	}
+	if maxBackups <= 0 {
+		maxBackups = defaultLogMaxBackups
+	}
+	if maxAge <= 0 {
+		maxAge = defaultLogMaxAge
+	}
+	query := url.Values{}
+	query.Set("max_size", strconv.Itoa(maxSize))
+	query.Set("max_backups", strconv.Itoa(maxBackups))
+	query.Set("max_age", strconv.Itoa(maxAge))
+	u := url.URL{Scheme: logSinkScheme, Path: l.File, RawQuery: query.Encode()}
+	return u.String()
+}
+
+// encodeCorrelation renders the non-empty correlation fields as the inside of
+// a JSON object, in a stable order.
+func encodeCorrelation(containerID, podUID, traceID string) []byte {
+	var buf bytes.Buffer
+	for _, f := range []struct{ key, val string }{
+		{"containerID", containerID},
+		{"podUID", podUID},
+		{"traceID", traceID},
+	} {
+		if f.val == "" {
+			continue
+		}
+		if buf.Len() > 0 {
+			buf.WriteByte(',')
+		}
+		val, _ := json.Marshal(f.val)
+		fmt.Fprintf(&buf, "%q:%s", f.key, val)
+	}
+	return buf.Bytes()
+}
+
+// resolveLogLevel returns the log level to use for a pod in the given
+// namespace, preferring a namespace override over the plugin-wide level.
+func resolveLogLevel(conf *PluginConf, namespace string) string {
+	if lvl, ok := conf.Logging.NamespaceLevels[namespace]; ok && namespace != "" {
+		return lvl
+	}
+	return conf.LogLevel
+}
+
+// configureLogging reconfigures the plugin logger for a single invocation,
+// adding the file sink, correlation IDs and the effective log level. An
+// invalid level falls back to info, and is reported through the configured
+// sinks.
+func configureLogging(conf *PluginConf, containerID string, k8sArgs K8sArgs, traceID string) error {
+	logCorrelation = encodeCorrelation(containerID, string(k8sArgs.K8S_POD_UID), traceID)
+
+	opts := log.DefaultOptions()
+	opts.JSONEncoding = true
+	opts.OutputPaths = []string{logSinkScheme + ":stderr"}
+	if conf.Logging.File != "" {
+		opts.OutputPaths = append(opts.OutputPaths, logFileURL(conf.Logging))
+	}
+	lvl := resolveLogLevel(conf, string(k8sArgs.K8S_POD_NAMESPACE))
+	level, ok := logLevels[lvl]
+	if lvl != "" {
+		if !ok {
+			level = log.InfoLevel
+		}
+		opts.SetOutputLevel(log.DefaultScopeName, level)
+	}
+	if err := log.Configure(opts); err != nil {
+		return err
+	}
+	if lvl != "" && !ok {
+		log.Warnf("Invalid log level %q, using info", lvl)
+	}
+	return nil
+}
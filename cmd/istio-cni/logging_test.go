@@ -0,0 +1,151 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"istio.io/pkg/log"
+)
+
+func TestCorrelatedLogFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "istio-cni-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logCorrelation = encodeCorrelation("testContainerID", "testPodUID", "")
+	defer func() { logCorrelation = nil }()
+
+	path := filepath.Join(dir, "istio-cni.log")
+	u, err := url.Parse(logFileURL(Logging{File: path}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := u.Query().Get("max_size"); got != "10" {
+		t.Fatalf("expected default max_size 10, got %q", got)
+	}
+	sink, err := newLogSink(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sink.Write([]byte(`{"level":"info","msg":"hello"}` + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := map[string]string{}
+	if err := json.Unmarshal(out, &line); err != nil {
+		t.Fatalf("log line %q is not valid JSON: %v", out, err)
+	}
+	if line["containerID"] != "testContainerID" || line["podUID"] != "testPodUID" || line["msg"] != "hello" {
+		t.Fatalf("unexpected log line %v", line)
+	}
+}
+
+func TestResolveLogLevel(t *testing.T) {
+	conf := &PluginConf{
+		LogLevel: "warn",
+		Logging:  Logging{NamespaceLevels: map[string]string{"debug-ns": "debug"}},
+	}
+	if lvl := resolveLogLevel(conf, "debug-ns"); lvl != "debug" {
+		t.Fatalf("expected namespace override debug, got %q", lvl)
+	}
+	if lvl := resolveLogLevel(conf, "other-ns"); lvl != "warn" {
+		t.Fatalf("expected plugin level warn, got %q", lvl)
+	}
+}
+
+func TestConfigureLoggingInvalidLevel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "istio-cni-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() {
+		logCorrelation = nil
+		_ = log.Configure(loggingOptions)
+	}()
+
+	path := filepath.Join(dir, "istio-cni.log")
+	conf := &PluginConf{LogLevel: "verbose", Logging: Logging{File: path}}
+	if err := configureLogging(conf, "testContainerID", K8sArgs{}, ""); err != nil {
+		t.Fatal(err)
+	}
+	log.Info("hello")
+
+	out, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), `Invalid log level \"verbose\", using info`) || !strings.Contains(string(out), "hello") {
+		t.Fatalf("expected the invalid level warning and info lines in the log file, got %q", out)
+	}
+}
+
+func TestParseFailuresLoggedToFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "istio-cni-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() {
+		logCorrelation = nil
+		_ = log.Configure(loggingOptions)
+	}()
+
+	path := filepath.Join(dir, "istio-cni.log")
+	stdinData := `{
+    "cniVersion": "0.3.0",
+    "name": "istio-plugin-sample-test",
+    "type": "sample",
+    "prevResult": {"ips": "invalid"},
+    "logging": {"file": "` + path + `"}
+    }`
+	if err := cmdAdd(testSetArgs(stdinData)); err == nil {
+		t.Fatal("expected the invalid prevResult to fail the ADD")
+	}
+	args := testSetArgs(strings.Replace(stdinData, `"prevResult": {"ips": "invalid"},`, "", 1))
+	args.Args = "K8S_POD_NAME"
+	if err := cmdAdd(args); err == nil {
+		t.Fatal("expected the invalid CNI args to fail the ADD")
+	}
+
+	out, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"could not parse prevResult", "Failed to load CNI args"} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("expected %q in the log file, got %q", want, out)
+		}
+	}
+	if !strings.Contains(string(out), `"containerID":"testContainerID"`) {
+		t.Errorf("expected the container ID in the log file, got %q", out)
+	}
+}
@@ -17,54 +17,47 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
-	"istio.io/api/annotation"
-
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
 	"github.com/containernetworking/cni/pkg/types/current"
 	"github.com/containernetworking/cni/pkg/version"
+	"go.uber.org/multierr"
 	"go.uber.org/zap"
 
+	"istio.io/cni/pkg/capture"
+	"istio.io/cni/pkg/plan"
+	"istio.io/cni/pkg/policy"
+	"istio.io/cni/pkg/redirect"
 	"istio.io/pkg/log"
 )
 
 var (
-	nsSetupBinDir          = "/opt/cni/bin"
-	injectAnnotationKey    = annotation.SidecarInject.Name
-	sidecarStatusKey       = annotation.SidecarStatus.Name
-	interceptRuleMgrType   = defInterceptRuleMgrType
+	nsSetupBinDir          = capture.DefaultBinDir
+	interceptRuleMgrType   = capture.DefaultInterceptRuleMgrType
+	iptablesBackend        = capture.BackendAuto
+	programTimeout         = capture.DefaultProgramTimeout
+	verifyRules            = ""
 	loggingOptions         = log.DefaultOptions()
 	podRetrievalMaxRetries = 30
 	podRetrievalInterval   = 1 * time.Second
 )
 
-const ISTIOINIT = "istio-init"
-
-// Kubernetes a K8s specific struct to hold config
-type Kubernetes struct {
-	K8sAPIRoot           string   `json:"k8s_api_root"`
-	Kubeconfig           string   `json:"kubeconfig"`
-	InterceptRuleMgrType string   `json:"intercept_type"`
-	NodeName             string   `json:"node_name"`
-	ExcludeNamespaces    []string `json:"exclude_namespaces"`
-	CniBinDir            string   `json:"cni_bin_dir"`
-}
-
 // PluginConf is whatever you expect your configuration json to be. This is whatever
 // is passed in on stdin. Your plugin may wish to expose its functionality via
 // runtime args, see CONVENTIONS.md in the CNI spec.
 type PluginConf struct {
-	types.NetConf // You may wish to not nest this type
-	RuntimeConfig *struct {
-		// SampleConfig map[string]interface{} `json:"sample"`
-	} `json:"runtimeConfig"`
+	types.NetConf                // You may wish to not nest this type
+	RuntimeConfig *RuntimeConfig `json:"runtimeConfig"`
 
 	// This is the previous result, when called in the context of a chained
 	// plugin. Because this plugin supports multiple versions, we'll have to
@@ -77,8 +70,13 @@ type PluginConf struct {
 	PrevResult    *current.Result         `json:"-"`
 
 	// Add plugin-specific flags here
-	LogLevel   string     `json:"log_level"`
-	Kubernetes Kubernetes `json:"kubernetes"`
+	LogLevel string  `json:"log_level"`
+	Logging  Logging `json:"logging"`
+	Metrics  Metrics `json:"metrics"`
+	Tracing  Tracing `json:"tracing"`
+	// Config holds the settings which decide whether and how pods are
+	// captured.
+	plan.Config
 }
 
 // K8sArgs is the valid CNI_ARGS used for Kubernetes
@@ -89,6 +87,7 @@ type K8sArgs struct {
 	K8S_POD_NAME               types.UnmarshallableString // nolint: golint, stylecheck
 	K8S_POD_NAMESPACE          types.UnmarshallableString // nolint: golint, stylecheck
 	K8S_POD_INFRA_CONTAINER_ID types.UnmarshallableString // nolint: golint, stylecheck
+	K8S_POD_UID                types.UnmarshallableString // nolint: golint, stylecheck
 }
 
 // parseConfig parses the supplied configuration (and prevResult) from stdin.
@@ -100,19 +99,20 @@ func parseConfig(stdin []byte) (*PluginConf, error) {
 	}
 
 	// Parse previous result. Remove this if your plugin is not chained.
+	// The config is still returned on errors, for the metrics of the failure.
 	if conf.RawPrevResult != nil {
 		resultBytes, err := json.Marshal(conf.RawPrevResult)
 		if err != nil {
-			return nil, fmt.Errorf("could not serialize prevResult: %v", err)
+			return &conf, fmt.Errorf("could not serialize prevResult: %v", err)
 		}
 		res, err := version.NewResult(conf.CNIVersion, resultBytes)
 		if err != nil {
-			return nil, fmt.Errorf("could not parse prevResult: %v", err)
+			return &conf, fmt.Errorf("could not parse prevResult: %v", err)
 		}
 		conf.RawPrevResult = nil
 		conf.PrevResult, err = current.NewResultFromResult(res)
 		if err != nil {
-			return nil, fmt.Errorf("could not convert result to current version: %v", err)
+			return &conf, fmt.Errorf("could not convert result to current version: %v", err)
 		}
 	}
 	// End previous result parsing
@@ -121,12 +121,43 @@ func parseConfig(stdin []byte) (*PluginConf, error) {
 }
 
 // cmdAdd is called for ADD requests
-func cmdAdd(args *skel.CmdArgs) error {
-	conf, err := parseConfig(args.StdinData)
+func cmdAdd(args *skel.CmdArgs) (err error) {
+	start := time.Now()
+	var conf *PluginConf
+	defer func() { recordCommand(conf, "add", start, err) }()
+	if conf, err = parseConfig(args.StdinData); conf == nil {
+		log.Errorf("istio-cni cmdAdd parsing config %v", err)
+		return err
+	}
+
+	// Logging is configured as soon as the config is decoded, so that the
+	// failures to parse the prevResult or the CNI args reach the log file
+	// with the correlation IDs.
+	k8sArgs := K8sArgs{}
+	argsErr := types.LoadArgs(args.Args, &k8sArgs)
+	trc, trcErr := newTracer(conf.Tracing)
+	if err := configureLogging(conf, args.ContainerID, k8sArgs, trc.TraceID()); err != nil {
+		log.Warnf("Failed to configure logging: %v", err)
+	}
 	if err != nil {
 		log.Errorf("istio-cni cmdAdd parsing config %v", err)
 		return err
 	}
+	if argsErr != nil {
+		log.Error("Failed to load CNI args", zap.Error(argsErr))
+		return argsErr
+	}
+	if trcErr != nil {
+		log.Warnf("Tracing disabled: %v", trcErr)
+	}
+	root := trc.StartAt("cmdAdd", nil, start)
+	trc.StartAt("parseConfig", root, start).End(nil)
+	defer func() {
+		root.End(err)
+		if exportErr := trc.Export(); exportErr != nil {
+			log.Warnf("Failed to export trace %s: %v", trc.TraceID(), exportErr)
+		}
+	}()
 
 	var loggedPrevResult interface{}
 	if conf.PrevResult == nil {
@@ -139,11 +170,9 @@ func cmdAdd(args *skel.CmdArgs) error {
 		zap.String("version", conf.CNIVersion),
 		zap.Reflect("prevResult", loggedPrevResult))
 
-	// Determine if running under k8s by checking the CNI args
-	k8sArgs := K8sArgs{}
-	if err := types.LoadArgs(args.Args, &k8sArgs); err != nil {
-		return err
-	}
+	root.SetAttr("container_id", args.ContainerID)
+	root.SetAttr("pod", string(k8sArgs.K8S_POD_NAME))
+	root.SetAttr("namespace", string(k8sArgs.K8S_POD_NAMESPACE))
 	log.Infof("Getting identifiers with arguments: %s", args.Args)
 	log.Infof("Loaded k8s arguments: %v", k8sArgs)
 	if conf.Kubernetes.CniBinDir != "" {
@@ -152,6 +181,32 @@ func cmdAdd(args *skel.CmdArgs) error {
 	if conf.Kubernetes.InterceptRuleMgrType != "" {
 		interceptRuleMgrType = conf.Kubernetes.InterceptRuleMgrType
 	}
+	if err := capture.ValidateBackend(conf.Kubernetes.IptablesBackend); err != nil {
+		return fmt.Errorf("invalid iptables_backend: %v", err)
+	}
+	if conf.Kubernetes.IptablesBackend != "" {
+		iptablesBackend = conf.Kubernetes.IptablesBackend
+	}
+	if conf.Kubernetes.ProgramTimeout != "" {
+		timeout, err := time.ParseDuration(conf.Kubernetes.ProgramTimeout)
+		if err != nil {
+			return fmt.Errorf("invalid program_timeout %q: %v", conf.Kubernetes.ProgramTimeout, err)
+		}
+		if timeout <= 0 {
+			return fmt.Errorf("invalid program_timeout %q: must be positive", conf.Kubernetes.ProgramTimeout)
+		}
+		programTimeout = timeout
+	}
+	switch conf.Kubernetes.VerifyRules {
+	case "", verifyRulesWarn, verifyRulesFail:
+		verifyRules = conf.Kubernetes.VerifyRules
+	default:
+		return fmt.Errorf("invalid verify_rules %q: must be %s or %s", conf.Kubernetes.VerifyRules, verifyRulesWarn, verifyRulesFail)
+	}
+	if err := conf.Validate(); err != nil {
+		log.Error("Invalid plugin config", zap.Error(err))
+		return err
+	}
 
 	log.Info("",
 		zap.String("ContainerID", args.ContainerID),
@@ -161,25 +216,30 @@ func cmdAdd(args *skel.CmdArgs) error {
 
 	// Check if the workload is running under Kubernetes.
 	if string(k8sArgs.K8S_POD_NAMESPACE) != "" && string(k8sArgs.K8S_POD_NAME) != "" {
-		excludePod := false
-		for _, excludeNs := range conf.Kubernetes.ExcludeNamespaces {
-			if string(k8sArgs.K8S_POD_NAMESPACE) == excludeNs {
-				excludePod = true
-				break
-			}
+		capturePolicy, err := conf.CompilePolicy()
+		if err != nil {
+			log.Error("Invalid policy", zap.Error(err))
+			return err
 		}
-		if !excludePod {
+		// The policy excludes the namespaces before looking up the pod.
+		if excluded, ok := capturePolicy.ExcludedNamespace(string(k8sArgs.K8S_POD_NAMESPACE)); !ok {
+			clientSpan := trc.Start("newKubeClient", root)
 			client, err := newKubeClient(*conf)
+			clientSpan.End(err)
 			if err != nil {
 				return err
 			}
 			log.Debug("Created Kubernetes client", zap.Reflect("client", client))
-			var containers []string
-			var initContainersMap map[string]struct{}
-			var annotations map[string]string
+			var pod *policy.Pod
 			var k8sErr error
 			for attempt := 1; attempt <= podRetrievalMaxRetries; attempt++ {
-				containers, initContainersMap, _, annotations, k8sErr = getKubePodInfo(client, string(k8sArgs.K8S_POD_NAME), string(k8sArgs.K8S_POD_NAMESPACE))
+				lookupStart := time.Now()
+				lookupSpan := trc.StartAt("getKubePodInfo", root, lookupStart)
+				lookupSpan.SetAttr("attempt", strconv.Itoa(attempt))
+				pod, k8sErr = getKubePodInfo(client, string(k8sArgs.K8S_POD_NAME), string(k8sArgs.K8S_POD_NAMESPACE))
+				lookupSpan.End(k8sErr)
+				pluginMetrics.ObserveSince(podLookupDuration, lookupStart)
+				pluginMetrics.Inc(podLookupAttempts, "outcome", outcome(k8sErr))
 				if k8sErr == nil {
 					break
 				}
@@ -191,57 +251,101 @@ func cmdAdd(args *skel.CmdArgs) error {
 				return k8sErr
 			}
 
-			// Check if istio-init container is present; in that case exclude pod
-			if _, present := initContainersMap[ISTIOINIT]; present {
-				log.Info("Pod excluded due to being already injected with istio-init container",
-					zap.String("pod", string(k8sArgs.K8S_POD_NAME)),
-					zap.String("namespace", string(k8sArgs.K8S_POD_NAMESPACE)))
-				excludePod = true
-			}
-
-			log.Infof("Found containers %v", containers)
-			if len(containers) > 1 {
+			// The pod is named by the CNI args.
+			pod.Name = string(k8sArgs.K8S_POD_NAME)
+			pod.Namespace = string(k8sArgs.K8S_POD_NAMESPACE)
+			annotations := pod.Annotations
+			log.Infof("Found containers %v", pod.Containers)
+			if len(pod.Containers) > 1 {
 				log.Info("Checking annotations prior to redirect for Istio proxy",
 					zap.String("ContainerID", args.ContainerID),
 					zap.String("netns", args.Netns),
 					zap.String("pod", string(k8sArgs.K8S_POD_NAME)),
 					zap.String("Namespace", string(k8sArgs.K8S_POD_NAMESPACE)),
 					zap.Reflect("annotations", annotations))
-				if val, ok := annotations[injectAnnotationKey]; ok {
-					log.Infof("Pod %s contains inject annotation: %s", string(k8sArgs.K8S_POD_NAME), val)
-					if injectEnabled, err := strconv.ParseBool(val); err == nil {
-						if !injectEnabled {
-							log.Infof("Pod excluded due to inject-disabled annotation")
-							excludePod = true
-						}
-					}
+			}
+			// The namespace is looked up at most once, for both the policy and
+			// the namespace defaults.
+			var ns *policy.Namespace
+			if capturePolicy.NeedsNamespaceMetadata() || conf.Kubernetes.NamespaceDefaults {
+				nsSpan := trc.Start("getKubeNamespace", root)
+				ns, err = getKubeNamespace(client, pod.Namespace)
+				nsSpan.End(err)
+				if err != nil {
+					log.Error("Failed to get namespace data", zap.Error(err))
+					return err
 				}
-				if _, ok := annotations[sidecarStatusKey]; !ok {
-					log.Infof("Pod %s excluded due to not containing sidecar annotation", string(k8sArgs.K8S_POD_NAME))
-					excludePod = true
+			}
+			decision, err := capturePolicy.Evaluate(pod, ns)
+			if err != nil {
+				log.Error("Failed to evaluate the capture policy", zap.Error(err))
+				return err
+			}
+			interfaces, ifErr := podInterfaces(conf.PrevResult, annotations)
+			if ifErr != nil {
+				log.Warn("Ignoring network status", zap.Error(ifErr))
+			}
+			if !decision.Capture {
+				log.Info("Pod excluded",
+					zap.String("pod", pod.Name),
+					zap.String("namespace", pod.Namespace),
+					zap.String("rule", decision.Rule),
+					zap.String("reason", decision.Description))
+				pluginMetrics.Inc(podsExcluded, "reason", string(decision.Reason))
+			} else {
+				if len(decision.Redirect) > 0 {
+					log.Info("Applying policy redirect overrides",
+						zap.String("rule", decision.Rule),
+						zap.Reflect("overrides", decision.Redirect))
 				}
-				if !excludePod {
-					log.Infof("setting up redirect")
-					if redirect, redirErr := NewRedirect(annotations); redirErr != nil {
-						log.Errorf("Pod redirect failed due to bad params: %v", redirErr)
-					} else {
-						log.Infof("Redirect local ports: %v", redirect.includePorts)
-						// Get the constructor for the configured type of InterceptRuleMgr
-						interceptMgrCtor := GetInterceptRuleMgrCtor(interceptRuleMgrType)
-						if interceptMgrCtor == nil {
-							log.Errorf("Pod redirect failed due to unavailable InterceptRuleMgr of type %s",
-								interceptRuleMgrType)
-						} else {
-							rulesMgr := interceptMgrCtor()
-							if err := rulesMgr.Program(args.Netns, redirect); err != nil {
-								return err
-							}
-						}
-					}
+				layers, err := conf.Layers(ns, annotations, decision.Redirect)
+				if err != nil {
+					return err
+				}
+				autoExcluded, err := autoExcludeCIDRs(conf, client)
+				if err != nil {
+					log.Error("Failed to look up auto excluded destinations", zap.Error(err))
+					return err
+				}
+				if err := setupRedirect(args, trc, root, conf, plan.Input{
+					Mesh:         loadMeshConfig(conf, client),
+					Layers:       layers,
+					AutoExcluded: autoExcluded,
+					Primary:      args.IfName,
+					Interfaces:   interfaces,
+					Pod:          pod,
+				}); err != nil {
+					return err
 				}
 			}
 		} else {
-			log.Infof("Pod excluded")
+			log.Info("Pod excluded", zap.String("rule", excluded.Rule), zap.String("reason", excluded.Description))
+			pluginMetrics.Inc(podsExcluded, "reason", string(excluded.Reason))
+		}
+	} else if annotations, rcErr := runtimeConfigAnnotations(conf.RuntimeConfig); rcErr != nil {
+		log.Errorf("Invalid runtimeConfig: %v", rcErr)
+		return rcErr
+	} else if annotations != nil {
+		log.Info("Checking runtimeConfig prior to redirect for Istio proxy",
+			zap.String("ContainerID", args.ContainerID),
+			zap.String("netns", args.Netns),
+			zap.Reflect("annotations", annotations))
+		if reason := runtimeConfigExclusion(conf.RuntimeConfig, annotations); reason != "" {
+			log.Infof("Container %s excluded: %s", args.ContainerID, reason.Description())
+			pluginMetrics.Inc(podsExcluded, "reason", string(reason))
+		} else if autoExcluded, err := autoExcludeCIDRs(conf, nil); err != nil {
+			log.Error("Invalid auto_exclude", zap.Error(err))
+			return err
+		} else if layers, err := conf.Layers(nil, annotations, nil); err != nil {
+			return err
+		} else if err := setupRedirect(args, trc, root, conf, plan.Input{
+			Mesh:         loadMeshConfig(conf, nil),
+			Layers:       layers,
+			AutoExcluded: autoExcluded,
+			Primary:      args.IfName,
+			Interfaces:   resultInterfaces(conf.PrevResult),
+		}); err != nil {
+			return err
 		}
 	} else {
 		log.Infof("No Kubernetes Data")
@@ -259,22 +363,148 @@ func cmdAdd(args *skel.CmdArgs) error {
 	return types.PrintResult(result, conf.CNIVersion)
 }
 
-func cmdGet(args *skel.CmdArgs) error {
+// setupRedirect resolves the plan of the pod, see plan.Config.Resolve, and
+// programs its Redirect into the container's netns with the configured
+// InterceptRuleMgr.
+func setupRedirect(args *skel.CmdArgs, trc *tracer, root *span, conf *PluginConf, in plan.Input) error {
+	log.Infof("setting up redirect")
+	redirectSpan := trc.Start("redirect.Parse", root)
+	p, redirErr := conf.Resolve(in)
+	redirectSpan.End(redirErr)
+	if redirErr != nil {
+		for _, err := range multierr.Errors(redirErr) {
+			log.Errorf("Annotation value error: %v", err)
+		}
+		log.Errorf("Pod redirect failed due to bad params: %v", redirErr)
+		pluginMetrics.Inc(podsExcluded, "reason", "invalid_redirect")
+		return nil
+	}
+	rdrct := p.Redirect
+	if len(p.UnknownKubevirtInterfaces) > 0 {
+		log.Warn("kubevirtInterfaces are not interfaces of the pod, unless KubeVirt creates them later",
+			zap.Strings("kubevirtInterfaces", p.UnknownKubevirtInterfaces), zap.Strings("interfaces", in.Interfaces))
+	}
+	if len(p.ProbePorts) > 0 {
+		log.Info("Excluded probe ports from inbound capture as probe rewriting is disabled",
+			zap.Strings("probePorts", p.ProbePorts), zap.Strings("added", p.ProbePortsAdded))
+		root.SetAttr("probe_ports_excluded", strings.Join(p.ProbePorts, ","))
+	}
+	log.Info("Resolved redirect", zap.Reflect("redirect", rdrct), zap.Reflect("sources", p.Sources),
+		zap.Strings("autoExcluded", in.AutoExcluded), zap.Strings("interfaces", in.Interfaces))
+	log.Infof("Redirect local ports: %v", rdrct.IncludePorts)
+	if err := checkConflicts(&conf.ProxyPorts, p.Conflicts); err != nil {
+		return err
+	}
+	// Get the constructor for the configured type of InterceptRuleMgr
+	interceptMgrCtor := capture.GetInterceptRuleMgrCtor(interceptRuleMgrType)
+	if interceptMgrCtor == nil {
+		log.Errorf("Pod redirect failed due to unavailable InterceptRuleMgr of type %s",
+			interceptRuleMgrType)
+		return nil
+	}
+	rulesMgr := interceptMgrCtor(&capture.Config{BinDir: nsSetupBinDir, Backend: iptablesBackend})
+	// The timeout also bounds the wait for a concurrent ADD of the container.
+	ctx, cancel := context.WithTimeout(context.Background(), programTimeout)
+	defer cancel()
+	unlock, err := lockContainer(ctx, args.ContainerID)
+	if err != nil {
+		return fmt.Errorf("failed to lock container %s: %v", args.ContainerID, err)
+	}
+	defer unlock()
+	programStart := time.Now()
+	programSpan := trc.StartAt("InterceptRuleMgr.Program", root, programStart)
+	programSpan.SetAttr("intercept_type", interceptRuleMgrType)
+	err = rulesMgr.Program(ctx, args.Netns, rdrct)
+	programSpan.End(err)
+	pluginMetrics.ObserveSince(interceptDuration, programStart,
+		"type", interceptRuleMgrType, "outcome", outcome(err))
+	if err != nil {
+		var execErr *capture.ExecError
+		if errors.As(err, &execErr) {
+			log.Error("Programming capture rules failed",
+				zap.String("cause", string(execErr.Cause)),
+				zap.String("command", execErr.Command),
+				zap.Duration("timeout", programTimeout))
+		}
+		return fmt.Errorf("programming capture rules failed: %w", err)
+	}
+	if verifyRules != "" {
+		return verifyRedirect(ctx, trc, root, rulesMgr, args.Netns, rdrct)
+	}
+	return nil
+}
+
+const (
+	verifyRulesWarn = "warn"
+	verifyRulesFail = "fail"
+)
+
+// verifyRedirect compares the rules programmed in netns with rdrct. Differences
+// only fail the ADD if verify_rules is "fail".
+func verifyRedirect(ctx context.Context, trc *tracer, root *span, rulesMgr capture.InterceptRuleMgr,
+	netns string, rdrct *redirect.Redirect) error {
+	verifySpan := trc.Start("InterceptRuleMgr.Verify", root)
+	err := rulesMgr.Verify(ctx, netns, rdrct)
+	verifySpan.End(err)
+	if err == nil {
+		pluginMetrics.Inc(ruleVerifications, "outcome", "match")
+		log.Info("Verified capture rules", zap.String("netns", netns))
+		return nil
+	}
+	var mismatch *capture.MismatchError
+	if errors.As(err, &mismatch) {
+		pluginMetrics.Inc(ruleVerifications, "outcome", "mismatch")
+		log.Error("Programmed capture rules do not match the redirect, missing (-) and unexpected (+) rules:\n"+
+			mismatch.Diff.String(), zap.String("netns", netns))
+	} else {
+		pluginMetrics.Inc(ruleVerifications, "outcome", outcomeError)
+		log.Error("Failed to verify capture rules", zap.String("netns", netns), zap.Error(err))
+	}
+	if verifyRules == verifyRulesFail {
+		return fmt.Errorf("verifying capture rules failed: %w", err)
+	}
+	return nil
+}
+
+func cmdGet(args *skel.CmdArgs) (err error) {
+	start := time.Now()
+	conf, _ := parseConfig(args.StdinData)
+	defer func() { recordCommand(conf, "check", start, err) }()
 	log.Info("cmdGet not implemented")
 	// TODO: implement
 	return fmt.Errorf("not implemented")
 }
 
 // cmdDel is called for DELETE requests
-func cmdDel(args *skel.CmdArgs) error {
+func cmdDel(args *skel.CmdArgs) (err error) {
+	start := time.Now()
+	var conf *PluginConf
+	defer func() { recordCommand(conf, "del", start, err) }()
 	log.Info("istio-cni cmdDel parsing config")
-	conf, err := parseConfig(args.StdinData)
+	if conf, err = parseConfig(args.StdinData); conf == nil {
+		log.Errorf("istio-cni cmdDel parsing config %v", err)
+		return err
+	}
+
+	k8sArgs := K8sArgs{}
+	argsErr := types.LoadArgs(args.Args, &k8sArgs)
+	if err := configureLogging(conf, args.ContainerID, k8sArgs, ""); err != nil {
+		log.Warnf("Failed to configure logging: %v", err)
+	}
 	if err != nil {
+		log.Errorf("istio-cni cmdDel parsing config %v", err)
 		return err
 	}
-	_ = conf
+	if argsErr != nil {
+		log.Warnf("Failed to load CNI args: %v", argsErr)
+	}
 
 	// Do your delete here
+	ctx, cancel := context.WithTimeout(context.Background(), programTimeout)
+	defer cancel()
+	if err := removeContainerLock(ctx, args.ContainerID); err != nil {
+		log.Warn("Failed to remove the container lock", zap.Error(err))
+	}
 
 	return nil
 }
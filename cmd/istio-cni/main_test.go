@@ -15,17 +15,26 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
 	"os"
-	"reflect"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
 	"github.com/containernetworking/cni/pkg/types/current"
 	"github.com/containernetworking/plugins/pkg/testutils"
 	"k8s.io/client-go/kubernetes"
+
+	"istio.io/api/annotation"
+	"istio.io/cni/pkg/capture"
+	"istio.io/cni/pkg/policy"
+	"istio.io/cni/pkg/redirect"
+	"istio.io/pkg/log"
 )
 
 var (
@@ -44,7 +53,16 @@ var (
 	testInitContainers = map[string]struct{}{
 		"foo-init": {},
 	}
+	testPorts                     = map[string][]string{}
+	testProbePorts                []string
 	singletonMockInterceptRuleMgr = &mockInterceptRuleMgr{}
+
+	injectAnnotationKey     = annotation.SidecarInject.Name
+	sidecarStatusKey        = annotation.SidecarStatus.Name
+	includePortsKey         = annotation.SidecarTrafficIncludeInboundPorts.Name
+	excludeInboundPortsKey  = annotation.SidecarTrafficExcludeInboundPorts.Name
+	excludeOutboundPortsKey = annotation.SidecarTrafficExcludeOutboundPorts.Name
+	kubevirtInterfacesKey   = annotation.SidecarTrafficKubevirtInterfaces.Name
 )
 
 var conf = `{
@@ -94,16 +112,29 @@ var conf = `{
     }`
 
 type mockInterceptRuleMgr struct {
-	lastRedirect []*Redirect
+	lastRedirect []*redirect.Redirect
+	verifyErr    error
 }
 
-func (mrdir *mockInterceptRuleMgr) Program(netns string, redirect *Redirect) error {
+func (mrdir *mockInterceptRuleMgr) Program(ctx context.Context, netns string, rdrct *redirect.Redirect) error {
 	nsenterFuncCalled = true
-	mrdir.lastRedirect = append(mrdir.lastRedirect, redirect)
+	mrdir.lastRedirect = append(mrdir.lastRedirect, rdrct)
 	return nil
 }
 
-func NewMockInterceptRuleMgr() InterceptRuleMgr {
+func (mrdir *mockInterceptRuleMgr) Render(netns string, rdrct *redirect.Redirect) ([]string, error) {
+	return nil, nil
+}
+
+func (mrdir *mockInterceptRuleMgr) Verify(ctx context.Context, netns string, rdrct *redirect.Redirect) error {
+	return mrdir.verifyErr
+}
+
+func (mrdir *mockInterceptRuleMgr) Remove(netns string, rdrct *redirect.Redirect) error {
+	return nil
+}
+
+func NewMockInterceptRuleMgr() capture.InterceptRuleMgr {
 	return singletonMockInterceptRuleMgr
 }
 
@@ -115,15 +146,15 @@ func mocknewK8sClient(conf PluginConf) (*kubernetes.Clientset, error) {
 	return &cs, nil
 }
 
-func mockgetK8sPodInfo(client *kubernetes.Clientset, podName, podNamespace string) (containers []string,
-	initContainers map[string]struct{}, labels map[string]string, annotations map[string]string, err error) {
-
-	containers = testContainers
-	labels = testLabels
-	annotations = testAnnotations
-	initContainers = testInitContainers
-
-	return containers, initContainers, labels, annotations, nil
+func mockgetK8sPodInfo(client *kubernetes.Clientset, podName, podNamespace string) (*policy.Pod, error) {
+	return &policy.Pod{
+		Containers:     testContainers,
+		InitContainers: testInitContainers,
+		Labels:         testLabels,
+		Annotations:    testAnnotations,
+		Ports:          testPorts,
+		ProbePorts:     testProbePorts,
+	}, nil
 }
 
 func resetGlobalTestVariables() {
@@ -133,8 +164,17 @@ func resetGlobalTestVariables() {
 	testContainers = []string{"mockContainer"}
 	testLabels = map[string]string{}
 	testAnnotations = map[string]string{}
+	testInitContainers = map[string]struct{}{
+		"foo-init": {},
+	}
+	testPorts = map[string][]string{}
+	testProbePorts = nil
 
 	interceptRuleMgrType = "mock"
+	iptablesBackend = capture.BackendAuto
+	programTimeout = capture.DefaultProgramTimeout
+	verifyRules = ""
+	singletonMockInterceptRuleMgr.verifyErr = nil
 	testAnnotations[sidecarStatusKey] = "true"
 	k8Args = "K8S_POD_NAMESPACE=istio-system;K8S_POD_NAME=testPodName"
 }
@@ -230,13 +270,13 @@ func TestCmdAddTwoContainers(t *testing.T) {
 	if !nsenterFuncCalled {
 		t.Fatalf("expected nsenterFunc to be called")
 	}
-	mockIntercept, ok := GetInterceptRuleMgrCtor("mock")().(*mockInterceptRuleMgr)
+	mockIntercept, ok := capture.GetInterceptRuleMgrCtor("mock")(nil).(*mockInterceptRuleMgr)
 	if !ok {
-		t.Fatalf("expect using mockInterceptRuleMgr, actual %v", InterceptRuleMgrTypes["mock"]())
+		t.Fatalf("expect using mockInterceptRuleMgr, actual %v", capture.InterceptRuleMgrTypes["mock"](nil))
 	}
 	r := mockIntercept.lastRedirect[len(mockIntercept.lastRedirect)-1]
-	if r.includePorts != "*" {
-		t.Fatalf("expect includePorts has value '*' set by istio, actual %v", r.includePorts)
+	if r.IncludePorts != "*" {
+		t.Fatalf("expect includePorts has value '*' set by istio, actual %v", r.IncludePorts)
 	}
 }
 
@@ -249,13 +289,13 @@ func TestCmdAddTwoContainersWithStarInboundPort(t *testing.T) {
 	if !nsenterFuncCalled {
 		t.Fatalf("expected nsenterFunc to be called")
 	}
-	mockIntercept, ok := GetInterceptRuleMgrCtor("mock")().(*mockInterceptRuleMgr)
+	mockIntercept, ok := capture.GetInterceptRuleMgrCtor("mock")(nil).(*mockInterceptRuleMgr)
 	if !ok {
-		t.Fatalf("expect using mockInterceptRuleMgr, actual %v", InterceptRuleMgrTypes["mock"]())
+		t.Fatalf("expect using mockInterceptRuleMgr, actual %v", capture.InterceptRuleMgrTypes["mock"](nil))
 	}
 	r := mockIntercept.lastRedirect[len(mockIntercept.lastRedirect)-1]
-	if r.includePorts != "*" {
-		t.Fatalf("expect includePorts is '*', actual %v", r.includePorts)
+	if r.IncludePorts != "*" {
+		t.Fatalf("expect includePorts is '*', actual %v", r.IncludePorts)
 	}
 }
 
@@ -269,13 +309,13 @@ func TestCmdAddTwoContainersWithEmptyInboundPort(t *testing.T) {
 	if !nsenterFuncCalled {
 		t.Fatalf("expected nsenterFunc to be called")
 	}
-	mockIntercept, ok := GetInterceptRuleMgrCtor("mock")().(*mockInterceptRuleMgr)
+	mockIntercept, ok := capture.GetInterceptRuleMgrCtor("mock")(nil).(*mockInterceptRuleMgr)
 	if !ok {
-		t.Fatalf("expect using mockInterceptRuleMgr, actual %v", InterceptRuleMgrTypes["mock"])
+		t.Fatalf("expect using mockInterceptRuleMgr, actual %v", capture.InterceptRuleMgrTypes["mock"])
 	}
 	r := mockIntercept.lastRedirect[len(mockIntercept.lastRedirect)-1]
-	if r.includePorts != "" {
-		t.Fatalf("expect includePorts is \"\", actual %v", r.includePorts)
+	if r.IncludePorts != "" {
+		t.Fatalf("expect includePorts is \"\", actual %v", r.IncludePorts)
 	}
 }
 
@@ -289,13 +329,13 @@ func TestCmdAddTwoContainersWithEmptyExcludeInboundPort(t *testing.T) {
 	if !nsenterFuncCalled {
 		t.Fatalf("expected nsenterFunc to be called")
 	}
-	mockIntercept, ok := GetInterceptRuleMgrCtor("mock")().(*mockInterceptRuleMgr)
+	mockIntercept, ok := capture.GetInterceptRuleMgrCtor("mock")(nil).(*mockInterceptRuleMgr)
 	if !ok {
-		t.Fatalf("expect using mockInterceptRuleMgr, actual %v", InterceptRuleMgrTypes["mock"])
+		t.Fatalf("expect using mockInterceptRuleMgr, actual %v", capture.InterceptRuleMgrTypes["mock"])
 	}
 	r := mockIntercept.lastRedirect[len(mockIntercept.lastRedirect)-1]
-	if r.excludeInboundPorts != "15020,15021,15090" {
-		t.Fatalf("expect excludeInboundPorts is \"15090\", actual %v", r.excludeInboundPorts)
+	if r.ExcludeInboundPorts != "15020,15021,15090" {
+		t.Fatalf("expect excludeInboundPorts is \"15090\", actual %v", r.ExcludeInboundPorts)
 	}
 }
 
@@ -309,13 +349,13 @@ func TestCmdAddTwoContainersWithExplictExcludeInboundPort(t *testing.T) {
 	if !nsenterFuncCalled {
 		t.Fatalf("expected nsenterFunc to be called")
 	}
-	mockIntercept, ok := GetInterceptRuleMgrCtor("mock")().(*mockInterceptRuleMgr)
+	mockIntercept, ok := capture.GetInterceptRuleMgrCtor("mock")(nil).(*mockInterceptRuleMgr)
 	if !ok {
-		t.Fatalf("expect using mockInterceptRuleMgr, actual %v", InterceptRuleMgrTypes["mock"])
+		t.Fatalf("expect using mockInterceptRuleMgr, actual %v", capture.InterceptRuleMgrTypes["mock"])
 	}
 	r := mockIntercept.lastRedirect[len(mockIntercept.lastRedirect)-1]
-	if r.excludeInboundPorts != "3306,15020,15021,15090" {
-		t.Fatalf("expect excludeInboundPorts is \"3306,15090\", actual %v", r.excludeInboundPorts)
+	if r.ExcludeInboundPorts != "3306,15020,15021,15090" {
+		t.Fatalf("expect excludeInboundPorts is \"3306,15090\", actual %v", r.ExcludeInboundPorts)
 	}
 }
 
@@ -381,6 +421,458 @@ func TestCmdAddWithKubevirtInterfaces(t *testing.T) {
 	}
 }
 
+var runtimeConfigConf = `{
+    "cniVersion": "0.3.0",
+    "name": "istio-plugin-sample-test",
+    "type": "sample",
+    "runtimeConfig": %s,
+    "kubernetes": {
+        "intercept_type": "mock"
+    }
+    }`
+
+func TestCmdAddRuntimeConfigRedirect(t *testing.T) {
+	defer resetGlobalTestVariables()
+	k8Args = ""
+
+	testCmdAddWithStdinData(t, fmt.Sprintf(runtimeConfigConf,
+		`{"istioRedirect": {"includePorts": "8080", "excludeOutboundPorts": "5432"}}`))
+
+	if getKubePodInfoCalled {
+		t.Fatalf("expected no Kubernetes API lookup for runtimeConfig")
+	}
+	if !nsenterFuncCalled {
+		t.Fatalf("expected nsenterFunc to be called")
+	}
+	r := singletonMockInterceptRuleMgr.lastRedirect[len(singletonMockInterceptRuleMgr.lastRedirect)-1]
+	if r.IncludePorts != "8080" || r.ExcludeOutboundPorts != "5432" {
+		t.Fatalf("expected redirect from runtimeConfig, got includePorts=%v excludeOutboundPorts=%v",
+			r.IncludePorts, r.ExcludeOutboundPorts)
+	}
+}
+
+func TestCmdAddRuntimeConfigPodAnnotationsWithoutSidecar(t *testing.T) {
+	defer resetGlobalTestVariables()
+	k8Args = ""
+
+	testCmdAddWithStdinData(t, fmt.Sprintf(runtimeConfigConf,
+		`{"io.kubernetes.cri.pod-annotations": {"app": "test"}}`))
+
+	if nsenterFuncCalled {
+		t.Fatalf("expected nsenterFunc to not get called without sidecar status annotation")
+	}
+}
+
+func TestCmdAddRuntimeConfigUnknownKey(t *testing.T) {
+	defer resetGlobalTestVariables()
+	k8Args = ""
+
+	args := testSetArgs(fmt.Sprintf(runtimeConfigConf, `{"istioRedirect": {"bogus": "1"}}`))
+	if err := cmdAdd(args); err == nil || !strings.Contains(err.Error(), `istioRedirect: unknown redirect parameter "bogus"`) {
+		t.Fatalf("expected unknown parameter error, got: %v", err)
+	}
+}
+
+var policyConf = `{
+    "cniVersion": "0.3.0",
+    "name": "istio-plugin-sample-test",
+    "type": "sample",
+    "kubernetes": {
+        "intercept_type": "mock"
+    },
+    "capture_policy": %s
+    }`
+
+func TestCmdAddPolicy(t *testing.T) {
+	defer resetGlobalTestVariables()
+	defer func() { getKubeNamespace = getCachedK8sNamespace }()
+	getKubeNamespace = func(client *kubernetes.Clientset, name string) (*policy.Namespace, error) {
+		return &policy.Namespace{Name: name, Labels: map[string]string{"team": "payments"}}, nil
+	}
+	testContainers = []string{"mockContainer", "mockContainer2"}
+	testLabels["app"] = "ledger"
+
+	testCmdAddWithStdinData(t, fmt.Sprintf(policyConf, `[
+		{"name": "no-batch", "match": "'batch' in pod.labels", "action": "exclude"},
+		{"name": "payments", "match": "namespace.labels.team == 'payments' && pod.labels.app == 'ledger'",
+		 "action": "include", "redirect": {"excludeOutboundPorts": "5432"}}]`))
+
+	if !nsenterFuncCalled {
+		t.Fatalf("expected nsenterFunc to be called")
+	}
+	r := singletonMockInterceptRuleMgr.lastRedirect[len(singletonMockInterceptRuleMgr.lastRedirect)-1]
+	if r.ExcludeOutboundPorts != "5432" {
+		t.Fatalf("expected excludeOutboundPorts from the payments rule, got %v", r.ExcludeOutboundPorts)
+	}
+
+	nsenterFuncCalled = false
+	testLabels["batch"] = "true"
+	testCmdAddWithStdinData(t, fmt.Sprintf(policyConf, `[
+		{"name": "no-batch", "match": "'batch' in pod.labels", "action": "exclude"}]`))
+	if nsenterFuncCalled {
+		t.Fatalf("expected nsenterFunc to not get called for a pod excluded by policy")
+	}
+}
+
+func TestCmdAddNamespaceDefaults(t *testing.T) {
+	defer resetGlobalTestVariables()
+	defer func() { getKubeNamespace = getCachedK8sNamespace }()
+	getKubeNamespace = func(client *kubernetes.Clientset, name string) (*policy.Namespace, error) {
+		return &policy.Namespace{Name: name, Annotations: map[string]string{
+			excludeOutboundPortsKey: "3306",
+			includePortsKey:         "9080",
+		}}, nil
+	}
+	testContainers = []string{"mockContainer", "mockContainer2"}
+	testAnnotations[includePortsKey] = "8080"
+
+	testCmdAddWithStdinData(t, `{
+    "cniVersion": "0.3.0",
+    "name": "istio-plugin-sample-test",
+    "type": "sample",
+    "redirect_defaults": {"excludeIPCidrs": "169.254.169.254/32", "excludeOutboundPorts": "5432"},
+    "kubernetes": {
+        "intercept_type": "mock",
+        "namespace_defaults": true
+    }
+    }`)
+
+	r := singletonMockInterceptRuleMgr.lastRedirect[len(singletonMockInterceptRuleMgr.lastRedirect)-1]
+	if r.ExcludeIPCidrs != "169.254.169.254/32" || r.ExcludeOutboundPorts != "3306" || r.IncludePorts != "8080" {
+		t.Fatalf("expected config, namespace and pod layers, got excludeIPCidrs=%v excludeOutboundPorts=%v includePorts=%v",
+			r.ExcludeIPCidrs, r.ExcludeOutboundPorts, r.IncludePorts)
+	}
+}
+
+func TestCmdAddMeshConfigDefaults(t *testing.T) {
+	defer resetGlobalTestVariables()
+	defer func() { getKubeMeshConfig = getK8sMeshConfig }()
+	getKubeMeshConfig = func(client *kubernetes.Clientset, namespace, name string) (string, error) {
+		if namespace != "istio-system" || name != "istio" {
+			return "", fmt.Errorf("unexpected ConfigMap %s/%s", namespace, name)
+		}
+		return "proxyListenPort: 15101\ndefaultConfig:\n  statusPort: 15120\n", nil
+	}
+	testContainers = []string{"mockContainer", "mockContainer2"}
+
+	testCmdAddWithStdinData(t, meshConfigMapConf)
+
+	r := singletonMockInterceptRuleMgr.lastRedirect[len(singletonMockInterceptRuleMgr.lastRedirect)-1]
+	if r.ExcludeInboundPorts != "15120,15021,15090" || r.ExcludeOutboundPorts != "15120" || r.TargetPort != "15101" {
+		t.Fatalf("expected ports from the mesh config, got excludeInboundPorts=%v excludeOutboundPorts=%v targetPort=%v",
+			r.ExcludeInboundPorts, r.ExcludeOutboundPorts, r.TargetPort)
+	}
+
+	testPorts = map[string][]string{"mockContainer": {"15120"}}
+	err := cmdAdd(testSetArgs(strings.Replace(meshConfigMapConf, `"kubernetes"`, `"proxy_ports": {"conflicts": "fail"}, "kubernetes"`, 1)))
+	if err == nil || !strings.Contains(err.Error(), "port 15120 of container mockContainer") {
+		t.Fatalf("expected the mesh status port to be reserved, got %v", err)
+	}
+}
+
+func TestCmdAddMeshConfigFallback(t *testing.T) {
+	defer resetGlobalTestVariables()
+	defer func() { getKubeMeshConfig = getK8sMeshConfig }()
+	getKubeMeshConfig = func(client *kubernetes.Clientset, namespace, name string) (string, error) {
+		return "", fmt.Errorf("configmaps %q is forbidden", name)
+	}
+	testContainers = []string{"mockContainer", "mockContainer2"}
+
+	testCmdAddWithStdinData(t, meshConfigMapConf)
+
+	r := singletonMockInterceptRuleMgr.lastRedirect[len(singletonMockInterceptRuleMgr.lastRedirect)-1]
+	if r.ExcludeInboundPorts != "15020,15021,15090" || r.TargetPort != redirect.DefaultRedirectToPort {
+		t.Fatalf("expected the built-in defaults, got excludeInboundPorts=%v targetPort=%v",
+			r.ExcludeInboundPorts, r.TargetPort)
+	}
+}
+
+const meshConfigMapConf = `{
+    "cniVersion": "0.3.0",
+    "name": "istio-plugin-sample-test",
+    "type": "sample",
+    "kubernetes": {
+        "intercept_type": "mock",
+        "mesh_config_map": "istio"
+    }
+    }`
+
+func TestCmdAddAutoExclude(t *testing.T) {
+	defer resetGlobalTestVariables()
+	defer func() { getKubeServiceIPs, getKubeNodeIPs = getK8sServiceIPs, getK8sNodeIPs }()
+	getKubeServiceIPs = func(client *kubernetes.Clientset, namespace, name string) ([]string, error) {
+		return []string{"10.96.0.1", "192.168.0.10"}, nil
+	}
+	getKubeNodeIPs = func(client *kubernetes.Clientset, name string) ([]string, error) {
+		if name != "testNodeName" {
+			return nil, fmt.Errorf("unexpected node %s", name)
+		}
+		return []string{"192.168.0.21", "fd00::21"}, nil
+	}
+	testContainers = []string{"mockContainer", "mockContainer2"}
+	testAnnotations[annotation.SidecarTrafficExcludeOutboundIPRanges.Name] = "10.10.0.0/16"
+
+	testCmdAddWithStdinData(t, `{
+    "cniVersion": "0.3.0",
+    "name": "istio-plugin-sample-test",
+    "type": "sample",
+    "auto_exclude": {
+        "kubernetes_service": true,
+        "node_local_dns": "169.254.20.10",
+        "link_local": true,
+        "node_ip": true
+    },
+    "kubernetes": {
+        "intercept_type": "mock",
+        "node_name": "testNodeName"
+    }
+    }`)
+
+	r := singletonMockInterceptRuleMgr.lastRedirect[len(singletonMockInterceptRuleMgr.lastRedirect)-1]
+	want := "10.10.0.0/16,169.254.0.0/16,169.254.20.10/32,10.96.0.1/32,192.168.0.10/32,192.168.0.21/32,fd00::21/128"
+	if r.ExcludeIPCidrs != want {
+		t.Fatalf("expected excludeIPCidrs %s, got %s", want, r.ExcludeIPCidrs)
+	}
+}
+
+func TestCmdAddSecondaryInterfaces(t *testing.T) {
+	defer resetGlobalTestVariables()
+
+	testContainers = []string{"mockContainer", "mockContainer2"}
+	testAnnotations[redirect.ExcludeInterfacesKey] = "net3"
+	testAnnotations[networkStatusKey] = `[
+    {"name": "cbr0", "interface": "eth0", "ips": ["10.0.0.2"], "default": true},
+    {"name": "default/sriov", "interface": "net2", "ips": ["192.168.10.2"]}
+]`
+
+	testCmdAddWithStdinData(t, `{
+    "cniVersion": "0.3.0",
+    "name": "istio-plugin-sample-test",
+    "type": "sample",
+    "prevResult": {
+        "cniversion": "0.3.0",
+        "interfaces": [
+            {"name": "cbr0"},
+            {"name": "eth0", "sandbox": "/tmp"},
+            {"name": "net1", "sandbox": "/tmp"}
+        ]
+    },
+    "kubernetes": {
+        "intercept_type": "mock"
+    }
+    }`)
+
+	r := singletonMockInterceptRuleMgr.lastRedirect[len(singletonMockInterceptRuleMgr.lastRedirect)-1]
+	if r.ExcludeInterfaces != "net3,net1,net2" {
+		t.Fatalf("expected excludeInterfaces net3,net1,net2, got %q", r.ExcludeInterfaces)
+	}
+
+	nsenterFuncCalled = false
+	testAnnotations[kubevirtInterfacesKey] = ifname
+	testCmdAdd(t)
+	if nsenterFuncCalled {
+		t.Fatalf("expected capture to be skipped for kubevirtInterfaces holding the primary interface")
+	}
+}
+
+func TestCmdAddUnknownKubevirtInterfaces(t *testing.T) {
+	defer resetGlobalTestVariables()
+	dir, err := ioutil.TempDir("", "istio-cni-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() { _ = log.Configure(loggingOptions) }()
+
+	testContainers = []string{"mockContainer", "mockContainer2"}
+	testAnnotations[kubevirtInterfacesKey] = "k6t-net1,k6t-typo"
+	path := filepath.Join(dir, "istio-cni.log")
+	testCmdAddWithStdinData(t, fmt.Sprintf(`{
+    "cniVersion": "0.3.0",
+    "name": "istio-plugin-sample-test",
+    "type": "sample",
+    "logging": {"file": %q},
+    "prevResult": {
+        "cniversion": "0.3.0",
+        "interfaces": [
+            {"name": "eth0", "sandbox": "/tmp"},
+            {"name": "k6t-net1", "sandbox": "/tmp"}
+        ]
+    },
+    "kubernetes": {
+        "intercept_type": "mock"
+    }
+    }`, path))
+
+	if !nsenterFuncCalled {
+		t.Fatalf("expected an unknown kubevirt interface not to prevent capture")
+	}
+	out, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "kubevirtInterfaces are not interfaces of the pod") ||
+		!strings.Contains(string(out), `"kubevirtInterfaces":["k6t-typo"]`) {
+		t.Fatalf("expected a warning for k6t-typo in the log file, got %q", out)
+	}
+}
+
+func TestCmdAddProgramTimeout(t *testing.T) {
+	defer resetGlobalTestVariables()
+
+	testContainers = []string{"mockContainer", "mockContainer2"}
+	stdinData := `{
+    "cniVersion": "0.3.0",
+    "name": "istio-plugin-sample-test",
+    "type": "sample",
+    "kubernetes": {
+        "intercept_type": "mock",
+        "program_timeout": "%s"
+    }
+    }`
+	testCmdAddWithStdinData(t, fmt.Sprintf(stdinData, "5s"))
+	if programTimeout != 5*time.Second {
+		t.Fatalf("expected a program timeout of 5s, got %v", programTimeout)
+	}
+
+	for _, bad := range []string{"soon", "-1s"} {
+		args := testSetArgs(fmt.Sprintf(stdinData, bad))
+		if err := cmdAdd(args); err == nil || !strings.Contains(err.Error(), "invalid program_timeout") {
+			t.Errorf("expected invalid program_timeout error for %q, got %v", bad, err)
+		}
+	}
+}
+
+func TestCmdAddVerifyRules(t *testing.T) {
+	defer resetGlobalTestVariables()
+
+	testContainers = []string{"mockContainer", "mockContainer2"}
+	singletonMockInterceptRuleMgr.verifyErr = &capture.MismatchError{Netns: sandboxDirectory, Diff: capture.Diff{
+		Missing: []capture.Rule{{Family: "iptables", Table: "nat", Chain: "ISTIO_REDIRECT", Spec: "--to-ports 15001 -j REDIRECT -p tcp"}},
+	}}
+	stdinData := `{
+    "cniVersion": "0.3.0",
+    "name": "istio-plugin-sample-test",
+    "type": "sample",
+    "kubernetes": {
+        "intercept_type": "mock",
+        "verify_rules": "%s"
+    }
+    }`
+	testCmdAddWithStdinData(t, fmt.Sprintf(stdinData, "warn"))
+
+	err := cmdAdd(testSetArgs(fmt.Sprintf(stdinData, "fail")))
+	if err == nil || !strings.Contains(err.Error(), "- iptables -t nat -A ISTIO_REDIRECT --to-ports 15001 -j REDIRECT -p tcp") {
+		t.Fatalf("expected verification to fail with the diff, got %v", err)
+	}
+	if err := cmdAdd(testSetArgs(fmt.Sprintf(stdinData, "always"))); err == nil || !strings.Contains(err.Error(), "invalid verify_rules") {
+		t.Fatalf("expected invalid verify_rules error, got %v", err)
+	}
+}
+
+func TestCmdAddTPROXY(t *testing.T) {
+	defer resetGlobalTestVariables()
+
+	testContainers = []string{"mockContainer", "mockContainer2"}
+	stdinData := `{
+    "cniVersion": "0.3.0",
+    "name": "istio-plugin-sample-test",
+    "type": "sample",
+    "tproxy": {
+        "mark": "0x400",
+        "mask": "%s",
+        "route_table": "200",
+        "outbound": true,
+        "reserved_marks": ["0xffff0000"]
+    },
+    "kubernetes": {
+        "intercept_type": "mock"
+    }
+    }`
+	testCmdAddWithStdinData(t, fmt.Sprintf(stdinData, "0xf00"))
+
+	r := singletonMockInterceptRuleMgr.lastRedirect[len(singletonMockInterceptRuleMgr.lastRedirect)-1]
+	if r.TproxyMark != "0x400" || r.TproxyMask != "0xf00" || r.TproxyRouteTable != "200" || !r.OutboundTproxy {
+		t.Fatalf("expected the tproxy settings in the redirect, got %+v", r)
+	}
+
+	err := cmdAdd(testSetArgs(fmt.Sprintf(stdinData, "0x10f00")))
+	if err == nil || !strings.Contains(err.Error(), "invalid tproxy") {
+		t.Fatalf("expected the reserved marks to be rejected, got %v", err)
+	}
+}
+
+func TestCmdAddPortConflicts(t *testing.T) {
+	defer resetGlobalTestVariables()
+
+	testContainers = []string{"mockContainer", "istio-proxy"}
+	testPorts = map[string][]string{"mockContainer": {"8080", "15090"}}
+	stdinData := `{
+    "cniVersion": "0.3.0",
+    "name": "istio-plugin-sample-test",
+    "type": "sample",
+    "proxy_ports": {
+        "excluded_inbound": "15020,15021,15090,9901",
+        "conflicts": "%s"
+    },
+    "kubernetes": {
+        "intercept_type": "mock"
+    }
+    }`
+	singletonMockInterceptRuleMgr.lastRedirect = nil
+	testCmdAddWithStdinData(t, fmt.Sprintf(stdinData, "warn"))
+	r := singletonMockInterceptRuleMgr.lastRedirect[len(singletonMockInterceptRuleMgr.lastRedirect)-1]
+	if !strings.Contains(r.ExcludeInboundPorts, "9901") {
+		t.Fatalf("expected the configured proxy ports in excludeInboundPorts, got %q", r.ExcludeInboundPorts)
+	}
+
+	singletonMockInterceptRuleMgr.lastRedirect = nil
+	err := cmdAdd(testSetArgs(fmt.Sprintf(stdinData, "fail")))
+	if err == nil || !strings.Contains(err.Error(), "port 15090 of container mockContainer is reserved by the proxy") {
+		t.Fatalf("expected the port conflict to fail the ADD, got %v", err)
+	}
+	if len(singletonMockInterceptRuleMgr.lastRedirect) != 0 {
+		t.Fatalf("expected no rules to be programmed, got %v", singletonMockInterceptRuleMgr.lastRedirect)
+	}
+
+	err = cmdAdd(testSetArgs(fmt.Sprintf(stdinData, "ignore")))
+	if err == nil || !strings.Contains(err.Error(), "invalid proxy_ports") {
+		t.Fatalf("expected invalid proxy_ports, got %v", err)
+	}
+}
+
+func TestCmdAddProbePorts(t *testing.T) {
+	defer resetGlobalTestVariables()
+
+	testContainers = []string{"mockContainer", "istio-proxy"}
+	testProbePorts = []string{"8080", "8081"}
+	testAnnotations[includePortsKey] = "8080,9080"
+
+	singletonMockInterceptRuleMgr.lastRedirect = nil
+	testCmdAdd(t)
+	r := singletonMockInterceptRuleMgr.lastRedirect[len(singletonMockInterceptRuleMgr.lastRedirect)-1]
+	if r.IncludePorts != "8080,9080" || strings.Contains(r.ExcludeInboundPorts, "8080") {
+		t.Fatalf("expected the probe ports to be captured while probes are rewritten, got %+v", r)
+	}
+
+	testAnnotations[annotation.SidecarRewriteAppHTTPProbers.Name] = "false"
+	singletonMockInterceptRuleMgr.lastRedirect = nil
+	testCmdAdd(t)
+	r = singletonMockInterceptRuleMgr.lastRedirect[len(singletonMockInterceptRuleMgr.lastRedirect)-1]
+	if r.IncludePorts != "9080" || r.ExcludeInboundPorts != "15020,15021,15090,8080,8081" {
+		t.Fatalf("expected the probe ports to be excluded, got %+v", r)
+	}
+}
+
+func TestCmdAddInvalidPolicy(t *testing.T) {
+	defer resetGlobalTestVariables()
+
+	args := testSetArgs(fmt.Sprintf(policyConf, `[{"name": "bad", "match": "node.name == 'x'", "action": "exclude"}]`))
+	if err := cmdAdd(args); err == nil || !strings.Contains(err.Error(), "policy rule bad") {
+		t.Fatalf("expected invalid policy error, got: %v", err)
+	}
+}
+
 func TestCmdAddInvalidK8sArgsKeyword(t *testing.T) {
 	defer resetGlobalTestVariables()
 
@@ -439,57 +931,33 @@ func TestCmdDelInvalidVersion(t *testing.T) {
 	testCmdInvalidVersion(t, cmdDel)
 }
 
-func MockInterceptRuleMgrCtor() InterceptRuleMgr {
+func MockInterceptRuleMgrCtor(cfg *capture.Config) capture.InterceptRuleMgr {
 	return NewMockInterceptRuleMgr()
 }
 func TestMain(m *testing.M) {
 	// call flag.Parse() here if TestMain uses flags
 
-	InterceptRuleMgrTypes["mock"] = MockInterceptRuleMgrCtor
-
-	os.Exit(m.Run())
-}
-
-func Test_dedupPorts(t *testing.T) {
-	type args struct {
-		ports []string
-	}
-	tests := []struct {
-		name string
-		args args
-		want []string
-	}{
-		{
-			name: "No duplicates",
-			args: args{ports: []string{"1234", "2345"}},
-			want: []string{"1234", "2345"},
-		},
-		{
-			name: "Sequential Duplicates",
-			args: args{ports: []string{"1234", "1234", "2345", "2345"}},
-			want: []string{"1234", "2345"},
-		},
-		{
-			name: "Mixed Duplicates",
-			args: args{ports: []string{"1234", "2345", "1234", "2345"}},
-			want: []string{"1234", "2345"},
-		},
-		{
-			name: "Empty",
-			args: args{ports: []string{}},
-			want: []string{},
-		},
-		{
-			name: "Non-parseable",
-			args: args{ports: []string{"abcd", "2345", "abcd"}},
-			want: []string{"abcd", "2345"},
-		},
-	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			if got := dedupPorts(tt.args.ports); !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("dedupPorts() = %v, want %v", got, tt.want)
-			}
-		})
+	capture.InterceptRuleMgrTypes["mock"] = MockInterceptRuleMgrCtor
+	lockDir, err := ioutil.TempDir("", "istio-cni-lock")
+	if err != nil {
+		panic(err)
+	}
+	containerLockDir = lockDir
+	namespaceCacheDir = filepath.Join(lockDir, "namespaces")
+
+	code := m.Run()
+	os.RemoveAll(lockDir)
+	os.Exit(code)
+}
+
+func TestParseConfigInstallTemplate(t *testing.T) {
+	// The template written by install-cni.sh carries a Calico style "policy"
+	// object, which must not clash with the plugin's own settings.
+	data, err := ioutil.ReadFile("../../deployments/kubernetes/install/scripts/istio-cni.conf.default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseConfig(data); err != nil {
+		t.Fatalf("failed to parse the install template: %v", err)
 	}
 }
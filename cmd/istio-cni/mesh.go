@@ -0,0 +1,62 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+	"k8s.io/client-go/kubernetes"
+
+	"istio.io/cni/pkg/redirect"
+	"istio.io/pkg/log"
+)
+
+// defaultMeshConfigNamespace is the namespace of a mesh_config_map given
+// without one.
+const defaultMeshConfigNamespace = "istio-system"
+
+// loadMeshConfig returns the mesh config set in the plugin config, or nil for
+// the built-in defaults. The node-local mesh_config_file takes precedence over
+// the mesh_config_map, which is only read with a Kubernetes client. A mesh
+// config which can't be read or parsed is logged and the built-in defaults
+// used, rather than failing the ADD of every pod.
+func loadMeshConfig(conf *PluginConf, client *kubernetes.Clientset) *redirect.MeshConfig {
+	mesh, err := readMeshConfig(conf, client)
+	if err != nil {
+		log.Warn("Failed to load mesh config, using the built-in defaults", zap.Error(err))
+		return nil
+	}
+	if mesh != nil {
+		log.Infof("Using mesh config defaults %+v", *mesh)
+	}
+	return mesh
+}
+
+func readMeshConfig(conf *PluginConf, client *kubernetes.Clientset) (*redirect.MeshConfig, error) {
+	if conf.MeshConfigFile != "" || conf.Kubernetes.MeshConfigMap == "" || client == nil {
+		return conf.ReadMeshConfigFile()
+	}
+	namespace, name := defaultMeshConfigNamespace, conf.Kubernetes.MeshConfigMap
+	if i := strings.Index(name, "/"); i >= 0 {
+		namespace, name = name[:i], name[i+1:]
+	}
+	data, err := getKubeMeshConfig(client, namespace, name)
+	if err != nil {
+		return nil, fmt.Errorf("mesh_config_map %s: %v", conf.Kubernetes.MeshConfigMap, err)
+	}
+	return redirect.ParseMeshConfig(data)
+}
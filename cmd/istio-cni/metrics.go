@@ -0,0 +1,318 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Prometheus metrics for plugin invocations. The plugin is a short-lived
+// process, so each invocation merges its samples into a file in the
+// Prometheus text format which is picked up by a node-local textfile collector.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"istio.io/pkg/log"
+)
+
+const (
+	metricsFileName = "istio-cni.prom"
+
+	counterMetric   = "counter"
+	histogramMetric = "histogram"
+
+	outcomeSuccess = "success"
+	outcomeError   = "error"
+)
+
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// Metrics holds the plugin's metrics reporting configuration
+type Metrics struct {
+	// TextfileDir is the directory scraped by the node's textfile collector.
+	// Metrics are not reported when it is empty.
+	TextfileDir string `json:"textfile_dir"`
+}
+
+type metricDesc struct {
+	name    string
+	help    string
+	kind    string
+	buckets []float64
+}
+
+var (
+	cmdTotal = &metricDesc{
+		name: "istio_cni_commands_total",
+		help: "Number of plugin invocations by CNI command and outcome.",
+		kind: counterMetric,
+	}
+	cmdDuration = &metricDesc{
+		name:    "istio_cni_command_duration_seconds",
+		help:    "Duration of plugin invocations by CNI command.",
+		kind:    histogramMetric,
+		buckets: latencyBuckets,
+	}
+	podLookupAttempts = &metricDesc{
+		name: "istio_cni_pod_lookup_attempts_total",
+		help: "Number of attempts to fetch pod metadata from the Kubernetes API by outcome.",
+		kind: counterMetric,
+	}
+	podLookupDuration = &metricDesc{
+		name:    "istio_cni_pod_lookup_duration_seconds",
+		help:    "Duration of single attempts to fetch pod metadata from the Kubernetes API.",
+		kind:    histogramMetric,
+		buckets: latencyBuckets,
+	}
+	podsExcluded = &metricDesc{
+		name: "istio_cni_pods_excluded_total",
+		help: "Number of pods left uncaptured by exclusion reason.",
+		kind: counterMetric,
+	}
+	interceptDuration = &metricDesc{
+		name:    "istio_cni_intercept_program_duration_seconds",
+		help:    "Duration of programming traffic interception by intercept type and outcome.",
+		kind:    histogramMetric,
+		buckets: latencyBuckets,
+	}
+
+	ruleVerifications = &metricDesc{
+		name: "istio_cni_rule_verifications_total",
+		help: "Number of verifications of programmed rules by outcome, match, mismatch or error.",
+		kind: counterMetric,
+	}
+
+	portConflicts = &metricDesc{
+		name: "istio_cni_port_conflicts_total",
+		help: "Number of app ports found reserved by the proxy by kind, container or include_inbound_ports.",
+		kind: counterMetric,
+	}
+
+	metricDescs = []*metricDesc{cmdTotal, cmdDuration, podLookupAttempts, podLookupDuration, podsExcluded, interceptDuration,
+		ruleVerifications, portConflicts}
+
+	pluginMetrics = newMetricsRecorder()
+)
+
+// metricsRecorder accumulates the samples of a single invocation, keyed by
+// series (metric name and labels).
+type metricsRecorder struct {
+	mu      sync.Mutex
+	samples map[string]float64
+}
+
+func newMetricsRecorder() *metricsRecorder {
+	return &metricsRecorder{samples: map[string]float64{}}
+}
+
+// seriesName renders name{k1="v1",...} from alternating label keys and values.
+func seriesName(name string, labels ...string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(labels[i])
+		b.WriteString(`="`)
+		b.WriteString(strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// Inc increments a counter.
+func (m *metricsRecorder) Inc(desc *metricDesc, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.samples[seriesName(desc.name, labels...)]++
+}
+
+// Observe records a histogram observation.
+func (m *metricsRecorder) Observe(desc *metricDesc, value float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, le := range desc.buckets {
+		if value <= le {
+			m.samples[seriesName(desc.name+"_bucket", append(labels, "le", formatFloat(le))...)]++
+		}
+	}
+	m.samples[seriesName(desc.name+"_bucket", append(labels, "le", "+Inf")...)]++
+	m.samples[seriesName(desc.name+"_sum", labels...)] += value
+	m.samples[seriesName(desc.name+"_count", labels...)]++
+}
+
+// ObserveSince records the time elapsed since start in a histogram.
+func (m *metricsRecorder) ObserveSince(desc *metricDesc, start time.Time, labels ...string) {
+	m.Observe(desc, time.Since(start).Seconds(), labels...)
+}
+
+// Flush merges the recorded samples into the metrics file in dir and resets
+// the recorder. Concurrent invocations are serialized with a file lock.
+func (m *metricsRecorder) Flush(dir string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if dir == "" || len(m.samples) == 0 {
+		m.samples = map[string]float64{}
+		return nil
+	}
+
+	lock, err := os.OpenFile(filepath.Join(dir, "."+metricsFileName+".lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN) // nolint: errcheck
+
+	path := filepath.Join(dir, metricsFileName)
+	merged := map[string]float64{}
+	if existing, err := ioutil.ReadFile(path); err == nil {
+		merged = parseSamples(existing)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	for series, val := range m.samples {
+		merged[series] += val
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, renderSamples(merged), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	m.samples = map[string]float64{}
+	return nil
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// parseSamples reads the series and values of a text format metrics file.
+func parseSamples(data []byte) map[string]float64 {
+	samples := map[string]float64{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		idx := strings.LastIndexByte(line, ' ')
+		if idx < 0 {
+			continue
+		}
+		val, err := strconv.ParseFloat(line[idx+1:], 64)
+		if err != nil {
+			continue
+		}
+		samples[line[:idx]] = val
+	}
+	return samples
+}
+
+// familyOf returns the metric family a series belongs to.
+func familyOf(series string) string {
+	name := series
+	if idx := strings.IndexByte(series, '{'); idx >= 0 {
+		name = series[:idx]
+	}
+	for _, desc := range metricDescs {
+		if desc.kind == histogramMetric {
+			for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+				if name == desc.name+suffix {
+					return desc.name
+				}
+			}
+		}
+	}
+	return name
+}
+
+// renderSamples writes samples in the Prometheus text format, grouped by family.
+func renderSamples(samples map[string]float64) []byte {
+	families := map[string][]string{}
+	for series := range samples {
+		family := familyOf(series)
+		families[family] = append(families[family], series)
+	}
+
+	var buf bytes.Buffer
+	writeFamily := func(name string) {
+		series := families[name]
+		sort.Strings(series)
+		for _, s := range series {
+			fmt.Fprintf(&buf, "%s %s\n", s, formatFloat(samples[s]))
+		}
+		delete(families, name)
+	}
+	for _, desc := range metricDescs {
+		if len(families[desc.name]) == 0 {
+			continue
+		}
+		fmt.Fprintf(&buf, "# HELP %s %s\n", desc.name, desc.help)
+		fmt.Fprintf(&buf, "# TYPE %s %s\n", desc.name, desc.kind)
+		writeFamily(desc.name)
+	}
+	// Keep series written by other plugin versions.
+	rest := make([]string, 0, len(families))
+	for name := range families {
+		rest = append(rest, name)
+	}
+	sort.Strings(rest)
+	for _, name := range rest {
+		writeFamily(name)
+	}
+	return buf.Bytes()
+}
+
+// outcome maps an error to the outcome label value.
+func outcome(err error) string {
+	if err != nil {
+		return outcomeError
+	}
+	return outcomeSuccess
+}
+
+// recordCommand records a plugin invocation and flushes all samples of the
+// invocation to the configured textfile directory.
+func recordCommand(conf *PluginConf, command string, start time.Time, err error) {
+	pluginMetrics.Inc(cmdTotal, "command", command, "outcome", outcome(err))
+	pluginMetrics.ObserveSince(cmdDuration, start, "command", command)
+	var dir string
+	if conf != nil {
+		dir = conf.Metrics.TextfileDir
+	}
+	if flushErr := pluginMetrics.Flush(dir); flushErr != nil {
+		// metrics are best effort and must never fail the invocation
+		log.Warnf("Failed to write metrics to %s: %v", dir, flushErr)
+	}
+}
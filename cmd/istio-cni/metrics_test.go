@@ -0,0 +1,131 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"istio.io/cni/pkg/plan"
+	"istio.io/cni/pkg/redirect"
+)
+
+func TestMetricsFlushMergesInvocations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "istio-cni-metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i := 0; i < 2; i++ {
+		m := newMetricsRecorder()
+		m.Inc(cmdTotal, "command", "add", "outcome", outcomeSuccess)
+		m.Observe(interceptDuration, 0.2, "type", "iptables", "outcome", outcomeSuccess)
+		if err := m.Flush(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out, err := ioutil.ReadFile(filepath.Join(dir, metricsFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples := parseSamples(out)
+	for series, want := range map[string]float64{
+		`istio_cni_commands_total{command="add",outcome="success"}`:                                        2,
+		`istio_cni_intercept_program_duration_seconds_bucket{type="iptables",outcome="success",le="0.1"}`:  0,
+		`istio_cni_intercept_program_duration_seconds_bucket{type="iptables",outcome="success",le="0.25"}`: 2,
+		`istio_cni_intercept_program_duration_seconds_bucket{type="iptables",outcome="success",le="+Inf"}`: 2,
+		`istio_cni_intercept_program_duration_seconds_count{type="iptables",outcome="success"}`:            2,
+		`istio_cni_intercept_program_duration_seconds_sum{type="iptables",outcome="success"}`:              0.4,
+	} {
+		if got := samples[series]; got != want {
+			t.Errorf("%s = %v, want %v", series, got, want)
+		}
+	}
+	if !strings.Contains(string(out), "# TYPE istio_cni_intercept_program_duration_seconds histogram\n") {
+		t.Errorf("missing histogram TYPE line in:\n%s", out)
+	}
+}
+
+func TestRecordFailedDel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "istio-cni-metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The prevResult is invalid, the metrics settings are still read.
+	stdinData := `{
+    "cniVersion": "0.3.0",
+    "name": "istio-plugin-sample-test",
+    "type": "sample",
+    "prevResult": {"ips": "invalid"},
+    "metrics": {"textfile_dir": "` + dir + `"}
+    }`
+	if err := cmdDel(testSetArgs(stdinData)); err == nil {
+		t.Fatal("expected the invalid prevResult to fail the DEL")
+	}
+
+	out, err := ioutil.ReadFile(filepath.Join(dir, metricsFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := parseSamples(out)[`istio_cni_commands_total{command="del",outcome="error"}`]; got != 1 {
+		t.Fatalf("expected the failed DEL to be counted, got:\n%s", out)
+	}
+}
+
+func TestPortConflictsByKind(t *testing.T) {
+	dir, err := ioutil.TempDir("", "istio-cni-metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() { pluginMetrics = newMetricsRecorder() }()
+
+	pluginMetrics = newMetricsRecorder()
+	r, err := redirect.Parse(map[string]string{includePortsKey: "15006"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conflicts := r.PortConflicts("", map[string][]string{"app": {"15000", "15001"}})
+	if err := checkConflicts(&plan.ProxyPorts{}, conflicts); err != nil {
+		t.Fatal(err)
+	}
+	if err := pluginMetrics.Flush(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := ioutil.ReadFile(filepath.Join(dir, metricsFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples := parseSamples(out)
+	for series, want := range map[string]float64{
+		`istio_cni_port_conflicts_total{kind="container"}`:             2,
+		`istio_cni_port_conflicts_total{kind="include_inbound_ports"}`: 1,
+	} {
+		if got := samples[series]; got != want {
+			t.Errorf("%s = %v, want %v", series, got, want)
+		}
+	}
+	if strings.Contains(string(out), "15000") {
+		t.Errorf("expected no port label in:\n%s", out)
+	}
+}
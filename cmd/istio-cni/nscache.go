@@ -0,0 +1,100 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.uber.org/zap"
+	"k8s.io/client-go/kubernetes"
+
+	"istio.io/cni/pkg/policy"
+	"istio.io/pkg/log"
+)
+
+// namespaceCacheDir holds the namespace metadata fetched by recent ADDs, one
+// file per namespace. Each ADD is a new process, so the cache is on disk.
+var namespaceCacheDir = "/var/run/istio-cni/namespaces"
+
+// namespaceCacheTTL is how long a cached namespace is used before it is
+// fetched again.
+var namespaceCacheTTL = 30 * time.Second
+
+type cachedNamespace struct {
+	Fetched   time.Time        `json:"fetched"`
+	Namespace policy.Namespace `json:"namespace"`
+}
+
+// getCachedK8sNamespace returns the metadata of a namespace, from the cache if
+// it was fetched less than namespaceCacheTTL ago.
+func getCachedK8sNamespace(client *kubernetes.Clientset, name string) (*policy.Namespace, error) {
+	return cachedK8sNamespace(name, func() (*policy.Namespace, error) {
+		return getK8sNamespace(client, name)
+	})
+}
+
+func cachedK8sNamespace(name string, fetch func() (*policy.Namespace, error)) (*policy.Namespace, error) {
+	if name == "" || filepath.Base(name) != name {
+		return nil, fmt.Errorf("invalid namespace %q", name)
+	}
+	path := filepath.Join(namespaceCacheDir, name+".json")
+	if data, err := ioutil.ReadFile(path); err == nil {
+		cached := cachedNamespace{}
+		if err := json.Unmarshal(data, &cached); err == nil &&
+			cached.Namespace.Name == name && time.Since(cached.Fetched) < namespaceCacheTTL {
+			return &cached.Namespace, nil
+		}
+	}
+	ns, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+	// A failure to cache only costs the next ADD a GET.
+	if err := writeCachedNamespace(path, ns); err != nil {
+		log.Debug("Failed to cache namespace", zap.String("namespace", name), zap.Error(err))
+	}
+	return ns, nil
+}
+
+// writeCachedNamespace writes through a temporary file, so concurrent ADDs
+// never read a partial entry.
+func writeCachedNamespace(path string, ns *policy.Namespace) error {
+	data, err := json.Marshal(cachedNamespace{Fetched: time.Now(), Namespace: *ns})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name()) // nolint: errcheck
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name()) // nolint: errcheck
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,55 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"istio.io/cni/pkg/policy"
+)
+
+func TestCachedK8sNamespace(t *testing.T) {
+	defer func(ttl time.Duration) { namespaceCacheTTL = ttl }(namespaceCacheTTL)
+	fetches := 0
+	fetch := func() (*policy.Namespace, error) {
+		fetches++
+		return &policy.Namespace{Name: "payments", Labels: map[string]string{"team": "payments"}}, nil
+	}
+
+	first, err := cachedK8sNamespace("payments", fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := cachedK8sNamespace("payments", func() (*policy.Namespace, error) {
+		return nil, errors.New("unexpected fetch")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetches != 1 || !reflect.DeepEqual(first, second) {
+		t.Fatalf("expected the second lookup from the cache, got %d fetches and %+v", fetches, second)
+	}
+
+	namespaceCacheTTL = 0
+	if _, err := cachedK8sNamespace("payments", fetch); err != nil || fetches != 2 {
+		t.Fatalf("expected an expired entry to be fetched again, got %d fetches, %v", fetches, err)
+	}
+	if _, err := cachedK8sNamespace("../payments", fetch); err == nil {
+		t.Fatalf("expected a namespace with a path to be rejected")
+	}
+}
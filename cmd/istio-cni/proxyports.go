@@ -0,0 +1,44 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"istio.io/cni/pkg/plan"
+	"istio.io/cni/pkg/redirect"
+	"istio.io/pkg/log"
+)
+
+// checkConflicts logs the conflicts of a pod's ports with the proxy. They only
+// fail the ADD if the proxy_ports conflicts is "fail".
+func checkConflicts(ports *plan.ProxyPorts, conflicts []redirect.PortConflict) error {
+	if len(conflicts) == 0 {
+		return nil
+	}
+	msgs := make([]string, len(conflicts))
+	for i, c := range conflicts {
+		pluginMetrics.Inc(portConflicts, "kind", c.Kind)
+		log.Warn("App port conflicts with the proxy", zap.String("port", c.Port), zap.String("source", c.Source))
+		msgs[i] = c.String()
+	}
+	if ports.Conflicts == plan.PortConflictsFail {
+		return fmt.Errorf("app ports conflict with the proxy: %s", strings.Join(msgs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+
+	"istio.io/cni/pkg/policy"
+	"istio.io/cni/pkg/redirect"
+)
+
+// RuntimeConfig holds the capability arguments a runtime may pass to the
+// plugin. They let runtimes without a Kubernetes API (e.g. Nomad or podman)
+// request traffic capture for a container.
+type RuntimeConfig struct {
+	// IstioRedirect carries the redirect parameters keyed by their name in the
+	// redirect registry, e.g. {"includePorts": "*", "redirectMode": "REDIRECT"}.
+	// Capture is programmed whenever it is set, unless "inject" is false.
+	IstioRedirect map[string]string `json:"istioRedirect,omitempty"`
+	// PodAnnotations are the pod annotations passed by CRI runtimes. They are
+	// subject to the same inject and sidecar status checks as Kubernetes pods.
+	PodAnnotations map[string]string `json:"io.kubernetes.cri.pod-annotations,omitempty"`
+}
+
+// runtimeConfigAnnotations merges the pod annotations and istioRedirect
+// parameters of the runtimeConfig into a single annotation map, with
+// istioRedirect taking precedence. It returns nil if neither is set.
+func runtimeConfigAnnotations(rc *RuntimeConfig) (map[string]string, error) {
+	if rc == nil || (rc.IstioRedirect == nil && rc.PodAnnotations == nil) {
+		return nil, nil
+	}
+	params, err := redirect.Annotations(rc.IstioRedirect)
+	if err != nil {
+		return nil, fmt.Errorf("istioRedirect: %v", err)
+	}
+	annotations := make(map[string]string, len(rc.PodAnnotations)+len(params))
+	for k, v := range rc.PodAnnotations {
+		annotations[k] = v
+	}
+	for k, v := range params {
+		annotations[k] = v
+	}
+	return annotations, nil
+}
+
+// runtimeConfigExclusion returns the reason the container must not be
+// captured, or "" if it should be.
+func runtimeConfigExclusion(rc *RuntimeConfig, annotations map[string]string) policy.Reason {
+	if policy.InjectDisabled(annotations) {
+		return policy.ReasonInjectDisabled
+	}
+	if rc.IstioRedirect == nil && !policy.HasSidecarStatus(annotations) {
+		return policy.ReasonNoSidecarStatus
+	}
+	return ""
+}
@@ -0,0 +1,265 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Optional tracing of plugin invocations. Spans are buffered for the lifetime
+// of the invocation and exported once, as OTLP/HTTP JSON, when it completes.
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	tracingServiceName    = "istio-cni"
+	defaultTracingTimeout = time.Second
+
+	otlpSpanKindInternal = 1
+	otlpStatusOk         = 1
+	otlpStatusError      = 2
+)
+
+// Tracing holds the plugin's tracing configuration
+type Tracing struct {
+	// Endpoint is the OTLP/HTTP traces endpoint, e.g. http://127.0.0.1:4318/v1/traces.
+	// Tracing is disabled when it is empty.
+	Endpoint string `json:"otlp_endpoint"`
+	// Timeout bounds the export of the spans, e.g. "500ms". Defaults to 1s.
+	Timeout string `json:"timeout"`
+}
+
+// tracer records the spans of a single plugin invocation. A nil *tracer is
+// valid and records nothing, so call sites need not check whether tracing is
+// enabled.
+type tracer struct {
+	mu       sync.Mutex
+	endpoint string
+	timeout  time.Duration
+	traceID  string
+	spans    []*span
+}
+
+// span is a single timed operation within a trace. A nil *span is a no-op.
+type span struct {
+	tracer   *tracer
+	name     string
+	spanID   string
+	parentID string
+	start    time.Time
+	end      time.Time
+	attrs    map[string]string
+	err      error
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// newTracer returns a tracer for the given configuration, or nil if tracing
+// is disabled.
+func newTracer(conf Tracing) (*tracer, error) {
+	if conf.Endpoint == "" {
+		return nil, nil
+	}
+	timeout := defaultTracingTimeout
+	if conf.Timeout != "" {
+		d, err := time.ParseDuration(conf.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tracing timeout %q: %v", conf.Timeout, err)
+		}
+		timeout = d
+	}
+	return &tracer{
+		endpoint: conf.Endpoint,
+		timeout:  timeout,
+		traceID:  randomHex(16),
+	}, nil
+}
+
+// TraceID returns the hex trace ID, or "" when tracing is disabled.
+func (t *tracer) TraceID() string {
+	if t == nil {
+		return ""
+	}
+	return t.traceID
+}
+
+// StartAt starts a span as a child of parent (or a root span if parent is
+// nil) with an explicit start time.
+func (t *tracer) StartAt(name string, parent *span, start time.Time) *span {
+	if t == nil {
+		return nil
+	}
+	s := &span{
+		tracer: t,
+		name:   name,
+		spanID: randomHex(8),
+		start:  start,
+		attrs:  map[string]string{},
+	}
+	if parent != nil {
+		s.parentID = parent.spanID
+	}
+	t.mu.Lock()
+	t.spans = append(t.spans, s)
+	t.mu.Unlock()
+	return s
+}
+
+// Start starts a span as a child of parent (or a root span if parent is nil).
+func (t *tracer) Start(name string, parent *span) *span {
+	return t.StartAt(name, parent, time.Now())
+}
+
+// SetAttr records a string attribute on the span.
+func (s *span) SetAttr(key, value string) {
+	if s == nil {
+		return
+	}
+	s.tracer.mu.Lock()
+	s.attrs[key] = value
+	s.tracer.mu.Unlock()
+}
+
+// End completes the span, marking it as failed if err is not nil.
+func (s *span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.tracer.mu.Lock()
+	s.end = time.Now()
+	s.err = err
+	s.tracer.mu.Unlock()
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// payload renders all ended spans as an OTLP ExportTraceServiceRequest.
+func (t *tracer) payload() ([]byte, int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	spans := make([]otlpSpan, 0, len(t.spans))
+	for _, s := range t.spans {
+		if s.end.IsZero() {
+			continue
+		}
+		ospan := otlpSpan{
+			TraceID:           t.traceID,
+			SpanID:            s.spanID,
+			ParentSpanID:      s.parentID,
+			Name:              s.name,
+			Kind:              otlpSpanKindInternal,
+			StartTimeUnixNano: unixNano(s.start),
+			EndTimeUnixNano:   unixNano(s.end),
+			Status:            otlpStatus{Code: otlpStatusOk},
+		}
+		for k, v := range s.attrs {
+			ospan.Attributes = append(ospan.Attributes, otlpKeyValue{Key: k, Value: otlpValue{StringValue: v}})
+		}
+		if s.err != nil {
+			ospan.Status = otlpStatus{Code: otlpStatusError, Message: s.err.Error()}
+		}
+		spans = append(spans, ospan)
+	}
+	req := otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpKeyValue{
+			{Key: "service.name", Value: otlpValue{StringValue: tracingServiceName}},
+		}},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: tracingServiceName}, Spans: spans}},
+	}}}
+	out, _ := json.Marshal(req)
+	return out, len(spans)
+}
+
+// Export sends all ended spans to the configured OTLP/HTTP endpoint.
+func (t *tracer) Export() error {
+	if t == nil {
+		return nil
+	}
+	body, count := t.payload()
+	if count == 0 {
+		return nil
+	}
+	client := &http.Client{Timeout: t.timeout}
+	resp, err := client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("exporting %d spans to %s: %s", count, t.endpoint, resp.Status)
+	}
+	return nil
+}
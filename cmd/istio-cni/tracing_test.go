@@ -0,0 +1,75 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTracerExport(t *testing.T) {
+	var got otlpTraces
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("failed to decode OTLP payload: %v", err)
+		}
+	}))
+	defer srv.Close()
+
+	trc, err := newTracer(Tracing{Endpoint: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := trc.Start("cmdAdd", nil)
+	child := trc.Start("getKubePodInfo", root)
+	child.SetAttr("attempt", "1")
+	child.End(errors.New("pod not found"))
+	root.End(nil)
+	if err := trc.Export(); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := got.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+	for _, s := range spans {
+		if s.TraceID != trc.TraceID() || len(s.TraceID) != 32 {
+			t.Errorf("span %s has trace ID %q, want %q", s.Name, s.TraceID, trc.TraceID())
+		}
+	}
+	if spans[1].ParentSpanID != spans[0].SpanID {
+		t.Errorf("expected %s to be a child of %s", spans[1].Name, spans[0].Name)
+	}
+	if spans[1].Status.Code != otlpStatusError || spans[1].Status.Message != "pod not found" {
+		t.Errorf("unexpected status %+v", spans[1].Status)
+	}
+}
+
+func TestDisabledTracerIsNoop(t *testing.T) {
+	trc, err := newTracer(Tracing{})
+	if err != nil || trc != nil {
+		t.Fatalf("expected no tracer, got %v, %v", trc, err)
+	}
+	s := trc.Start("cmdAdd", nil)
+	s.SetAttr("pod", "test")
+	s.End(nil)
+	if err := trc.Export(); err != nil || trc.TraceID() != "" {
+		t.Fatalf("expected disabled tracer to do nothing, got %v", err)
+	}
+}
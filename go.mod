@@ -8,6 +8,7 @@ require (
 	github.com/evanphx/json-patch v4.5.0+incompatible // indirect
 	github.com/googleapis/gnostic v0.3.1 // indirect
 	github.com/imdario/mergo v0.3.6 // indirect
+	github.com/natefinch/lumberjack v2.0.0+incompatible
 	github.com/spf13/pflag v1.0.5
 	github.com/spf13/viper v1.4.0
 	go.uber.org/multierr v1.1.0
@@ -20,4 +21,5 @@ require (
 	k8s.io/apimachinery v0.0.0-20191025225532-af6325b3a843
 	k8s.io/client-go v0.0.0-20191016111102-bec269661e48
 	k8s.io/utils v0.0.0-20191010214722-8d271d903fe4 // indirect
+	sigs.k8s.io/yaml v1.1.0
 )
@@ -0,0 +1,131 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package capture
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"istio.io/pkg/log"
+)
+
+const (
+	// BackendAuto detects the backend holding the node's rules.
+	BackendAuto = "auto"
+	// BackendLegacy is the iptables-legacy commands, programming the kernel's
+	// xtables.
+	BackendLegacy = "legacy"
+	// BackendNFT is the iptables-nft commands, programming nf_tables.
+	BackendNFT = "nft"
+)
+
+// ValidateBackend checks backend is an iptables backend, or empty for
+// BackendAuto.
+func ValidateBackend(backend string) error {
+	switch backend {
+	case "", BackendAuto, BackendLegacy, BackendNFT:
+		return nil
+	}
+	return fmt.Errorf("iptables backend must be %s, %s or %s, got %q", BackendAuto, BackendLegacy, BackendNFT, backend)
+}
+
+// backendCommand returns the name of the family's tool, e.g. iptables-save
+// for the suffix "-save", of backend. Empty backend is the tool of the PATH.
+func backendCommand(family, backend, suffix string) string {
+	if backend == "" {
+		return family + suffix
+	}
+	return family + "-" + backend + suffix
+}
+
+// kubeProxyHintChain is the chain kube-proxy creates in the mangle table of
+// the backend it uses, so that other components can find it.
+const kubeProxyHintChain = "KUBE-IPTABLES-HINT"
+
+// detectBackend returns the backend of the rules of the current network
+// namespace, where kube-proxy and the node's CNI program theirs. Pod network
+// namespaces are new and hold no rules to go by. As every ADD detects it
+// again, the common cases run few commands: a node with only one of the
+// iptables-legacy-save and iptables-nft-save commands uses its backend without
+// running it. With both, the backend holding kube-proxy's hint chain in its
+// mangle table is used, and failing that the one holding the most IPv4 rules.
+// It returns an empty backend, i.e. the iptables of the PATH, if neither
+// command is installed or neither holds rules.
+func detectBackend(ctx context.Context) string {
+	var installed []string
+	for _, backend := range []string{BackendLegacy, BackendNFT} {
+		if _, err := exec.LookPath(backendCommand(familyIPv4, backend, "-save")); err == nil {
+			installed = append(installed, backend)
+		}
+	}
+	if len(installed) < 2 {
+		detected := ""
+		if len(installed) == 1 {
+			detected = installed[0]
+		}
+		log.Info("Detected iptables backend", zap.String("backend", detected), zap.Strings("installed", installed))
+		return detected
+	}
+
+	var unhinted []string
+	for _, backend := range installed {
+		prog := backendCommand(familyIPv4, backend, "-save")
+		out, err := run(ctx, command(ctx, "", prog, "-t", "mangle"))
+		if err != nil {
+			log.Debug("Skipping iptables backend", zap.String("command", prog), zap.Error(err))
+			continue
+		}
+		if strings.Contains(out, ":"+kubeProxyHintChain+" ") {
+			log.Info("Detected iptables backend", zap.String("backend", backend), zap.String("chain", kubeProxyHintChain))
+			return backend
+		}
+		unhinted = append(unhinted, backend)
+	}
+	counts := map[string]int{}
+	for _, backend := range unhinted {
+		prog := backendCommand(familyIPv4, backend, "-save")
+		out, err := run(ctx, command(ctx, "", prog))
+		if err != nil {
+			log.Debug("Skipping iptables backend", zap.String("command", prog), zap.Error(err))
+			continue
+		}
+		counts[backend] = countRules(out)
+	}
+	detected := ""
+	switch {
+	case counts[BackendLegacy] > counts[BackendNFT]:
+		detected = BackendLegacy
+	case counts[BackendNFT] > 0:
+		detected = BackendNFT
+	}
+	log.Info("Detected iptables backend", zap.String("backend", detected),
+		zap.Int("legacyRules", counts[BackendLegacy]), zap.Int("nftRules", counts[BackendNFT]))
+	return detected
+}
+
+// countRules returns the number of rules in iptables-save output.
+func countRules(out string) int {
+	n := 0
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, "-A ") {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,132 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package capture
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDetectBackend(t *testing.T) {
+	tests := []struct {
+		name string
+		// rules maps the save commands on the PATH to the number of rules
+		// they print.
+		rules map[string]int
+		// hint is the save command printing kube-proxy's hint chain.
+		hint     string
+		expected string
+	}{
+		{
+			name:     "no backend commands",
+			rules:    map[string]int{"iptables-save": 10},
+			expected: "",
+		},
+		{
+			name:     "no rules",
+			rules:    map[string]int{"iptables-legacy-save": 0, "iptables-nft-save": 0},
+			expected: "",
+		},
+		{
+			name: "legacy",
+			rules: map[string]int{
+				"iptables-legacy-save": 12, "ip6tables-legacy-save": 2,
+				"iptables-nft-save": 0, "ip6tables-nft-save": 0,
+			},
+			expected: BackendLegacy,
+		},
+		{
+			name: "nft hint chain",
+			rules: map[string]int{
+				"iptables-legacy-save": 30, "iptables-nft-save": 3,
+			},
+			hint:     "iptables-nft-save",
+			expected: BackendNFT,
+		},
+		{
+			name:     "nft only",
+			rules:    map[string]int{"iptables-nft-save": 0},
+			expected: BackendNFT,
+		},
+		{
+			// A single installed backend is used without running it.
+			name:     "legacy only",
+			rules:    map[string]int{"iptables-legacy-save": -1},
+			expected: BackendLegacy,
+		},
+	}
+	path := os.Getenv("PATH")
+	defer os.Setenv("PATH", path)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "backend")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			for prog, n := range tt.rules {
+				script := "#!/bin/sh\n"
+				switch {
+				case n < 0:
+					script += "exit 1\n"
+				case prog == tt.hint:
+					script += "[ \"$2\" = mangle ] && echo ':" + kubeProxyHintChain + " - [0:0]'\n"
+					fallthrough
+				default:
+					script += "echo '*nat'\n" +
+						strings.Repeat("echo '-A PREROUTING -j KUBE-SERVICES'\n", n) + "echo COMMIT\n"
+				}
+				if err := ioutil.WriteFile(filepath.Join(dir, prog), []byte(script), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			os.Setenv("PATH", dir)
+
+			if backend := detectBackend(context.Background()); backend != tt.expected {
+				t.Fatalf("expected backend %q, got %q", tt.expected, backend)
+			}
+		})
+	}
+}
+
+func TestValidateBackend(t *testing.T) {
+	for _, backend := range []string{"", BackendAuto, BackendLegacy, BackendNFT} {
+		if err := ValidateBackend(backend); err != nil {
+			t.Errorf("expected %q to be valid, got %v", backend, err)
+		}
+	}
+	if err := ValidateBackend("nftables"); err == nil {
+		t.Errorf("expected nftables to be invalid")
+	}
+}
+
+func TestBackendCommand(t *testing.T) {
+	for _, tt := range []struct{ family, backend, suffix, expected string }{
+		{familyIPv4, "", "-save", "iptables-save"},
+		{familyIPv6, BackendLegacy, "-restore", "ip6tables-legacy-restore"},
+		{familyIPv4, BackendNFT, "", "iptables-nft"},
+	} {
+		t.Run(fmt.Sprintf("%s/%s%s", tt.family, tt.backend, tt.suffix), func(t *testing.T) {
+			if prog := backendCommand(tt.family, tt.backend, tt.suffix); prog != tt.expected {
+				t.Fatalf("expected %s, got %s", tt.expected, prog)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2019 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package capture programs the rules which capture a workload's traffic into
+// an Istio proxy.
+package capture
+
+import (
+	"context"
+	"time"
+
+	"istio.io/cni/pkg/redirect"
+)
+
+const (
+	DefaultInterceptRuleMgrType = "iptables"
+	DefaultBinDir               = "/opt/cni/bin"
+	// DefaultProgramTimeout bounds InterceptRuleMgr.Program, e.g. while
+	// waiting for the xtables lock.
+	DefaultProgramTimeout = time.Minute
+)
+
+// Config holds the settings used to construct an InterceptRuleMgr.
+type Config struct {
+	// BinDir is the directory holding the rule programming tools, e.g. istio-iptables.sh.
+	BinDir string
+	// Backend is the iptables backend, BackendLegacy or BackendNFT, whose
+	// commands are used for both IPv4 and IPv6. BackendAuto, the default,
+	// detects the backend holding the node's rules.
+	Backend string
+}
+
+// InterceptRuleMgr configures networking tables (e.g. iptables or nftables) for
+// redirecting traffic to an Istio proxy.
+type InterceptRuleMgr interface {
+	// Program adds the rules for redirect to the network namespace at netns.
+	// It gives up when ctx is done, removing the rules it partly added. A
+	// failure to run the programming tool wraps an *ExecError.
+	Program(ctx context.Context, netns string, redirect *redirect.Redirect) error
+	// Render returns the commands Program would run in netns, without running
+	// them. netns may be empty to render outside of any network namespace.
+	Render(netns string, redirect *redirect.Redirect) ([]string, error)
+	// Verify checks that the rules in netns match the rules for redirect. Rules
+	// which do not match are returned as a *MismatchError.
+	Verify(ctx context.Context, netns string, redirect *redirect.Redirect) error
+	// Remove deletes all rules added for redirect from netns.
+	Remove(netns string, redirect *redirect.Redirect) error
+}
+
+type InterceptRuleMgrCtor func(cfg *Config) InterceptRuleMgr
+
+var (
+	InterceptRuleMgrTypes = map[string]InterceptRuleMgrCtor{
+		"iptables": IptablesInterceptRuleMgrCtor,
+	}
+)
+
+// Constructor factory for known types of InterceptRuleMgr's
+func GetInterceptRuleMgrCtor(interceptType string) InterceptRuleMgrCtor {
+	return InterceptRuleMgrTypes[interceptType]
+}
+
+// Constructor for iptables InterceptRuleMgr
+func IptablesInterceptRuleMgrCtor(cfg *Config) InterceptRuleMgr {
+	return newIPTables(cfg)
+}
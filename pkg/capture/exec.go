@@ -0,0 +1,184 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package capture
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Cause is why running a rule programming tool failed.
+type Cause string
+
+const (
+	// CauseTimeout is a tool which did not finish in time.
+	CauseTimeout Cause = "timeout"
+	// CauseLockContention is a tool which could not get the xtables lock,
+	// held by another process of the node, e.g. kube-proxy.
+	CauseLockContention Cause = "xtables_lock"
+	// CauseMissingBinary is a tool, or a command it runs, which is not
+	// installed.
+	CauseMissingBinary Cause = "missing_binary"
+	// CauseRule is a rule rejected by iptables.
+	CauseRule Cause = "rule"
+)
+
+// ExecError is the error of a rule programming tool, with its output.
+type ExecError struct {
+	Cause Cause
+	// Command is the tool run, or for istio-iptables.sh the last command it
+	// traced before failing.
+	Command string
+	Stdout  string
+	Stderr  string
+	Err     error
+}
+
+func (e *ExecError) Error() string {
+	msg := fmt.Sprintf("%s: %s", e.Cause, e.Command)
+	if detail := lastLine(e.Stderr, func(l string) bool { return !strings.HasPrefix(l, "+") }); detail != "" {
+		msg += ": " + detail
+	}
+	return fmt.Sprintf("%s (%v)", msg, e.Err)
+}
+
+func (e *ExecError) Unwrap() error {
+	return e.Err
+}
+
+// lockContentionMessages are printed by iptables when another process holds
+// the xtables lock.
+var lockContentionMessages = []string{
+	"holding the xtables lock",
+	"Another app is currently holding",
+	"Resource temporarily unavailable",
+}
+
+// missingBinaryMessages are printed by bash and nsenter for a command which
+// is not installed.
+var missingBinaryMessages = []string{
+	"command not found",
+	"failed to execute",
+}
+
+// command returns the command running prog with args inside netns, or in the
+// current network namespace if netns is empty. The command is killed when ctx
+// is done, and runs in its own process group which run kills with it.
+func command(ctx context.Context, netns string, prog string, args ...string) *exec.Cmd {
+	var cmd *exec.Cmd
+	if netns == "" {
+		cmd = exec.CommandContext(ctx, prog, args...)
+	} else {
+		cmd = exec.CommandContext(ctx, "nsenter", append([]string{fmt.Sprintf("--net=%s", netns), prog}, args...)...)
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return cmd
+}
+
+// run runs cmd and returns its stdout, or an *ExecError telling why it failed.
+// When ctx is done, the whole process group of cmd is killed: the iptables
+// commands istio-iptables.sh runs would otherwise hold its output open, and
+// run would wait for them past the deadline.
+func run(ctx context.Context, cmd *exec.Cmd) (string, error) {
+	var stdout, stderr bytes.Buffer
+	if cmd.Stdout == nil {
+		cmd.Stdout = &stdout
+	}
+	cmd.Stderr = &stderr
+	err := cmd.Start()
+	if err == nil {
+		done := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				if cmd.SysProcAttr != nil && cmd.SysProcAttr.Setpgid {
+					_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+				}
+			case <-done:
+			}
+		}()
+		err = cmd.Wait()
+		close(done)
+		if err == nil && ctx.Err() != nil {
+			// The children outlived the deadline.
+			err = ctx.Err()
+		}
+	}
+	if err == nil {
+		return stdout.String(), nil
+	}
+	return stdout.String(), classify(ctx, cmd, stdout.String(), stderr.String(), err)
+}
+
+func classify(ctx context.Context, cmd *exec.Cmd, stdout, stderr string, err error) *ExecError {
+	e := &ExecError{Cause: CauseRule, Command: strings.Join(cmd.Args, " "), Stdout: stdout, Stderr: stderr, Err: err}
+	// With set -x, istio-iptables.sh traces each command before running it.
+	if traced := lastLine(stderr, tracedRuleCommand); traced != "" {
+		e.Command = strings.TrimSpace(strings.TrimLeft(traced, "+"))
+	}
+	if ctx.Err() != nil {
+		e.Cause = CauseTimeout
+		e.Err = fmt.Errorf("%v: %v", ctx.Err(), err)
+	}
+	// Only the last message counts, the script retries commands which failed
+	// to get the lock.
+	detail := lastLine(stderr, func(l string) bool { return !strings.HasPrefix(l, "+") })
+	for _, msg := range lockContentionMessages {
+		if strings.Contains(detail, msg) {
+			e.Cause = CauseLockContention
+		}
+	}
+	for _, msg := range missingBinaryMessages {
+		if strings.Contains(detail, msg) {
+			e.Cause = CauseMissingBinary
+		}
+	}
+	if errors.Is(err, exec.ErrNotFound) || errors.Is(err, os.ErrNotExist) {
+		e.Cause = CauseMissingBinary
+	}
+	return e
+}
+
+// tracedRuleCommand returns true for a set -x trace of an iptables or ip
+// command.
+func tracedRuleCommand(line string) bool {
+	if !strings.HasPrefix(line, "+") {
+		return false
+	}
+	fields := strings.Fields(strings.TrimLeft(line, "+"))
+	if len(fields) == 0 {
+		return false
+	}
+	prog := filepath.Base(fields[0])
+	return prog == "ip" || strings.HasPrefix(prog, "iptables") || strings.HasPrefix(prog, "ip6tables")
+}
+
+// lastLine returns the last non-empty line of out matching keep.
+func lastLine(out string, keep func(string) bool) string {
+	lines := strings.Split(out, "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		if l := strings.TrimSpace(lines[i]); l != "" && keep(l) {
+			return l
+		}
+	}
+	return ""
+}
@@ -0,0 +1,103 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package capture
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunClassifiesFailures(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		args    []string
+		cause   Cause
+		command string
+	}{
+		{
+			name:  "missing binary",
+			args:  []string{"/nonexistent/iptables-save"},
+			cause: CauseMissingBinary,
+		},
+		{
+			name:  "command not found in script",
+			args:  []string{"bash", "-c", "set -x; nonexistent-iptables -t nat -L"},
+			cause: CauseMissingBinary,
+		},
+		{
+			name:    "timeout",
+			timeout: 100 * time.Millisecond,
+			args:    []string{"sleep", "5"},
+			cause:   CauseTimeout,
+		},
+		{
+			name: "lock contention",
+			args: []string{"bash", "-c", "set -x; echo 'Another app is currently holding the xtables lock. " +
+				"Perhaps you want to use the -w option?' >&2; exit 4"},
+			cause: CauseLockContention,
+		},
+		{
+			name: "bad rule",
+			args: []string{"bash", "-c", "iptables() { echo 'iptables: No chain/target/match by that name.' >&2; return 1; }; " +
+				"echo 'Another app is currently holding the xtables lock.' >&2; " +
+				"set -x; iptables -t nat -A ISTIO_OUTPUT -j ISTIO_NOPE || exit 1"},
+			cause:   CauseRule,
+			command: "iptables -t nat -A ISTIO_OUTPUT -j ISTIO_NOPE",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+			_, err := run(ctx, command(ctx, "", tt.args[0], tt.args[1:]...))
+			var execErr *ExecError
+			if !errors.As(err, &execErr) {
+				t.Fatalf("expected *ExecError, got %v", err)
+			}
+			if execErr.Cause != tt.cause {
+				t.Fatalf("expected cause %s, got %v", tt.cause, err)
+			}
+			if tt.command != "" && execErr.Command != tt.command {
+				t.Fatalf("expected command %q, got %q", tt.command, execErr.Command)
+			}
+			if !strings.HasPrefix(err.Error(), string(tt.cause)+": ") {
+				t.Fatalf("expected the error to start with the cause, got %v", err)
+			}
+		})
+	}
+}
+
+func TestRunKillsChildrenHoldingOutput(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	// The background child keeps stdout open after the script exits.
+	_, err := run(ctx, command(ctx, "", "sh", "-c", "sleep 30 & echo started"))
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("expected the child to be killed at the deadline, waited %v", elapsed)
+	}
+	var execErr *ExecError
+	if !errors.As(err, &execErr) || execErr.Cause != CauseTimeout {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+}
@@ -0,0 +1,330 @@
+// Copyright 2019 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package capture
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"istio.io/cni/pkg/redirect"
+	"istio.io/pkg/log"
+)
+
+var (
+	nsSetupProg = "istio-iptables.sh"
+)
+
+// cleanupTimeout bounds the removal or restore of rules after Program failed,
+// which cannot use the context of Program once it is done.
+const cleanupTimeout = 10 * time.Second
+
+type iptables struct {
+	binDir string
+	// backend is the configured iptables backend, BackendAuto until detected.
+	backend    string
+	detectOnce sync.Once
+}
+
+func newIPTables(cfg *Config) InterceptRuleMgr {
+	ipt := &iptables{binDir: DefaultBinDir, backend: BackendAuto}
+	if cfg != nil && cfg.BinDir != "" {
+		ipt.binDir = cfg.BinDir
+	}
+	if cfg != nil && cfg.Backend != "" {
+		ipt.backend = cfg.Backend
+	}
+	return ipt
+}
+
+// resolveBackend returns the iptables backend whose commands program the
+// rules, detecting it on first use for BackendAuto.
+func (ipt *iptables) resolveBackend(ctx context.Context) string {
+	ipt.detectOnce.Do(func() {
+		if ipt.backend == BackendAuto {
+			ipt.backend = detectBackend(ctx)
+		}
+	})
+	return ipt.backend
+}
+
+// scriptArgs returns the istio-iptables.sh arguments for rdrct.
+func scriptArgs(rdrct *redirect.Redirect) []string {
+	args := []string{
+		"-p", rdrct.TargetPort,
+		"-u", joinIDs(rdrct.NoRedirectUID, rdrct.ExcludeOutboundUIDs),
+		"-g", joinIDs(rdrct.NoRedirectUID, rdrct.ExcludeOutboundGIDs),
+		"-m", rdrct.RedirectMode,
+		"-i", rdrct.IncludeIPCidrs,
+		"-b", rdrct.IncludePorts,
+		"-d", rdrct.ExcludeInboundPorts,
+		"-o", rdrct.ExcludeOutboundPorts,
+		"-q", rdrct.IncludeOutboundPorts,
+		"-x", rdrct.ExcludeIPCidrs,
+		"-s", rdrct.ExcludeInboundSourceIPCidrs,
+		"-k", rdrct.KubevirtInterfaces,
+		"-e", rdrct.ExcludeInterfaces,
+		"-f", rdrct.InboundPortTargets,
+	}
+	if rdrct.EgressLockdown {
+		args = append(args, "-l")
+		if rdrct.EgressLockdownRejectUDP {
+			args = append(args, "-r")
+		}
+	}
+	return args
+}
+
+// joinIDs returns the proxy's id followed by the other excluded ids. The proxy
+// runs with the same UID and GID.
+func joinIDs(proxyID, ids string) string {
+	if ids == "" {
+		return proxyID
+	}
+	if proxyID == "" {
+		return ids
+	}
+	return proxyID + "," + ids
+}
+
+// scriptEnv returns the istio-iptables.sh environment variables for rdrct,
+// which the script has no flags for.
+func scriptEnv(rdrct *redirect.Redirect) []string {
+	var env []string
+	for _, v := range []struct{ name, val string }{
+		{"ISTIO_INBOUND_TPROXY_MARK", rdrct.TproxyMark},
+		{"ISTIO_INBOUND_TPROXY_MASK", rdrct.TproxyMask},
+		{"ISTIO_INBOUND_TPROXY_ROUTE_TABLE", rdrct.TproxyRouteTable},
+	} {
+		if v.val != "" {
+			env = append(env, v.name+"="+v.val)
+		}
+	}
+	if rdrct.OutboundTproxy {
+		env = append(env, "ISTIO_OUTBOUND_TPROXY=true")
+	}
+	return env
+}
+
+// scriptCommand returns the istio-iptables.sh command for rdrct using the
+// iptables commands of backend.
+func (ipt *iptables) scriptCommand(ctx context.Context, netns, backend string, rdrct *redirect.Redirect,
+	args ...string) *exec.Cmd {
+	cmd := command(ctx, netns, fmt.Sprintf("%s/%s", ipt.binDir, nsSetupProg), args...)
+	env := scriptEnv(rdrct)
+	if backend != "" {
+		env = append(env, "ISTIO_IPTABLES_BACKEND="+backend)
+	}
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	return cmd
+}
+
+// Program defines a method which programs iptables based on the parameters
+// provided in Redirect. Istio chains already in netns, e.g. when the runtime
+// retries ADD or reuses the network namespace, are kept if they match rdrct and
+// replaced otherwise. A failed replacement restores the previous rules, and
+// rules partly programmed when ctx is done are removed. A node without IPv6
+// iptables, where ip6tables-save is missing or fails, has no IPv6 rules.
+func (ipt *iptables) Program(ctx context.Context, netns string, rdrct *redirect.Redirect) error {
+	saved, err := ipt.saveFamilies(ctx, netns, map[string]bool{familyIPv4: true, familyIPv6: true})
+	if err != nil {
+		return err
+	}
+	programmed := false
+	for family, out := range saved {
+		programmed = programmed || HasIstioChains(family, out)
+	}
+	if !programmed {
+		err := ipt.run(ctx, netns, rdrct)
+		if err != nil && ctx.Err() != nil {
+			cleanupCtx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+			defer cancel()
+			if cleanupErr := ipt.remove(cleanupCtx, netns, rdrct); cleanupErr != nil {
+				log.Error("Failed to clean up capture rules", zap.String("netns", netns), zap.Error(cleanupErr))
+			}
+		}
+		return err
+	}
+
+	cmds, err := ipt.render(ctx, netns, rdrct)
+	if err != nil {
+		return err
+	}
+	var actual []Rule
+	for _, family := range []string{familyIPv4, familyIPv6} {
+		actual = append(actual, ParseSave(family, saved[family])...)
+	}
+	// The rendered script adds IPv6 rules even where ip6tables is missing.
+	diff := Compare(ParseCommands(cmds).Only(saved), actual)
+	if diff.Empty() {
+		log.Info("Capture rules already programmed", zap.String("netns", netns))
+		return nil
+	}
+	log.Info("Replacing capture rules", zap.String("netns", netns), zap.String("diff", diff.String()))
+	err = ipt.remove(ctx, netns, rdrct)
+	if err == nil {
+		err = ipt.run(ctx, netns, rdrct)
+	}
+	if err != nil {
+		// Put the previous rules back rather than leave the netns partly
+		// programmed. Each table is replaced in a single commit.
+		restoreCtx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+		defer cancel()
+		for _, family := range []string{familyIPv4, familyIPv6} {
+			out, ok := saved[family]
+			if !ok {
+				continue
+			}
+			if restoreErr := ipt.restore(restoreCtx, netns, family, out); restoreErr != nil {
+				log.Error("Failed to restore capture rules", zap.String("family", family), zap.Error(restoreErr))
+			}
+		}
+	}
+	return err
+}
+
+// run runs istio-iptables.sh to add the rules for rdrct.
+func (ipt *iptables) run(ctx context.Context, netns string, rdrct *redirect.Redirect) error {
+	cmd := ipt.scriptCommand(ctx, netns, ipt.resolveBackend(ctx), rdrct, scriptArgs(rdrct)...)
+	log.Info("nsenter args",
+		zap.Reflect("nsenterArgs", cmd.Args[1:]), zap.Strings("env", scriptEnv(rdrct)))
+	out, err := run(ctx, cmd)
+	if err != nil {
+		e := err.(*ExecError)
+		log.Error("nsenter failed",
+			zap.String("cause", string(e.Cause)),
+			zap.String("stdout", e.Stdout),
+			zap.String("stderr", e.Stderr),
+			zap.Error(err))
+	} else {
+		log.Infof("nsenter done: %s", out)
+	}
+	return err
+}
+
+// Render runs istio-iptables.sh in dry run mode and returns the iptables and
+// ip commands it would have run.
+func (ipt *iptables) Render(netns string, rdrct *redirect.Redirect) ([]string, error) {
+	return ipt.render(context.Background(), netns, rdrct)
+}
+
+func (ipt *iptables) render(ctx context.Context, netns string, rdrct *redirect.Redirect) ([]string, error) {
+	// Dry run mode only prints the commands, which do not depend on the backend.
+	out, err := run(ctx, ipt.scriptCommand(ctx, netns, "", rdrct, append([]string{"-n"}, scriptArgs(rdrct)...)...))
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %w", nsSetupProg, err)
+	}
+	var cmds []string
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		for _, prefix := range []string{"iptables ", "ip6tables ", "ip "} {
+			if strings.HasPrefix(line, prefix) {
+				cmds = append(cmds, line)
+				break
+			}
+		}
+	}
+	return cmds, scanner.Err()
+}
+
+// save returns the iptables-save or ip6tables-save output of netns.
+func (ipt *iptables) save(ctx context.Context, netns, family string) (string, error) {
+	prog := backendCommand(family, ipt.resolveBackend(ctx), "-save")
+	out, err := run(ctx, command(ctx, netns, prog))
+	if err != nil {
+		return "", fmt.Errorf("%s failed: %w", prog, err)
+	}
+	return out, nil
+}
+
+// saveFamilies returns the save output of netns for the given families, keyed
+// by family. A failed ip6tables-save, e.g. on a node without IPv6 iptables,
+// is logged and leaves IPv6 out, as the node has no IPv6 rules.
+func (ipt *iptables) saveFamilies(ctx context.Context, netns string, families map[string]bool) (map[string]string, error) {
+	saved := map[string]string{}
+	for _, family := range []string{familyIPv4, familyIPv6} {
+		if !families[family] {
+			continue
+		}
+		out, err := ipt.save(ctx, netns, family)
+		if err != nil && (family != familyIPv6 || ctx.Err() != nil) {
+			return nil, err
+		}
+		if err != nil {
+			log.Warn("Failed to save IPv6 rules, assuming there are none", zap.String("netns", netns), zap.Error(err))
+			continue
+		}
+		saved[family] = out
+	}
+	return saved, nil
+}
+
+// restore replaces the tables of netns with the iptables-save output data.
+func (ipt *iptables) restore(ctx context.Context, netns, family, data string) error {
+	prog := backendCommand(family, ipt.resolveBackend(ctx), "-restore")
+	cmd := command(ctx, netns, prog)
+	cmd.Stdin = strings.NewReader(data)
+	if _, err := run(ctx, cmd); err != nil {
+		return fmt.Errorf("%s failed: %w", prog, err)
+	}
+	return nil
+}
+
+// Verify compares the rules in netns with the rules rendered for rdrct. A node
+// without IPv6 iptables, where ip6tables-save is missing or fails, is only
+// checked for the IPv4 rules.
+func (ipt *iptables) Verify(ctx context.Context, netns string, rdrct *redirect.Redirect) error {
+	cmds, err := ipt.render(ctx, netns, rdrct)
+	if err != nil {
+		return err
+	}
+	expected := ParseCommands(cmds)
+	saved, err := ipt.saveFamilies(ctx, netns, expected.Families())
+	if err != nil {
+		return err
+	}
+	expected = expected.Only(saved)
+	var actual []Rule
+	for _, family := range []string{familyIPv4, familyIPv6} {
+		actual = append(actual, ParseSave(family, saved[family])...)
+	}
+	if diff := Compare(expected, actual); !diff.Empty() {
+		return &MismatchError{Netns: netns, Diff: diff}
+	}
+	return nil
+}
+
+// Remove runs istio-iptables.sh in clean up mode.
+func (ipt *iptables) Remove(netns string, rdrct *redirect.Redirect) error {
+	return ipt.remove(context.Background(), netns, rdrct)
+}
+
+func (ipt *iptables) remove(ctx context.Context, netns string, rdrct *redirect.Redirect) error {
+	_, err := run(ctx, ipt.scriptCommand(ctx, netns, ipt.resolveBackend(ctx), rdrct, "-c", "-k", rdrct.KubevirtInterfaces))
+	if err != nil {
+		log.Error("istio-iptables.sh clean up failed", zap.Error(err))
+	}
+	return err
+}
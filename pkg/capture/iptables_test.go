@@ -0,0 +1,318 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package capture
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"istio.io/cni/pkg/redirect"
+)
+
+// testBinDir holds the istio-iptables.sh of this repo.
+const testBinDir = "../../tools/packaging/common"
+
+func render(t *testing.T, rdrct *redirect.Redirect) string {
+	t.Helper()
+	cmds, err := IptablesInterceptRuleMgrCtor(&Config{BinDir: testBinDir}).Render("", rdrct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Join(cmds, "\n")
+}
+
+func TestRenderIncludeOutboundPorts(t *testing.T) {
+	rdrct := redirect.Defaults()
+	if out := render(t, rdrct); strings.Contains(out, "multiport") {
+		t.Fatalf("expected all outbound ports captured by default, got:\n%s", out)
+	}
+
+	rdrct.IncludeOutboundPorts = "80,8000-8100"
+	want := "iptables -t nat -A ISTIO_OUTPUT -p tcp -m multiport ! --dports 80,8000:8100 -j RETURN"
+	if out := render(t, rdrct); !strings.Contains(out, want) {
+		t.Fatalf("expected %q, got:\n%s", want, out)
+	}
+}
+
+func TestRenderExcludeInboundSourceIPCidrs(t *testing.T) {
+	for mode, table := range map[string]string{redirect.ModeREDIRECT: "nat", redirect.ModeTPROXY: "mangle"} {
+		rdrct := redirect.Defaults()
+		rdrct.RedirectMode = mode
+		rdrct.ExcludeInboundSourceIPCidrs = "10.1.0.0/16,130.211.0.0/22"
+		out := render(t, rdrct)
+		for _, cidr := range []string{"10.1.0.0/16", "130.211.0.0/22"} {
+			want := "iptables -t " + table + " -A ISTIO_INBOUND -s " + cidr + " -j RETURN"
+			if !strings.Contains(out, want) {
+				t.Errorf("%s: expected %q, got:\n%s", mode, want, out)
+			}
+		}
+	}
+}
+
+func TestRenderExcludeOutboundIDs(t *testing.T) {
+	rdrct := redirect.Defaults()
+	rdrct.ExcludeOutboundUIDs = "1500,1501"
+	rdrct.ExcludeOutboundGIDs = "2500"
+	out := render(t, rdrct)
+	for _, want := range []string{
+		"iptables -t nat -A ISTIO_OUTPUT -m owner --uid-owner 1337 -j RETURN",
+		"iptables -t nat -A ISTIO_OUTPUT -m owner --uid-owner 1500 -j RETURN",
+		"iptables -t nat -A ISTIO_OUTPUT -m owner --uid-owner 1501 -j RETURN",
+		"iptables -t nat -A ISTIO_OUTPUT -m owner --gid-owner 1337 -j RETURN",
+		"iptables -t nat -A ISTIO_OUTPUT -m owner --gid-owner 2500 -j RETURN",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q, got:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "--gid-owner 1500") {
+		t.Errorf("expected excluded UIDs not to be used as GIDs, got:\n%s", out)
+	}
+}
+
+func TestRenderExcludeInterfaces(t *testing.T) {
+	rdrct := redirect.Defaults()
+	rdrct.ExcludeInterfaces = "net1,net2"
+	out := render(t, rdrct)
+	for _, iface := range []string{"net1", "net2"} {
+		for _, want := range []string{
+			"iptables -t nat -A ISTIO_INBOUND -i " + iface + " -j RETURN",
+			"iptables -t nat -A ISTIO_OUTPUT -o " + iface + " -j RETURN",
+		} {
+			if !strings.Contains(out, want) {
+				t.Errorf("expected %q, got:\n%s", want, out)
+			}
+		}
+	}
+}
+
+func TestRenderTPROXYSettings(t *testing.T) {
+	rdrct := redirect.Defaults()
+	rdrct.RedirectMode = redirect.ModeTPROXY
+	out := render(t, rdrct)
+	for _, want := range []string{
+		"iptables -t mangle -A ISTIO_DIVERT -j MARK --set-mark 1337",
+		"ip -f inet rule add fwmark 1337 lookup 133",
+		"--tproxy-mark 1337/0xffffffff",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected %q, got:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "CONNMARK") {
+		t.Fatalf("expected no outbound TPROXY by default, got:\n%s", out)
+	}
+
+	rdrct.TproxyMark = "0x400"
+	rdrct.TproxyMask = "0xf00"
+	rdrct.TproxyRouteTable = "200"
+	rdrct.OutboundTproxy = true
+	out = render(t, rdrct)
+	for _, want := range []string{
+		"iptables -t mangle -A ISTIO_DIVERT -j MARK --set-mark 0x400/0xf00",
+		"ip -f inet rule add fwmark 0x400/0xf00 lookup 200",
+		"ip -f inet route add local default dev lo table 200",
+		"--tproxy-mark 0x400/0xf00",
+		"iptables -t mangle -A ISTIO_INBOUND -p tcp -m mark --mark 0x400/0xf00 -j CONNMARK --save-mark --nfmask 0xf00 --ctmask 0xf00",
+		"iptables -t mangle -A ISTIO_OUTPUT -p tcp -m connmark --mark 0x400/0xf00 -j CONNMARK --restore-mark --nfmask 0xf00 --ctmask 0xf00",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected %q, got:\n%s", want, out)
+		}
+	}
+}
+
+func TestRenderEgressLockdown(t *testing.T) {
+	rdrct := redirect.Defaults()
+	rdrct.ExcludeOutboundUIDs = "1500"
+	rdrct.ExcludeIPCidrs = "10.0.0.0/8"
+	if out := render(t, rdrct); strings.Contains(out, "ISTIO_EGRESS") {
+		t.Fatalf("expected no egress lockdown by default, got:\n%s", out)
+	}
+
+	rdrct.EgressLockdown = true
+	out := render(t, rdrct)
+	for _, family := range []string{"iptables", "ip6tables"} {
+		for _, want := range []string{
+			family + " -t filter -A OUTPUT -j ISTIO_EGRESS",
+			family + " -t filter -A ISTIO_EGRESS -o lo -j RETURN",
+			family + " -t filter -A ISTIO_EGRESS -m owner --uid-owner 1337 --gid-owner 1337 -j RETURN",
+			family + " -t filter -A ISTIO_EGRESS -m owner --uid-owner 1500 -j RETURN",
+			family + " -t filter -A ISTIO_EGRESS -p udp -j RETURN",
+			family + " -t filter -A ISTIO_EGRESS -j DROP",
+		} {
+			if !strings.Contains(out, want) {
+				t.Fatalf("expected %q, got:\n%s", want, out)
+			}
+		}
+	}
+	if want := "iptables -t filter -A ISTIO_EGRESS -d 10.0.0.0/8 -j RETURN"; !strings.Contains(out, want) {
+		t.Fatalf("expected %q, got:\n%s", want, out)
+	}
+
+	rdrct.EgressLockdownRejectUDP = true
+	out = render(t, rdrct)
+	for _, want := range []string{
+		"iptables -t filter -A ISTIO_EGRESS -p udp --dport 53 -j RETURN",
+		"iptables -t filter -A ISTIO_EGRESS -p udp -j REJECT",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected %q, got:\n%s", want, out)
+		}
+	}
+}
+
+func TestRenderInboundPortTargets(t *testing.T) {
+	rdrct := redirect.Defaults()
+	rdrct.InboundPortTargets = "9000:15007"
+	want := "iptables -t nat -A ISTIO_INBOUND -p tcp --dport 9000 -j REDIRECT --to-port 15007"
+	if out := render(t, rdrct); !strings.Contains(out, want) {
+		t.Fatalf("expected %q, got:\n%s", want, out)
+	}
+
+	rdrct.RedirectMode = redirect.ModeTPROXY
+	want = "iptables -t mangle -A ISTIO_INBOUND ! -d 127.0.0.1/32 -p tcp --dport 9000 -j TPROXY " +
+		"--tproxy-mark 1337/0xffffffff --on-port 15007"
+	if out := render(t, rdrct); !strings.Contains(out, want) {
+		t.Fatalf("expected %q, got:\n%s", want, out)
+	}
+}
+
+func TestProgramWithoutIPv6(t *testing.T) {
+	dir, err := ioutil.TempDir("", "program")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// The node has iptables-save, but no ip6tables-save.
+	for prog, script := range map[string]string{
+		"iptables-save": "#!/bin/sh\necho '*nat'\necho COMMIT\n",
+		nsSetupProg:     "#!/bin/sh\n: > \"$0.ran\"\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, prog), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := os.Getenv("PATH")
+	defer os.Setenv("PATH", path)
+	os.Setenv("PATH", dir)
+
+	ipt := IptablesInterceptRuleMgrCtor(&Config{BinDir: dir})
+	if err := ipt.Program(context.Background(), "", redirect.Defaults()); err != nil {
+		t.Fatalf("expected a missing ip6tables-save to mean no IPv6 rules, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, nsSetupProg+".ran")); err != nil {
+		t.Fatalf("expected %s to program the rules: %v", nsSetupProg, err)
+	}
+}
+
+// fakeProgrammedNode puts an iptables-save holding the rules the fake
+// istio-iptables.sh renders, for both families, first in PATH, without an
+// ip6tables-save. The script records a run other than a dry run.
+func fakeProgrammedNode(t *testing.T) (dir string, cleanup func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "programmed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for prog, script := range map[string]string{
+		"iptables-save": "#!/bin/sh\n" +
+			"printf '*nat\\n:ISTIO_INBOUND - [0:0]\\n-A ISTIO_INBOUND -p tcp -j RETURN\\nCOMMIT\\n'\n",
+		nsSetupProg: "#!/bin/sh\n" +
+			"if [ \"$1\" != -n ]; then : > \"$0.ran\"; exit 0; fi\n" +
+			"for cmd in iptables ip6tables; do\n" +
+			"  echo \"$cmd -t nat -N ISTIO_INBOUND\"\n" +
+			"  echo \"$cmd -t nat -A ISTIO_INBOUND -p tcp -j RETURN\"\n" +
+			"done\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, prog), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir)
+	return dir, func() {
+		os.Setenv("PATH", path)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestReprogramWithoutIPv6(t *testing.T) {
+	dir, cleanup := fakeProgrammedNode(t)
+	defer cleanup()
+
+	ipt := IptablesInterceptRuleMgrCtor(&Config{BinDir: dir})
+	if err := ipt.Program(context.Background(), "", redirect.Defaults()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, nsSetupProg+".ran")); !os.IsNotExist(err) {
+		t.Fatalf("expected the programmed IPv4 rules to be kept without ip6tables-save, got %v", err)
+	}
+}
+
+func TestVerifyWithoutIPv6(t *testing.T) {
+	dir, cleanup := fakeProgrammedNode(t)
+	defer cleanup()
+
+	ipt := IptablesInterceptRuleMgrCtor(&Config{BinDir: dir})
+	if err := ipt.Verify(context.Background(), "", redirect.Defaults()); err != nil {
+		t.Fatalf("expected the IPv4 rules to verify without ip6tables-save, got %v", err)
+	}
+}
+
+func TestEgressLockdownWithoutIPv6(t *testing.T) {
+	which, err := exec.LookPath("which")
+	if err != nil {
+		t.Skip("which is not installed")
+	}
+	dir, err := ioutil.TempDir("", "lockdown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// The node has iptables, but neither ip6tables nor ip6tables-save.
+	calls := filepath.Join(dir, "calls")
+	for _, prog := range []string{"iptables", "iptables-save"} {
+		script := "#!/bin/sh\necho \"$*\" >> " + calls + "\n"
+		if err := ioutil.WriteFile(filepath.Join(dir, prog), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(which, filepath.Join(dir, "which")); err != nil {
+		t.Fatal(err)
+	}
+	path := os.Getenv("PATH")
+	defer os.Setenv("PATH", path)
+	os.Setenv("PATH", dir)
+
+	rdrct := redirect.Defaults()
+	rdrct.EgressLockdown = true
+	ipt := IptablesInterceptRuleMgrCtor(&Config{BinDir: testBinDir})
+	if err := ipt.Program(context.Background(), "", rdrct); err != nil {
+		t.Fatalf("expected the IPv4 egress lockdown without ip6tables, got %v", err)
+	}
+	out, err := ioutil.ReadFile(calls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "-t filter -A ISTIO_EGRESS -j DROP") {
+		t.Fatalf("expected the IPv4 egress lockdown, got:\n%s", out)
+	}
+}
@@ -0,0 +1,334 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package capture
+
+import (
+	"bufio"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	familyIPv4 = "iptables"
+	familyIPv6 = "ip6tables"
+)
+
+// Rule is a single iptables rule. Spec holds the rule's match and target
+// options in a canonical form, so that rules written differently but with the
+// same meaning (e.g. as rendered by istio-iptables.sh and as listed by
+// iptables-save) compare equal.
+type Rule struct {
+	Family string
+	Table  string
+	Chain  string
+	Spec   string
+}
+
+func (r Rule) String() string {
+	return fmt.Sprintf("%s -t %s -A %s %s", r.Family, r.Table, r.Chain, r.Spec)
+}
+
+func (r Rule) chain() string {
+	return r.Family + "/" + r.Table + "/" + r.Chain
+}
+
+// istioChainPrefix starts the names of the chains created by istio-iptables.sh.
+const istioChainPrefix = "ISTIO_"
+
+// istio returns true if the rule is in an Istio chain or jumps to one.
+func (r Rule) istio() bool {
+	if strings.HasPrefix(r.Chain, istioChainPrefix) {
+		return true
+	}
+	for _, target := range []string{"-j ", "-g "} {
+		if strings.Contains(r.Spec, target+istioChainPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasIstioChains returns true if iptables-save or ip6tables-save output
+// declares an Istio chain or jumps to one, i.e. capture was at least partly
+// programmed.
+func HasIstioChains(family, out string) bool {
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		if strings.HasPrefix(strings.TrimSpace(scanner.Text()), ":"+istioChainPrefix) {
+			return true
+		}
+	}
+	for _, r := range ParseSave(family, out) {
+		if r.istio() {
+			return true
+		}
+	}
+	return false
+}
+
+// Ruleset is the set of rules expected in a network namespace. Owned chains are
+// the chains created or flushed by the commands, which must not hold any other
+// rules.
+type Ruleset struct {
+	Rules []Rule
+	Owned map[string]bool
+}
+
+// Families returns the iptables families the ruleset has rules for.
+func (rs Ruleset) Families() map[string]bool {
+	families := map[string]bool{}
+	for _, r := range rs.Rules {
+		families[r.Family] = true
+	}
+	return families
+}
+
+// Only returns the ruleset with the rules of the given families, the keys of
+// families.
+func (rs Ruleset) Only(families map[string]string) Ruleset {
+	only := Ruleset{Owned: rs.Owned}
+	for _, r := range rs.Rules {
+		if _, ok := families[r.Family]; ok {
+			only.Rules = append(only.Rules, r)
+		}
+	}
+	return only
+}
+
+// ParseCommands returns the rules added by iptables and ip6tables commands.
+// Other commands, e.g. ip route changes, are ignored.
+func ParseCommands(cmds []string) Ruleset {
+	rs := Ruleset{Owned: map[string]bool{}}
+	for _, cmd := range cmds {
+		args := strings.Fields(cmd)
+		if len(args) == 0 || (args[0] != familyIPv4 && args[0] != familyIPv6) {
+			continue
+		}
+		family, table := args[0], "filter"
+		args = args[1:]
+		if len(args) >= 2 && (args[0] == "-t" || args[0] == "--table") {
+			table, args = args[1], args[2:]
+		}
+		if len(args) < 2 {
+			continue
+		}
+		r := Rule{Family: family, Table: table, Chain: args[1]}
+		switch args[0] {
+		case "-N", "--new-chain", "-F", "--flush":
+			rs.Owned[r.chain()] = true
+		case "-A", "--append":
+			r.Spec = normalizeSpec(args[2:])
+			rs.Rules = append(rs.Rules, r)
+		case "-I", "--insert":
+			rest := args[2:]
+			if len(rest) > 0 {
+				if _, err := strconv.Atoi(rest[0]); err == nil {
+					rest = rest[1:]
+				}
+			}
+			r.Spec = normalizeSpec(rest)
+			rs.Rules = append(rs.Rules, r)
+		}
+	}
+	return rs
+}
+
+// ParseSave returns the rules listed in iptables-save or ip6tables-save output.
+func ParseSave(family, out string) []Rule {
+	var rules []Rule
+	table := ""
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "*"):
+			table = line[1:]
+		case strings.HasPrefix(line, "-A "):
+			args := strings.Fields(line)
+			if len(args) < 2 {
+				continue
+			}
+			rules = append(rules, Rule{Family: family, Table: table, Chain: args[1], Spec: normalizeSpec(args[2:])})
+		}
+	}
+	return rules
+}
+
+var optionAliases = map[string]string{
+	"--protocol":      "-p",
+	"--source":        "-s",
+	"--destination":   "-d",
+	"--in-interface":  "-i",
+	"--out-interface": "-o",
+	"--jump":          "-j",
+	"--goto":          "-g",
+	"--match":         "-m",
+	"--to-port":       "--to-ports",
+	"--set-mark":      "--set-xmark",
+}
+
+// normalizeSpec canonicalizes the options of a rule: long options are
+// shortened, match module loads are dropped, addresses get a prefix length,
+// marks are written in decimal, defaults added by iptables-save are removed
+// and the options are sorted.
+func normalizeSpec(args []string) string {
+	var opts []string
+	negate := false
+	for i := 0; i < len(args); i++ {
+		if args[i] == "!" {
+			negate = true
+			continue
+		}
+		flag := args[i]
+		if alias, ok := optionAliases[flag]; ok {
+			flag = alias
+		}
+		var vals []string
+		for i+1 < len(args) && args[i+1] != "!" && !strings.HasPrefix(args[i+1], "-") {
+			i++
+			vals = append(vals, args[i])
+		}
+		opt, keep := normalizeOption(flag, vals)
+		if keep {
+			if negate {
+				opt = "! " + opt
+			}
+			opts = append(opts, opt)
+		}
+		negate = false
+	}
+	sort.Strings(opts)
+	return strings.Join(opts, " ")
+}
+
+func normalizeOption(flag string, vals []string) (string, bool) {
+	switch flag {
+	case "-m":
+		// The match options themselves identify the module.
+		return "", false
+	case "-p":
+		for i := range vals {
+			vals[i] = strings.ToLower(vals[i])
+		}
+	case "-s", "-d":
+		for i, v := range vals {
+			if !strings.Contains(v, "/") {
+				if strings.Contains(v, ":") {
+					vals[i] = v + "/128"
+				} else {
+					vals[i] = v + "/32"
+				}
+			}
+		}
+	case "--set-xmark", "--tproxy-mark", "--mark":
+		for i, v := range vals {
+			vals[i] = normalizeMark(v)
+		}
+	case "--nfmask", "--ctmask":
+		for i, v := range vals {
+			if n, err := strconv.ParseUint(v, 0, 32); err == nil {
+				vals[i] = strconv.FormatUint(n, 10)
+			}
+		}
+	case "--on-ip":
+		if len(vals) == 1 && (vals[0] == "0.0.0.0" || vals[0] == "::") {
+			return "", false
+		}
+	case "--reject-with":
+		if len(vals) == 1 && (vals[0] == "icmp-port-unreachable" || vals[0] == "icmp6-port-unreachable") {
+			return "", false
+		}
+	}
+	return strings.Join(append([]string{flag}, vals...), " "), true
+}
+
+// normalizeMark writes a value[/mask] mark in decimal, with the full mask
+// iptables-save adds when none is given.
+func normalizeMark(mark string) string {
+	parts := strings.SplitN(mark, "/", 2)
+	if len(parts) == 1 {
+		parts = append(parts, "0xffffffff")
+	}
+	for i, p := range parts {
+		if n, err := strconv.ParseUint(p, 0, 32); err == nil {
+			parts[i] = strconv.FormatUint(n, 10)
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// Diff lists the differences between expected and actual rules.
+type Diff struct {
+	// Missing are expected rules that are not programmed.
+	Missing []Rule
+	// Unexpected are programmed rules in owned chains, or Istio rules in any
+	// chain, that are not expected.
+	Unexpected []Rule
+}
+
+// Empty returns true if the rules match.
+func (d Diff) Empty() bool {
+	return len(d.Missing) == 0 && len(d.Unexpected) == 0
+}
+
+func (d Diff) String() string {
+	var b strings.Builder
+	for _, r := range d.Missing {
+		fmt.Fprintf(&b, "- %s\n", r)
+	}
+	for _, r := range d.Unexpected {
+		fmt.Fprintf(&b, "+ %s\n", r)
+	}
+	return b.String()
+}
+
+// MismatchError is returned by Verify for rules which do not match the
+// redirect.
+type MismatchError struct {
+	Netns string
+	Diff  Diff
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("iptables rules in %s do not match redirect:\n%s", e.Netns, e.Diff)
+}
+
+// Compare compares the rules of expected with the actual rules, ignoring order.
+// Rules in chains not owned by expected are only checked for the expected rules,
+// except for leftover Istio rules, e.g. jumps to the ISTIO_INBOUND chain of
+// another table after the redirect mode changed.
+func Compare(expected Ruleset, actual []Rule) Diff {
+	var diff Diff
+	remaining := map[Rule]int{}
+	for _, r := range actual {
+		remaining[r]++
+	}
+	for _, r := range expected.Rules {
+		if remaining[r] > 0 {
+			remaining[r]--
+			continue
+		}
+		diff.Missing = append(diff.Missing, r)
+	}
+	for _, r := range actual {
+		if (expected.Owned[r.chain()] || r.istio()) && remaining[r] > 0 {
+			remaining[r]--
+			diff.Unexpected = append(diff.Unexpected, r)
+		}
+	}
+	return diff
+}
@@ -0,0 +1,147 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package capture
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testCommands = []string{
+	"iptables -t nat -N ISTIO_REDIRECT",
+	"iptables -t nat -A ISTIO_REDIRECT -p tcp -j REDIRECT --to-port 15001",
+	"iptables -t mangle -N ISTIO_DIVERT",
+	"iptables -t mangle -A ISTIO_DIVERT -j MARK --set-mark 1337",
+	"ip -f inet rule add fwmark 1337 lookup 133",
+	"iptables -t mangle -N ISTIO_TPROXY",
+	"iptables -t mangle -A ISTIO_TPROXY ! -d 127.0.0.1/32 -p tcp -j TPROXY --tproxy-mark 1337/0xffffffff --on-port 15001",
+	"iptables -t mangle -A ISTIO_TPROXY -p tcp --dport 15020 -j RETURN",
+	"iptables -t nat -N ISTIO_OUTPUT",
+	"iptables -t nat -A OUTPUT -p tcp -j ISTIO_OUTPUT",
+	"iptables -t nat -A ISTIO_OUTPUT -o lo -m owner ! --uid-owner 1337 -j RETURN",
+	"iptables -t nat -A ISTIO_OUTPUT -o lo -s 127.0.0.6 -j RETURN",
+	"ip6tables -t filter -F INPUT",
+	"ip6tables -t filter -A INPUT -i lo -d ::1 -j ACCEPT",
+	"ip6tables -t filter -A INPUT -j REJECT",
+}
+
+const testSaveV4 = `# Generated by iptables-save v1.6.1
+*mangle
+:PREROUTING ACCEPT [0:0]
+:ISTIO_DIVERT - [0:0]
+:ISTIO_TPROXY - [0:0]
+-A ISTIO_DIVERT -j MARK --set-xmark 0x539/0xffffffff
+-A ISTIO_TPROXY -p tcp -m tcp --dport 15020 -j RETURN
+-A ISTIO_TPROXY ! -d 127.0.0.1/32 -p tcp -j TPROXY --on-port 15001 --on-ip 0.0.0.0 --tproxy-mark 0x539/0xffffffff
+COMMIT
+*nat
+:OUTPUT ACCEPT [0:0]
+:ISTIO_OUTPUT - [0:0]
+:ISTIO_REDIRECT - [0:0]
+-A OUTPUT -p tcp -m comment --comment "kube" -j KUBE-SERVICES
+-A OUTPUT -p tcp -j ISTIO_OUTPUT
+-A ISTIO_OUTPUT -s 127.0.0.6/32 -o lo -j RETURN
+-A ISTIO_OUTPUT -o lo -m owner ! --uid-owner 1337 -j RETURN
+-A ISTIO_REDIRECT -p tcp -j REDIRECT --to-ports 15001
+COMMIT
+`
+
+const testSaveV6 = `*filter
+:INPUT ACCEPT [0:0]
+-A INPUT -d ::1/128 -i lo -j ACCEPT
+-A INPUT -j REJECT --reject-with icmp6-port-unreachable
+COMMIT
+`
+
+func TestCompareMatchesSaveOutput(t *testing.T) {
+	expected := ParseCommands(testCommands)
+	if families := expected.Families(); !reflect.DeepEqual(families, map[string]bool{familyIPv4: true, familyIPv6: true}) {
+		t.Fatalf("unexpected families %v", families)
+	}
+	actual := append(ParseSave(familyIPv4, testSaveV4), ParseSave(familyIPv6, testSaveV6)...)
+	if diff := Compare(expected, actual); !diff.Empty() {
+		t.Fatalf("expected no diff, got:\n%s", diff)
+	}
+}
+
+func TestCompareReportsDiff(t *testing.T) {
+	expected := ParseCommands(testCommands)
+	save := strings.Replace(testSaveV4, "--to-ports 15001", "--to-ports 15002", 1)
+	actual := append(ParseSave(familyIPv4, save), ParseSave(familyIPv6, testSaveV6)...)
+
+	diff := Compare(expected, actual)
+	want := "- iptables -t nat -A ISTIO_REDIRECT --to-ports 15001 -j REDIRECT -p tcp\n" +
+		"+ iptables -t nat -A ISTIO_REDIRECT --to-ports 15002 -j REDIRECT -p tcp\n"
+	if diff.String() != want {
+		t.Fatalf("expected diff:\n%s\ngot:\n%s", want, diff)
+	}
+}
+
+func TestCompareReportsLeftoverIstioRules(t *testing.T) {
+	// REDIRECT rules expected where TPROXY was programmed before.
+	expected := ParseCommands([]string{
+		"iptables -t nat -N ISTIO_INBOUND",
+		"iptables -t nat -A PREROUTING -p tcp -j ISTIO_INBOUND",
+	})
+	actual := ParseSave(familyIPv4, `*mangle
+:PREROUTING ACCEPT [0:0]
+:ISTIO_INBOUND - [0:0]
+-A PREROUTING -p tcp -j ISTIO_INBOUND
+-A PREROUTING -j CNI-MARK
+COMMIT
+*nat
+:PREROUTING ACCEPT [0:0]
+:ISTIO_INBOUND - [0:0]
+-A PREROUTING -p tcp -j ISTIO_INBOUND
+COMMIT
+`)
+	want := "+ iptables -t mangle -A PREROUTING -j ISTIO_INBOUND -p tcp\n"
+	if diff := Compare(expected, actual); diff.String() != want {
+		t.Fatalf("expected diff:\n%s\ngot:\n%s", want, diff)
+	}
+}
+
+func TestCompareMatchesMarks(t *testing.T) {
+	expected := ParseCommands([]string{
+		"iptables -t mangle -A ISTIO_INBOUND -p tcp -m mark --mark 0x400/0xf00 -j CONNMARK --save-mark --nfmask 0xf00 --ctmask 0xf00",
+		"iptables -t mangle -A ISTIO_INBOUND -p tcp -i lo -m mark ! --mark 1337 -j RETURN",
+		"iptables -t mangle -A ISTIO_OUTPUT -p tcp -m connmark --mark 0x400/0xf00 -j CONNMARK --restore-mark --nfmask 0xf00 --ctmask 0xf00",
+	})
+	actual := ParseSave(familyIPv4, `*mangle
+:ISTIO_INBOUND - [0:0]
+:ISTIO_OUTPUT - [0:0]
+-A ISTIO_INBOUND -p tcp -m mark --mark 0x400/0xf00 -j CONNMARK --save-mark --nfmask 0xf00 --ctmask 0xf00
+-A ISTIO_INBOUND -i lo -p tcp -m mark ! --mark 0x539 -j RETURN
+-A ISTIO_OUTPUT -p tcp -m connmark --mark 0x400/0xf00 -j CONNMARK --restore-mark --nfmask 0xf00 --ctmask 0xf00
+COMMIT
+`)
+	if diff := Compare(expected, actual); !diff.Empty() {
+		t.Fatalf("expected no diff, got:\n%s", diff)
+	}
+}
+
+func TestHasIstioChains(t *testing.T) {
+	for out, want := range map[string]bool{
+		testSaveV4: true,
+		testSaveV6: false,
+		"*nat\n:ISTIO_REDIRECT - [0:0]\nCOMMIT\n":                                           true,
+		"*nat\n:PREROUTING ACCEPT [0:0]\n-A PREROUTING -i net1 -j ISTIO_REDIRECT\nCOMMIT\n": true,
+	} {
+		if got := HasIstioChains(familyIPv4, out); got != want {
+			t.Errorf("HasIstioChains(%q) = %v, want %v", out, got, want)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plan
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+
+	"istio.io/cni/pkg/policy"
+	"istio.io/cni/pkg/redirect"
+)
+
+const (
+	// PortConflictsWarn logs the app ports reserved by the proxy.
+	PortConflictsWarn = "warn"
+	// PortConflictsFail fails the ADD of pods using ports reserved by the proxy.
+	PortConflictsFail = "fail"
+
+	// linkLocalCIDR holds the cloud metadata endpoints, e.g. 169.254.169.254.
+	linkLocalCIDR = "169.254.0.0/16"
+)
+
+// Config holds the istio-cni plugin settings which decide whether and how a
+// pod is captured. It is embedded in the plugin config.
+type Config struct {
+	Kubernetes Kubernetes `json:"kubernetes"`
+	// Policy rules decide which pods are captured ahead of the default rules.
+	Policy []policy.Rule `json:"capture_policy"`
+	// RedirectDefaults are the redirect parameters used unless the namespace or
+	// pod annotations set them, keyed by registry name.
+	RedirectDefaults map[string]string `json:"redirect_defaults"`
+	// MeshConfigFile is a node-local copy of the mesh config, e.g. the "mesh"
+	// key of the istio ConfigMap, whose proxy settings give the redirect
+	// defaults.
+	MeshConfigFile string `json:"mesh_config_file"`
+	// AutoExclude adds cluster infrastructure destinations to excludeIPCidrs.
+	AutoExclude AutoExclude `json:"auto_exclude"`
+	// TPROXY configures the firewall mark and routing of the TPROXY redirect
+	// mode.
+	TPROXY TPROXY `json:"tproxy"`
+	// ProxyPorts are the proxy's ports, checked against the app's ports.
+	ProxyPorts ProxyPorts `json:"proxy_ports"`
+}
+
+// Kubernetes a K8s specific struct to hold config
+type Kubernetes struct {
+	K8sAPIRoot           string   `json:"k8s_api_root"`
+	Kubeconfig           string   `json:"kubeconfig"`
+	InterceptRuleMgrType string   `json:"intercept_type"`
+	NodeName             string   `json:"node_name"`
+	ExcludeNamespaces    []string `json:"exclude_namespaces"`
+	CniBinDir            string   `json:"cni_bin_dir"`
+	// IptablesBackend is the iptables backend programming the pod's rules:
+	// "legacy", "nft" or "auto" to detect the backend holding the node's
+	// rules on every ADD. Defaults to "auto"; setting it skips the detection.
+	IptablesBackend string `json:"iptables_backend"`
+	// ProgramTimeout bounds the programming of the pod's capture rules, e.g.
+	// "30s". Defaults to 1m.
+	ProgramTimeout string `json:"program_timeout"`
+	// VerifyRules compares the programmed rules with the pod's redirect after
+	// programming them: "warn" logs any difference, "fail" also fails the ADD.
+	// Rules are not verified if it is empty.
+	VerifyRules string `json:"verify_rules"`
+	// NamespaceDefaults applies the traffic annotations of the pod's namespace
+	// as defaults for the pod's own annotations.
+	NamespaceDefaults bool `json:"namespace_defaults"`
+	// MeshConfigMap is the namespace/name of the istio ConfigMap whose mesh
+	// config gives the redirect defaults, read unless mesh_config_file is set.
+	MeshConfigMap string `json:"mesh_config_map"`
+}
+
+// AutoExclude selects the cluster infrastructure destinations added to the
+// excludeIPCidrs of every captured pod.
+type AutoExclude struct {
+	// KubernetesService excludes the ClusterIP and endpoints of the
+	// default/kubernetes Service, i.e. the API server.
+	KubernetesService bool `json:"kubernetes_service"`
+	// NodeLocalDNS is the IP of the node-local DNS cache.
+	NodeLocalDNS string `json:"node_local_dns"`
+	// LinkLocal excludes 169.254.0.0/16.
+	LinkLocal bool `json:"link_local"`
+	// NodeIP excludes the addresses of the node named by kubernetes.node_name.
+	NodeIP bool `json:"node_ip"`
+}
+
+// TPROXY holds the settings of the TPROXY redirect mode, which must not
+// collide with the firewall marks and routing tables of the node's CNI.
+type TPROXY struct {
+	// Mark is the firewall mark of the captured packets, e.g. "0x400".
+	// Defaults to 1337.
+	Mark string `json:"mark"`
+	// Mask limits Mark to some bits, e.g. "0xf00". Defaults to all bits.
+	Mask string `json:"mask"`
+	// RouteTable routes the marked packets to the proxy. Defaults to 133.
+	RouteTable string `json:"route_table"`
+	// Outbound keeps the original source address of the connections the proxy
+	// makes to the app.
+	Outbound bool `json:"outbound"`
+	// ReservedMarks are the mark bits used by other components of the node,
+	// e.g. "0xffff0000" for Calico, which Mask must leave alone.
+	ReservedMarks []string `json:"reserved_marks"`
+}
+
+// ProxyPorts holds the ports of the proxy, which the app must not use.
+type ProxyPorts struct {
+	// Excluded are the proxy ports always excluded from inbound capture.
+	// Defaults to the mesh status port, 15021 and 15090.
+	Excluded string `json:"excluded_inbound"`
+	// Reserved are the ports the proxy listens on besides Excluded and the
+	// redirect target port. Defaults to 15000,15001,15006,15020,15021,15090,
+	// with the admin, listen and status ports of the mesh config.
+	Reserved string `json:"reserved"`
+	// Conflicts is "warn", the default, to log the app ports which are
+	// reserved, or "fail" to fail the ADD.
+	Conflicts string `json:"conflicts"`
+}
+
+// Validate checks the settings which do not depend on the pod.
+func (c *Config) Validate() error {
+	if _, err := redirect.Annotations(c.RedirectDefaults); err != nil {
+		return fmt.Errorf("redirect_defaults: %v", err)
+	}
+	if c.AutoExclude.NodeLocalDNS != "" {
+		if _, err := HostCIDR(c.AutoExclude.NodeLocalDNS); err != nil {
+			return fmt.Errorf("auto_exclude node_local_dns: %v", err)
+		}
+	}
+	if err := c.TPROXY.apply(nil).ValidateTPROXY(c.TPROXY.ReservedMarks); err != nil {
+		return fmt.Errorf("invalid tproxy: %v", err)
+	}
+	if err := c.ProxyPorts.validate(); err != nil {
+		return fmt.Errorf("invalid proxy_ports: %v", err)
+	}
+	return nil
+}
+
+// CompilePolicy compiles the capture policy, which excludes the
+// exclude_namespaces of the kubernetes settings.
+func (c *Config) CompilePolicy() (*policy.Policy, error) {
+	return policy.Compile(c.Policy, c.Kubernetes.ExcludeNamespaces)
+}
+
+// Defaults returns the redirect defaults of mesh, or of redirect.Defaults()
+// if nil, with the TPROXY settings and the proxy ports excluded from inbound
+// capture.
+func (c *Config) Defaults(mesh *redirect.MeshConfig) *redirect.Redirect {
+	rdrct := c.TPROXY.apply(mesh.Defaults())
+	if c.ProxyPorts.Excluded != "" {
+		rdrct.ProxyInboundPorts = c.ProxyPorts.Excluded
+	}
+	return rdrct
+}
+
+// ReadMeshConfigFile returns the mesh config of mesh_config_file, or nil if it
+// is not set.
+func (c *Config) ReadMeshConfigFile() (*redirect.MeshConfig, error) {
+	if c.MeshConfigFile == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(c.MeshConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	return redirect.ParseMeshConfig(string(data))
+}
+
+// ReservedPorts returns the ports reserved by the proxy: the configured ones,
+// or those of mesh.
+func (c *Config) ReservedPorts(mesh *redirect.MeshConfig) string {
+	if c.ProxyPorts.Reserved != "" {
+		return c.ProxyPorts.Reserved
+	}
+	return mesh.ReservedPorts()
+}
+
+// Layers returns the annotation layers of a pod's Redirect, from lowest to
+// highest precedence: the redirect_defaults, the annotations of ns if
+// namespace_defaults is set and ns is known, and annotations with the
+// overrides of the capture policy.
+func (c *Config) Layers(ns *policy.Namespace, annotations, overrides map[string]string) ([]redirect.Layer, error) {
+	configDefaults, err := redirect.Annotations(c.RedirectDefaults)
+	if err != nil {
+		return nil, fmt.Errorf("redirect_defaults: %v", err)
+	}
+	layers := []redirect.Layer{{Source: redirect.SourceConfig, Annotations: configDefaults}}
+	if c.Kubernetes.NamespaceDefaults && ns != nil {
+		layers = append(layers, redirect.Layer{Source: redirect.SourceNamespace, Annotations: ns.Annotations})
+	}
+	if len(overrides) > 0 {
+		merged := make(map[string]string, len(annotations)+len(overrides))
+		for k, v := range annotations {
+			merged[k] = v
+		}
+		for k, v := range overrides {
+			merged[k] = v
+		}
+		annotations = merged
+	}
+	return append(layers, redirect.Layer{Source: redirect.SourceAnnotation, Annotations: annotations}), nil
+}
+
+// CIDRs returns the CIDRs of the link-local and node-local DNS destinations,
+// and of the looked up addresses ips of the Kubernetes Service and node.
+func (a *AutoExclude) CIDRs(ips ...string) ([]string, error) {
+	var cidrs []string
+	if a.LinkLocal {
+		cidrs = append(cidrs, linkLocalCIDR)
+	}
+	if a.NodeLocalDNS != "" {
+		cidr, err := HostCIDR(a.NodeLocalDNS)
+		if err != nil {
+			return nil, fmt.Errorf("auto_exclude node_local_dns: %v", err)
+		}
+		cidrs = append(cidrs, cidr)
+	}
+	for _, ip := range ips {
+		cidr, err := HostCIDR(ip)
+		if err != nil {
+			return nil, err
+		}
+		cidrs = append(cidrs, cidr)
+	}
+	return cidrs, nil
+}
+
+// HostCIDR returns the single address CIDR of ip.
+func HostCIDR(ip string) (string, error) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return "", fmt.Errorf("invalid IP %q", ip)
+	}
+	if parsed.To4() != nil {
+		return parsed.String() + "/32", nil
+	}
+	return parsed.String() + "/128", nil
+}
+
+// apply returns a copy of defaults, or of redirect.Defaults() if nil, with the
+// TPROXY settings.
+func (t *TPROXY) apply(defaults *redirect.Redirect) *redirect.Redirect {
+	if defaults == nil {
+		defaults = redirect.Defaults()
+	}
+	rdrct := *defaults
+	rdrct.TproxyMark = t.Mark
+	rdrct.TproxyMask = t.Mask
+	rdrct.TproxyRouteTable = t.RouteTable
+	rdrct.OutboundTproxy = t.Outbound
+	return &rdrct
+}
+
+// validate checks the port lists and the conflict policy.
+func (p *ProxyPorts) validate() error {
+	if err := redirect.ValidatePortList(p.Excluded); err != nil {
+		return fmt.Errorf("excluded_inbound: %v", err)
+	}
+	if err := redirect.ValidatePortList(p.Reserved); err != nil {
+		return fmt.Errorf("reserved: %v", err)
+	}
+	switch p.Conflicts {
+	case "", PortConflictsWarn, PortConflictsFail:
+		return nil
+	}
+	return fmt.Errorf("conflicts %q: must be %s or %s", p.Conflicts, PortConflictsWarn, PortConflictsFail)
+}
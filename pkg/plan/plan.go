@@ -0,0 +1,104 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package plan resolves the Redirect programmed into a captured pod from the
+// istio-cni plugin config, for both the plugin and istio-cni-explain.
+package plan
+
+import (
+	"istio.io/cni/pkg/policy"
+	"istio.io/cni/pkg/redirect"
+)
+
+const (
+	// AddedAutoExclude marks the parameters extended by auto_exclude.
+	AddedAutoExclude = "auto_exclude"
+	// AddedProbePorts marks the parameters changed by the probe ports.
+	AddedProbePorts = "probe ports"
+)
+
+// Input holds what a pod's Plan depends on besides the plugin config.
+type Input struct {
+	// Mesh is the mesh config giving the redirect defaults, nil for the
+	// built-in ones.
+	Mesh *redirect.MeshConfig
+	// Layers are the annotation layers, see Config.Layers.
+	Layers []redirect.Layer
+	// AutoExcluded are the CIDRs added to excludeIPCidrs.
+	AutoExcluded []string
+	// Primary is the interface capture applies to, and Interfaces are all the
+	// interfaces of the pod, if known.
+	Primary    string
+	Interfaces []string
+	// Pod is the captured pod, nil for runtimeConfig containers.
+	Pod *policy.Pod
+}
+
+// Plan is the Redirect of a pod with what shaped it.
+type Plan struct {
+	Redirect *redirect.Redirect
+	// Sources are the sources of the parameters set by a layer, keyed by
+	// registry name.
+	Sources map[string]redirect.Source
+	// Added lists, by registry name, what changed a parameter after the
+	// layers were resolved: AddedAutoExclude or AddedProbePorts.
+	Added map[string][]string
+	// ProbePorts are the probe ports excluded from inbound capture as the pod
+	// disables probe rewriting, and ProbePortsAdded those not excluded yet.
+	ProbePorts      []string
+	ProbePortsAdded []string
+	// UnknownKubevirtInterfaces are the kubevirtInterfaces missing from the
+	// pod's interfaces.
+	UnknownKubevirtInterfaces []string
+	// Reserved are the ports reserved by the proxy, and Conflicts the ports
+	// of the pod using them.
+	Reserved  string
+	Conflicts []redirect.PortConflict
+}
+
+// Resolve resolves the input layers over the defaults of the config and the
+// mesh config, adds the auto excluded CIDRs, scopes the capture to the primary
+// interface, excludes the probe ports if the pod disables probe rewriting, and
+// finds the ports of the pod reserved by the proxy. It returns an error if the
+// layers or interfaces are invalid, and the pod must not be captured.
+func (c *Config) Resolve(in Input) (*Plan, error) {
+	rdrct, sources, err := redirect.ResolveLayers(c.Defaults(in.Mesh), in.Layers...)
+	if err != nil {
+		return nil, err
+	}
+	p := &Plan{Redirect: rdrct, Sources: sources, Added: map[string][]string{}}
+	if len(in.AutoExcluded) > 0 {
+		rdrct.AddExcludeIPCidrs(in.AutoExcluded...)
+		p.Added["excludeIPCidrs"] = append(p.Added["excludeIPCidrs"], AddedAutoExclude)
+	}
+	if p.UnknownKubevirtInterfaces, err = rdrct.ScopeInterfaces(in.Primary, in.Interfaces); err != nil {
+		return nil, err
+	}
+	var containerPorts map[string][]string
+	if in.Pod != nil {
+		containerPorts = in.Pod.Ports
+		if policy.ProbeRewriteDisabled(in.Pod.Annotations) && len(in.Pod.ProbePorts) > 0 {
+			includePorts := rdrct.IncludePorts
+			p.ProbePorts = in.Pod.ProbePorts
+			p.ProbePortsAdded = rdrct.AddExcludeInboundPorts(in.Pod.ProbePorts...)
+			p.Added["excludeInboundPorts"] = append(p.Added["excludeInboundPorts"], AddedProbePorts)
+			if rdrct.IncludePorts != includePorts {
+				p.Added["includePorts"] = append(p.Added["includePorts"], AddedProbePorts)
+			}
+		}
+	}
+	p.Reserved = c.ReservedPorts(in.Mesh)
+	p.Conflicts = rdrct.PortConflicts(p.Reserved, containerPorts)
+	return p, nil
+}
@@ -0,0 +1,123 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plan
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"istio.io/api/annotation"
+	"istio.io/cni/pkg/policy"
+	"istio.io/cni/pkg/redirect"
+)
+
+func TestResolve(t *testing.T) {
+	c := &Config{
+		Kubernetes:       Kubernetes{NamespaceDefaults: true},
+		RedirectDefaults: map[string]string{"excludeOutboundPorts": "5432"},
+		AutoExclude:      AutoExclude{LinkLocal: true, NodeLocalDNS: "169.254.20.10"},
+		TPROXY:           TPROXY{Mark: "0x400"},
+	}
+	pod := &policy.Pod{
+		Annotations: map[string]string{
+			annotation.SidecarTrafficIncludeInboundPorts.Name: "8080,8081",
+			annotation.SidecarRewriteAppHTTPProbers.Name:      "false",
+		},
+		Ports:      map[string][]string{"app": {"8080", "15120"}},
+		ProbePorts: []string{"8081"},
+	}
+	ns := &policy.Namespace{Annotations: map[string]string{
+		annotation.SidecarTrafficExcludeOutboundPorts.Name: "3306",
+	}}
+	overrides := map[string]string{annotation.SidecarTrafficExcludeOutboundIPRanges.Name: "10.0.0.1/32"}
+	layers, err := c.Layers(ns, pod.Annotations, overrides)
+	if err != nil {
+		t.Fatal(err)
+	}
+	autoExcluded, err := c.AutoExclude.CIDRs("10.96.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mesh := &redirect.MeshConfig{DefaultConfig: redirect.ProxyConfig{StatusPort: 15120}}
+	p, err := c.Resolve(Input{
+		Mesh:         mesh,
+		Layers:       layers,
+		AutoExcluded: autoExcluded,
+		Primary:      "eth0",
+		Interfaces:   []string{"eth0", "net1"},
+		Pod:          pod,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := p.Redirect
+	if r.ExcludeOutboundPorts != "3306" || p.Sources["excludeOutboundPorts"] != redirect.SourceNamespace {
+		t.Errorf("expected the namespace over redirect_defaults, got %q from %q",
+			r.ExcludeOutboundPorts, p.Sources["excludeOutboundPorts"])
+	}
+	if want := "10.0.0.1/32,169.254.0.0/16,169.254.20.10/32,10.96.0.1/32"; r.ExcludeIPCidrs != want {
+		t.Errorf("expected excludeIPCidrs %q, got %q", want, r.ExcludeIPCidrs)
+	}
+	if r.IncludePorts != "8080" || r.ExcludeInboundPorts != "15120,15021,15090,8081" {
+		t.Errorf("expected the probe port excluded, got includePorts=%q excludeInboundPorts=%q",
+			r.IncludePorts, r.ExcludeInboundPorts)
+	}
+	if r.ExcludeInterfaces != "net1" || r.TproxyMark != "0x400" {
+		t.Errorf("expected net1 excluded and the tproxy mark, got %+v", r)
+	}
+	wantAdded := map[string][]string{
+		"excludeIPCidrs":      {AddedAutoExclude},
+		"excludeInboundPorts": {AddedProbePorts},
+		"includePorts":        {AddedProbePorts},
+	}
+	if !reflect.DeepEqual(p.Added, wantAdded) {
+		t.Errorf("expected added %v, got %v", wantAdded, p.Added)
+	}
+	if p.Reserved != mesh.ReservedPorts() || len(p.Conflicts) != 1 || p.Conflicts[0].Port != "15120" {
+		t.Errorf("expected the mesh status port to conflict, got reserved %q conflicts %v", p.Reserved, p.Conflicts)
+	}
+}
+
+func TestResolveInvalid(t *testing.T) {
+	c := &Config{}
+	layers, err := c.Layers(nil, map[string]string{annotation.SidecarInterceptionMode.Name: "BOGUS"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Resolve(Input{Layers: layers}); err == nil {
+		t.Fatal("expected the invalid annotation to fail")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, tc := range []struct {
+		conf Config
+		want string
+	}{
+		{Config{RedirectDefaults: map[string]string{"bogus": "1"}}, "redirect_defaults"},
+		{Config{AutoExclude: AutoExclude{NodeLocalDNS: "dns"}}, "auto_exclude node_local_dns"},
+		{Config{TPROXY: TPROXY{Mark: "0x400", Mask: "0xf00", ReservedMarks: []string{"0x100"}}}, "invalid tproxy"},
+		{Config{ProxyPorts: ProxyPorts{Conflicts: "ignore"}}, "invalid proxy_ports"},
+	} {
+		if err := tc.conf.Validate(); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("expected %q error, got %v", tc.want, err)
+		}
+	}
+	if err := (&Config{}).Validate(); err != nil {
+		t.Errorf("expected the empty config to be valid, got %v", err)
+	}
+}
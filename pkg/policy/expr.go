@@ -0,0 +1,488 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package policy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// This file implements the match expressions of policy rules. An expression
+// tests the name, labels and annotations of the pod and its namespace:
+//
+//   pod.name == "reviews-v1"
+//   namespace.name in ["jobs", "etl"]
+//   pod.labels["app"] != "legacy"      (or pod.labels.app)
+//   "batch" in pod.annotations         (key presence)
+//
+// Tests are combined with !, && and ||, in decreasing precedence, and
+// parentheses; true and false are literals. Strings are double or single
+// quoted, with \\, \", \', \n, \t and \r escapes. A missing label or
+// annotation key has no value: it is neither equal to nor in any list, so !=
+// is true for it.
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+var operators = []string{"==", "!=", "&&", "||", "!", "(", ")", "[", "]", ".", ","}
+
+func tokenize(expr string) ([]token, error) {
+	var toks []token
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"' || c == '\'':
+			s, n, err := unquote(expr[i:])
+			if err != nil {
+				return nil, fmt.Errorf("at %d: %v", i, err)
+			}
+			toks = append(toks, token{tokString, s, i})
+			i += n
+		case isIdentChar(c) && !(c >= '0' && c <= '9'):
+			j := i
+			for j < len(expr) && isIdentChar(expr[j]) {
+				j++
+			}
+			toks = append(toks, token{tokIdent, expr[i:j], i})
+			i = j
+		default:
+			matched := false
+			for _, op := range operators {
+				if strings.HasPrefix(expr[i:], op) {
+					toks = append(toks, token{tokOp, op, i})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("at %d: unexpected character %q", i, c)
+			}
+		}
+	}
+	return append(toks, token{tokEOF, "", len(expr)}), nil
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// unquote decodes the quoted string at the start of s, returning it and the
+// number of bytes it spans.
+func unquote(s string) (string, int, error) {
+	quote := s[0]
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; c {
+		case quote:
+			return b.String(), i + 1, nil
+		case '\\':
+			i++
+			if i == len(s) {
+				break
+			}
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case '\\', '"', '\'':
+				b.WriteByte(s[i])
+			default:
+				return "", 0, fmt.Errorf("invalid escape \\%c", s[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string")
+}
+
+// fields are the fields of the pod and namespace variables. Map fields hold
+// labels or annotations, which are selected by key.
+var fields = map[string]map[string]bool{
+	"pod":       {"name": false, "namespace": false, "labels": true, "annotations": true},
+	"namespace": {"name": false, "labels": true, "annotations": true},
+}
+
+// field is a string field, or a key of a map field.
+type field struct {
+	variable string
+	name     string
+	key      string
+	isMap    bool
+}
+
+func (f field) String() string {
+	if f.isMap {
+		return fmt.Sprintf("%s.%s[%q]", f.variable, f.name, f.key)
+	}
+	return f.variable + "." + f.name
+}
+
+// namespaceMetadata reports whether f reads namespace fields other than its
+// name, which are only known once the namespace is looked up.
+func (f field) namespaceMetadata() bool {
+	return f.variable == "namespace" && f.name != "name"
+}
+
+func (f field) lookup(pod *Pod, ns *Namespace) (string, bool, error) {
+	if f.variable == "namespace" {
+		if ns == nil {
+			if f.namespaceMetadata() {
+				return "", false, fmt.Errorf("%s: namespace metadata is not available", f)
+			}
+			return pod.Namespace, true, nil
+		}
+		switch f.name {
+		case "labels":
+			v, ok := ns.Labels[f.key]
+			return v, ok, nil
+		case "annotations":
+			v, ok := ns.Annotations[f.key]
+			return v, ok, nil
+		}
+		return ns.Name, true, nil
+	}
+	switch f.name {
+	case "labels":
+		v, ok := pod.Labels[f.key]
+		return v, ok, nil
+	case "annotations":
+		v, ok := pod.Annotations[f.key]
+		return v, ok, nil
+	case "namespace":
+		return pod.Namespace, true, nil
+	}
+	return pod.Name, true, nil
+}
+
+type node interface {
+	eval(pod *Pod, ns *Namespace) (bool, error)
+}
+
+type (
+	literal  bool
+	notNode  struct{ operand node }
+	boolNode struct {
+		and         bool
+		left, right node
+	}
+	// compareNode is field == value, field != value or field in [values].
+	compareNode struct {
+		field  field
+		negate bool
+		values []string
+	}
+)
+
+func (n literal) eval(*Pod, *Namespace) (bool, error) {
+	return bool(n), nil
+}
+
+func (n *notNode) eval(pod *Pod, ns *Namespace) (bool, error) {
+	v, err := n.operand.eval(pod, ns)
+	return !v, err
+}
+
+func (n *boolNode) eval(pod *Pod, ns *Namespace) (bool, error) {
+	left, err := n.left.eval(pod, ns)
+	if err != nil || left != n.and {
+		return left, err
+	}
+	return n.right.eval(pod, ns)
+}
+
+func (n *compareNode) eval(pod *Pod, ns *Namespace) (bool, error) {
+	v, ok, err := n.field.lookup(pod, ns)
+	if err != nil {
+		return false, err
+	}
+	in := false
+	if ok {
+		for _, want := range n.values {
+			if v == want {
+				in = true
+				break
+			}
+		}
+	}
+	return in != n.negate, nil
+}
+
+// presenceNode is "key" in map.
+type presenceNode struct {
+	field field
+}
+
+func (n *presenceNode) eval(pod *Pod, ns *Namespace) (bool, error) {
+	_, ok, err := n.field.lookup(pod, ns)
+	return ok, err
+}
+
+// Expr is a compiled match expression.
+type Expr struct {
+	text              string
+	root              node
+	namespaceMetadata bool
+}
+
+// String returns the source of the expression.
+func (e *Expr) String() string {
+	return e.text
+}
+
+// CompileExpr parses expr. Fields of pod and namespace other than the above
+// are rejected.
+func CompileExpr(expr string) (*Expr, error) {
+	toks, err := tokenize(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, fmt.Errorf("at %d: unexpected %q", t.pos, t.text)
+	}
+	return &Expr{text: expr, root: root, namespaceMetadata: p.namespaceMetadata}, nil
+}
+
+// Eval evaluates the expression for pod. ns may be nil if the expression
+// does not need namespace metadata, the namespace name is then the pod's.
+func (e *Expr) Eval(pod *Pod, ns *Namespace) (bool, error) {
+	return e.root.eval(pod, ns)
+}
+
+// NeedsNamespaceMetadata reports whether the expression reads namespace
+// labels or annotations.
+func (e *Expr) NeedsNamespaceMetadata() bool {
+	return e.namespaceMetadata
+}
+
+type parser struct {
+	toks              []token
+	pos               int
+	namespaceMetadata bool
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) accept(op string) bool {
+	if t := p.peek(); t.kind == tokOp && t.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(op string) error {
+	if !p.accept(op) {
+		return unexpected(p.peek(), fmt.Sprintf("%q", op))
+	}
+	return nil
+}
+
+func unexpected(t token, want string) error {
+	if t.kind == tokEOF {
+		return fmt.Errorf("unexpected end of expression, expected %s", want)
+	}
+	return fmt.Errorf("at %d: expected %s, got %q", t.pos, want, t.text)
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &boolNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &boolNode{and: true, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if p.accept("!") {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{operand: operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	if p.accept("(") {
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return n, p.expect(")")
+	}
+	t := p.next()
+	switch {
+	case t.kind == tokIdent && (t.text == "true" || t.text == "false"):
+		return literal(t.text == "true"), nil
+	case t.kind == tokString:
+		// "key" in map
+		if t := p.next(); t.kind != tokIdent || t.text != "in" {
+			return nil, unexpected(t, "in after a string")
+		}
+		f, err := p.parseField(true)
+		if err != nil {
+			return nil, err
+		}
+		if !f.isMap {
+			return nil, fmt.Errorf("%s is not a map of labels or annotations", f)
+		}
+		f.key = t.text
+		return &presenceNode{field: f}, nil
+	case t.kind == tokIdent:
+		p.pos--
+		f, err := p.parseField(false)
+		if err != nil {
+			return nil, err
+		}
+		return p.parseComparison(f)
+	}
+	return nil, unexpected(t, "a test")
+}
+
+// parseField parses a field of the pod or namespace variables. Unless whole
+// is set, map fields must select a key.
+func (p *parser) parseField(whole bool) (field, error) {
+	t := p.next()
+	if t.kind != tokIdent {
+		return field{}, unexpected(t, "pod or namespace")
+	}
+	vars, ok := fields[t.text]
+	if !ok {
+		return field{}, fmt.Errorf("at %d: undeclared reference to %q", t.pos, t.text)
+	}
+	f := field{variable: t.text}
+	if err := p.expect("."); err != nil {
+		return field{}, err
+	}
+	name := p.next()
+	if name.kind != tokIdent {
+		return field{}, unexpected(name, "a field of "+f.variable)
+	}
+	if f.isMap, ok = vars[name.text]; !ok {
+		return field{}, fmt.Errorf("at %d: %s has no field %q", name.pos, f.variable, name.text)
+	}
+	f.name = name.text
+	if f.namespaceMetadata() {
+		p.namespaceMetadata = true
+	}
+	if !f.isMap || whole {
+		return f, nil
+	}
+	switch {
+	case p.accept("["):
+		key := p.next()
+		if key.kind != tokString {
+			return field{}, unexpected(key, "a quoted key")
+		}
+		f.key = key.text
+		return f, p.expect("]")
+	case p.accept("."):
+		key := p.next()
+		if key.kind != tokIdent {
+			return field{}, unexpected(key, "a key")
+		}
+		f.key = key.text
+		return f, nil
+	}
+	return field{}, fmt.Errorf("%s.%s is a map, select a key with %[1]s.%[2]s[\"key\"]", f.variable, f.name)
+}
+
+func (p *parser) parseComparison(f field) (node, error) {
+	t := p.next()
+	switch {
+	case t.kind == tokOp && (t.text == "==" || t.text == "!="):
+		v := p.next()
+		if v.kind != tokString {
+			return nil, unexpected(v, "a string")
+		}
+		return &compareNode{field: f, negate: t.text == "!=", values: []string{v.text}}, nil
+	case t.kind == tokIdent && t.text == "in":
+		if err := p.expect("["); err != nil {
+			return nil, err
+		}
+		var values []string
+		for !p.accept("]") {
+			if len(values) > 0 {
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+			}
+			v := p.next()
+			if v.kind != tokString {
+				return nil, unexpected(v, "a string")
+			}
+			values = append(values, v.text)
+		}
+		return &compareNode{field: f, values: values}, nil
+	}
+	return nil, unexpected(t, fmt.Sprintf("==, != or in after %s", f))
+}
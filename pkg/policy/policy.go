@@ -0,0 +1,207 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package policy decides whether istio-cni captures the traffic of a pod.
+package policy
+
+import (
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	"istio.io/api/annotation"
+)
+
+// IstioInitContainer is the init container which programs capture for pods
+// injected without istio-cni.
+const IstioInitContainer = "istio-init"
+
+// ProxyContainerName is the sidecar container injected into the pod.
+const ProxyContainerName = "istio-proxy"
+
+// Reason is why a pod is excluded from capture. Reasons are also used as the
+// reason label of the pods_excluded metric.
+type Reason string
+
+const (
+	ReasonNamespace       Reason = "namespace"
+	ReasonIstioInit       Reason = "istio_init"
+	ReasonInjectDisabled  Reason = "inject_disabled"
+	ReasonNoSidecarStatus Reason = "no_sidecar_status"
+	ReasonSingleContainer Reason = "single_container"
+	// ReasonPolicy is the reason of pods excluded by a rule of the plugin's policy.
+	ReasonPolicy Reason = "policy"
+)
+
+var reasonDescriptions = map[Reason]string{
+	ReasonNamespace:       "the namespace is in the plugin's exclude_namespaces",
+	ReasonIstioInit:       "the pod has an " + IstioInitContainer + " init container which programs capture itself",
+	ReasonInjectDisabled:  "the " + annotation.SidecarInject.Name + " annotation is false",
+	ReasonNoSidecarStatus: "the pod has no " + annotation.SidecarStatus.Name + " annotation, so no sidecar was injected",
+	ReasonSingleContainer: "the pod has a single container, so no sidecar was injected",
+	ReasonPolicy:          "a rule of the plugin's policy excludes the pod",
+}
+
+// Description returns a human readable explanation of the reason.
+func (r Reason) Description() string {
+	if d, ok := reasonDescriptions[r]; ok {
+		return d
+	}
+	return string(r)
+}
+
+// Pod holds the parts of a pod the capture decision depends on.
+type Pod struct {
+	Name           string
+	Namespace      string
+	Containers     []string
+	InitContainers map[string]struct{}
+	Labels         map[string]string
+	Annotations    map[string]string
+	// Ports are the container ports of the app containers, by container. The
+	// istio-proxy container is left out.
+	Ports map[string][]string
+	// ProbePorts are the ports of the HTTP and TCP probes of the app
+	// containers.
+	ProbePorts []string
+}
+
+// Namespace holds the metadata of the pod's namespace.
+type Namespace struct {
+	Name        string
+	Labels      map[string]string
+	Annotations map[string]string
+}
+
+// NewPod returns the Pod for a Kubernetes pod.
+func NewPod(pod *corev1.Pod) *Pod {
+	p := &Pod{
+		Name:           pod.Name,
+		Namespace:      pod.Namespace,
+		InitContainers: map[string]struct{}{},
+		Labels:         pod.Labels,
+		Annotations:    pod.Annotations,
+	}
+	for _, c := range pod.Spec.InitContainers {
+		p.InitContainers[c.Name] = struct{}{}
+	}
+	p.Ports = ContainerPorts(pod.Spec.Containers)
+	p.ProbePorts = ProbePorts(pod.Spec.Containers)
+	for _, c := range pod.Spec.Containers {
+		p.Containers = append(p.Containers, c.Name)
+	}
+	return p
+}
+
+// ContainerPorts returns the container ports of the app containers, by
+// container, leaving out the istio-proxy container.
+func ContainerPorts(containers []corev1.Container) map[string][]string {
+	ports := map[string][]string{}
+	for _, c := range containers {
+		if c.Name == ProxyContainerName {
+			continue
+		}
+		for _, port := range c.Ports {
+			ports[c.Name] = append(ports[c.Name], strconv.Itoa(int(port.ContainerPort)))
+		}
+	}
+	return ports
+}
+
+// ProbePorts returns the ports of the HTTP and TCP liveness, readiness and
+// startup probes of the app containers, leaving out the istio-proxy container.
+// Named ports are looked up in the ports of the probe's container, and skipped
+// if it has none of that name, as the kubelet fails such probes anyway.
+func ProbePorts(containers []corev1.Container) []string {
+	var ports []string
+	seen := map[string]bool{}
+	for _, c := range containers {
+		if c.Name == ProxyContainerName {
+			continue
+		}
+		for _, probe := range []*corev1.Probe{c.LivenessProbe, c.ReadinessProbe, c.StartupProbe} {
+			if probe == nil {
+				continue
+			}
+			var port intstr.IntOrString
+			switch {
+			case probe.HTTPGet != nil:
+				port = probe.HTTPGet.Port
+			case probe.TCPSocket != nil:
+				port = probe.TCPSocket.Port
+			default:
+				continue
+			}
+			if p := containerPort(c, port); p != "" && !seen[p] {
+				seen[p] = true
+				ports = append(ports, p)
+			}
+		}
+	}
+	return ports
+}
+
+// containerPort returns the number of port, looking up named ports in the
+// ports of c, or "" if c has no port of that name.
+func containerPort(c corev1.Container, port intstr.IntOrString) string {
+	if port.Type == intstr.Int {
+		return strconv.Itoa(port.IntValue())
+	}
+	for _, p := range c.Ports {
+		if p.Name == port.StrVal {
+			return strconv.Itoa(int(p.ContainerPort))
+		}
+	}
+	return ""
+}
+
+// ProbeRewriteDisabled returns true if the annotations of the pod disable the
+// rewriting of its HTTP probes to the proxy, so that the kubelet probes the
+// app through the proxy.
+func ProbeRewriteDisabled(annotations map[string]string) bool {
+	rewrite, err := strconv.ParseBool(annotations[annotation.SidecarRewriteAppHTTPProbers.Name])
+	return err == nil && !rewrite
+}
+
+// NewNamespace returns the Namespace for a Kubernetes namespace.
+func NewNamespace(ns *corev1.Namespace) *Namespace {
+	return &Namespace{Name: ns.Name, Labels: ns.Labels, Annotations: ns.Annotations}
+}
+
+// NamespaceExcluded returns true if namespace is one of excludeNamespaces.
+func NamespaceExcluded(namespace string, excludeNamespaces []string) bool {
+	for _, ns := range excludeNamespaces {
+		if namespace == ns {
+			return true
+		}
+	}
+	return false
+}
+
+// InjectDisabled returns true if the inject annotation is set to false.
+func InjectDisabled(annotations map[string]string) bool {
+	if val, ok := annotations[annotation.SidecarInject.Name]; ok {
+		if injectEnabled, err := strconv.ParseBool(val); err == nil && !injectEnabled {
+			return true
+		}
+	}
+	return false
+}
+
+// HasSidecarStatus returns true if the sidecar injector annotated the pod.
+func HasSidecarStatus(annotations map[string]string) bool {
+	_, ok := annotations[annotation.SidecarStatus.Name]
+	return ok
+}
@@ -0,0 +1,268 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package policy
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func TestDefaultPolicy(t *testing.T) {
+	status := map[string]string{"sidecar.istio.io/status": "{}"}
+	tests := []struct {
+		name string
+		pod  Pod
+		want Reason
+	}{
+		{
+			name: "captured",
+			pod:  Pod{Namespace: "default", Containers: []string{"app", "istio-proxy"}, Annotations: status},
+		},
+		{
+			name: "single container",
+			pod:  Pod{Namespace: "default", Containers: []string{"app"}, Annotations: status},
+			want: ReasonSingleContainer,
+		},
+		{
+			name: "inject disabled",
+			pod: Pod{Namespace: "default", Containers: []string{"app", "istio-proxy"},
+				Annotations: map[string]string{"sidecar.istio.io/status": "{}", "sidecar.istio.io/inject": "False"}},
+			want: ReasonInjectDisabled,
+		},
+		{
+			name: "no sidecar status",
+			pod:  Pod{Namespace: "default", Containers: []string{"app", "istio-proxy"}},
+			want: ReasonNoSidecarStatus,
+		},
+		{
+			name: "istio-init and excluded namespace",
+			pod: Pod{
+				Namespace:      "kube-system",
+				Containers:     []string{"app", "istio-proxy"},
+				InitContainers: map[string]struct{}{IstioInitContainer: {}},
+			},
+			want: ReasonNamespace,
+		},
+	}
+	p, err := Compile(nil, []string{"kube-system"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := p.Evaluate(&tt.pod, nil)
+			if err != nil {
+				t.Fatalf("unexpected evaluation error %v", err)
+			}
+			if d.Capture != (tt.want == "") || d.Reason != tt.want {
+				t.Errorf("Evaluate() = %+v, want reason %q", d, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolicyRules(t *testing.T) {
+	p, err := Compile([]Rule{
+		{
+			Name:   "no-batch",
+			Match:  `"batch" in pod.labels && namespace.labels["team"] in ["data", "ml"]`,
+			Action: ActionExclude,
+		},
+		{
+			Name:     "legacy-ports",
+			Match:    `pod.labels.app in ["legacy-billing", "legacy-ledger"]`,
+			Action:   ActionInclude,
+			Redirect: map[string]string{"includePorts": "8080"},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.NeedsNamespaceMetadata() {
+		t.Fatalf("expected namespace.labels to need namespace metadata")
+	}
+
+	ns := &Namespace{Name: "jobs", Labels: map[string]string{"team": "data"}}
+	pod := &Pod{Namespace: "jobs", Containers: []string{"app", "istio-proxy"},
+		Labels: map[string]string{"batch": "true", "app": "legacy-billing"}}
+	if d, _ := p.Evaluate(pod, ns); d.Capture || d.Rule != "no-batch" || d.Reason != ReasonPolicy {
+		t.Fatalf("expected no-batch to exclude the pod, got %+v", d)
+	}
+
+	delete(pod.Labels, "batch")
+	d, _ := p.Evaluate(pod, ns)
+	if !d.Capture || d.Rule != "legacy-ports" ||
+		!reflect.DeepEqual(d.Redirect, map[string]string{"traffic.sidecar.istio.io/includeInboundPorts": "8080"}) {
+		t.Fatalf("expected legacy-ports to include the pod with overrides, got %+v", d)
+	}
+}
+
+func TestExcludeNamespacesBeforeRules(t *testing.T) {
+	p, err := Compile([]Rule{{Name: "all", Match: "true", Action: ActionInclude}}, []string{"kube-system"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod := &Pod{Namespace: "kube-system", Containers: []string{"app", "istio-proxy"},
+		Annotations: map[string]string{"sidecar.istio.io/status": "{}"}}
+	if d, err := p.Evaluate(pod, nil); err != nil || d.Capture || d.Reason != ReasonNamespace {
+		t.Fatalf("expected exclude_namespaces to exclude the pod ahead of the rules, got %+v, %v", d, err)
+	}
+	if _, ok := p.ExcludedNamespace("default"); ok {
+		t.Fatalf("expected the default namespace not to be excluded")
+	}
+}
+
+func TestPolicyEvaluationErrorFailsClosed(t *testing.T) {
+	p, err := Compile([]Rule{
+		{Name: "by-team", Match: `namespace.labels.team == "data"`, Action: ActionExclude},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without the namespace, the rule can't tell whether the pod is excluded,
+	// and the later rules must not decide instead.
+	pod := &Pod{Namespace: "jobs", Containers: []string{"app", "istio-proxy"},
+		Annotations: map[string]string{"sidecar.istio.io/status": "{}"}}
+	d, err := p.Evaluate(pod, nil)
+	if err == nil || !strings.Contains(err.Error(), "policy rule by-team: namespace.labels[\"team\"]: namespace metadata is not available") {
+		t.Fatalf("expected a namespace metadata error, got %v", err)
+	}
+	if d.Capture || d.Rule != "" {
+		t.Fatalf("expected no decision, got %+v", d)
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, tt := range []struct {
+		rule Rule
+		want string
+	}{
+		{Rule{Name: "a", Match: `pod.name ==`, Action: ActionExclude}, "unexpected end of expression"},
+		{Rule{Name: "b", Match: `node.name == "x"`, Action: ActionExclude}, `undeclared reference to "node"`},
+		{Rule{Name: "c", Match: `true`, Action: "drop"}, "action must be"},
+		{Rule{Name: "d", Match: `true`, Action: ActionInclude, Redirect: map[string]string{"includePorts": "http"}}, "invalid redirect includePorts"},
+		{Rule{Name: "e", Match: `size(pod.containers) == "1"`, Action: ActionExclude}, `undeclared reference to "size"`},
+		{Rule{Name: "f", Match: `"istio-init" in pod.initContainers`, Action: ActionExclude}, `pod has no field "initContainers"`},
+		{Rule{Name: "g", Match: `namespace.uid == "x"`, Action: ActionExclude}, `namespace has no field "uid"`},
+		{Rule{Name: "h", Match: `pod.labels == "x"`, Action: ActionExclude}, "pod.labels is a map"},
+		{Rule{Name: "i", Match: `"x" in pod.name`, Action: ActionExclude}, "pod.name is not a map"},
+		{Rule{Name: "j", Match: `pod.name == 'x\q'`, Action: ActionExclude}, `invalid escape \q`},
+		{Rule{Name: "k", Match: `pod.name == "x`, Action: ActionExclude}, "unterminated string"},
+		{Rule{Name: "l", Match: `pod.name in ["a", 1]`, Action: ActionExclude}, "unexpected character '1'"},
+		{Rule{Name: "m", Match: `(pod.name == "a"`, Action: ActionExclude}, `expected ")"`},
+	} {
+		if _, err := Compile([]Rule{tt.rule}, nil); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("rule %s: expected error containing %q, got %v", tt.rule.Name, tt.want, err)
+		}
+	}
+}
+
+func TestExpressions(t *testing.T) {
+	pod := &Pod{
+		Name:        "reviews-v2",
+		Namespace:   "bookinfo",
+		Labels:      map[string]string{"app": "reviews", "quote": `a"b`},
+		Annotations: map[string]string{"team/owner": "books"},
+	}
+	ns := &Namespace{Name: "bookinfo", Labels: map[string]string{"istio-injection": "enabled"}}
+	for _, tt := range []struct {
+		expr string
+		want bool
+	}{
+		// Precedence: ! binds tighter than &&, which binds tighter than ||.
+		{`true || false && false`, true},
+		{`(true || false) && false`, false},
+		{`!false && false`, false},
+		{`!(false && false)`, true},
+		{`!!true`, true},
+		{`pod.name == "x" || pod.name == "reviews-v2" && pod.namespace == "bookinfo"`, true},
+		// Escapes and quoting.
+		{`pod.labels.quote == "a\"b"`, true},
+		{`pod.labels['quote'] == 'a"b'`, true},
+		{`pod.annotations["team/owner"] == "books"`, true},
+		{`pod.name == "reviews\tv2"`, false},
+		// Missing keys have no value.
+		{`pod.labels.version == "v1"`, false},
+		{`pod.labels.version != "v1"`, true},
+		{`pod.labels.version in ["v1", "v2"]`, false},
+		{`pod.labels.version in []`, false},
+		{`"version" in pod.labels`, false},
+		{`!("version" in pod.labels) || pod.labels.version == "v1"`, true},
+		{`namespace.annotations.owner != "x"`, true},
+		// Namespace fields.
+		{`namespace.name in ["bookinfo", "jobs"]`, true},
+		{`"istio-injection" in namespace.labels && namespace.labels["istio-injection"] == "enabled"`, true},
+	} {
+		e, err := CompileExpr(tt.expr)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.expr, err)
+		}
+		if got, err := e.Eval(pod, ns); err != nil || got != tt.want {
+			t.Errorf("%s = %v, %v; want %v", tt.expr, got, err, tt.want)
+		}
+	}
+}
+
+func TestContainerPorts(t *testing.T) {
+	containers := []corev1.Container{
+		{Name: "app", Ports: []corev1.ContainerPort{{ContainerPort: 8080}, {ContainerPort: 8443}}},
+		{Name: "sidecar"},
+		{Name: ProxyContainerName, Ports: []corev1.ContainerPort{{ContainerPort: 15090}}},
+	}
+	want := map[string][]string{"app": {"8080", "8443"}}
+	if got := ContainerPorts(containers); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
+
+func TestProbePorts(t *testing.T) {
+	httpProbe := func(port intstr.IntOrString) *corev1.Probe {
+		return &corev1.Probe{Handler: corev1.Handler{HTTPGet: &corev1.HTTPGetAction{Port: port}}}
+	}
+	containers := []corev1.Container{
+		{
+			Name:           "app",
+			Ports:          []corev1.ContainerPort{{Name: "http", ContainerPort: 8080}},
+			LivenessProbe:  httpProbe(intstr.FromString("http")),
+			ReadinessProbe: httpProbe(intstr.FromInt(8080)),
+			StartupProbe: &corev1.Probe{Handler: corev1.Handler{
+				TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt(9000)},
+			}},
+		},
+		{
+			Name:           "worker",
+			LivenessProbe:  &corev1.Probe{Handler: corev1.Handler{Exec: &corev1.ExecAction{Command: []string{"true"}}}},
+			ReadinessProbe: httpProbe(intstr.FromString("missing")),
+		},
+		{Name: ProxyContainerName, ReadinessProbe: httpProbe(intstr.FromInt(15021))},
+	}
+	want := []string{"8080", "9000"}
+	if got := ProbePorts(containers); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
+
+func TestProbeRewriteDisabled(t *testing.T) {
+	for value, want := range map[string]bool{"false": true, "true": false, "": false, "nope": false} {
+		annotations := map[string]string{"sidecar.istio.io/rewriteAppHTTPProbers": value}
+		if got := ProbeRewriteDisabled(annotations); got != want {
+			t.Errorf("expected %v for %q, got %v", want, value, got)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package policy
+
+import (
+	"fmt"
+
+	"istio.io/cni/pkg/redirect"
+)
+
+// Action is what a matching rule does with the pod.
+type Action string
+
+const (
+	ActionInclude Action = "include"
+	ActionExclude Action = "exclude"
+)
+
+// Rule is a policy rule of the plugin config. Rules are evaluated in order and
+// the first one whose Match expression is true decides whether the pod is
+// captured. Match tests the name, labels and annotations of the pod and
+// namespace, e.g. `"batch" in pod.labels && namespace.name in ["jobs", "etl"]`.
+type Rule struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Match       string `json:"match"`
+	Action      Action `json:"action"`
+	// Redirect overrides the pod's traffic annotations for included pods, keyed
+	// by redirect registry name, e.g. {"includePorts": "8080"}.
+	Redirect map[string]string `json:"redirect,omitempty"`
+}
+
+// Decision is the result of evaluating a policy for a pod.
+type Decision struct {
+	Capture bool
+	// Rule is the name of the rule which decided.
+	Rule        string
+	Description string
+	// Reason is the pods_excluded metric reason of excluded pods.
+	Reason Reason
+	// Redirect holds the annotations overridden by the rule, keyed by
+	// annotation key.
+	Redirect map[string]string
+}
+
+type compiledRule struct {
+	Rule
+	builtin bool
+	match   func(pod *Pod, ns *Namespace) (bool, error)
+	// namespaceMetadata is set if match reads namespace labels or annotations.
+	namespaceMetadata bool
+	redirect          map[string]string
+}
+
+// Policy is a compiled list of rules.
+type Policy struct {
+	excludeNamespaces []string
+	rules             []compiledRule
+}
+
+// builtinRules are istio-cni's built-in capture decision after the policy
+// rules: pods with an istio-init container, single container pods and pods
+// without an injected sidecar are not captured.
+func builtinRules() []compiledRule {
+	exclude := func(reason Reason, match func(pod *Pod) bool) compiledRule {
+		return compiledRule{
+			Rule:    Rule{Name: string(reason), Action: ActionExclude},
+			builtin: true,
+			match: func(pod *Pod, _ *Namespace) (bool, error) {
+				return match(pod), nil
+			},
+		}
+	}
+	return []compiledRule{
+		exclude(ReasonIstioInit, func(pod *Pod) bool {
+			_, ok := pod.InitContainers[IstioInitContainer]
+			return ok
+		}),
+		exclude(ReasonSingleContainer, func(pod *Pod) bool {
+			return len(pod.Containers) <= 1
+		}),
+		exclude(ReasonInjectDisabled, func(pod *Pod) bool {
+			return InjectDisabled(pod.Annotations)
+		}),
+		exclude(ReasonNoSidecarStatus, func(pod *Pod) bool {
+			return !HasSidecarStatus(pod.Annotations)
+		}),
+		{
+			Rule:    Rule{Name: "default", Description: "no rule excludes the pod", Action: ActionInclude},
+			builtin: true,
+			match: func(*Pod, *Namespace) (bool, error) {
+				return true, nil
+			},
+		},
+	}
+}
+
+// Compile returns the policy excluding the pods of excludeNamespaces, then
+// evaluating rules, then the built-in rules.
+func Compile(rules []Rule, excludeNamespaces []string) (*Policy, error) {
+	p := &Policy{excludeNamespaces: excludeNamespaces}
+	for i, r := range rules {
+		name := r.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i)
+		}
+		match, err := CompileExpr(r.Match)
+		if err != nil {
+			return nil, fmt.Errorf("policy rule %s: invalid match %q: %v", name, r.Match, err)
+		}
+		if r.Action != ActionInclude && r.Action != ActionExclude {
+			return nil, fmt.Errorf("policy rule %s: action must be %s or %s, got %q", name, ActionInclude, ActionExclude, r.Action)
+		}
+		if r.Action == ActionExclude && len(r.Redirect) > 0 {
+			return nil, fmt.Errorf("policy rule %s: redirect overrides need action %s", name, ActionInclude)
+		}
+		overrides := map[string]string{}
+		for param, val := range r.Redirect {
+			reg, ok := redirect.Lookup(param)
+			if !ok {
+				return nil, fmt.Errorf("policy rule %s: unknown redirect parameter %q", name, param)
+			}
+			if reg.Validator != nil {
+				if err := reg.Validator(val); err != nil {
+					return nil, fmt.Errorf("policy rule %s: invalid redirect %s: %v", name, param, err)
+				}
+			}
+			overrides[reg.Key] = val
+		}
+		r.Name = name
+		p.rules = append(p.rules, compiledRule{
+			Rule:              r,
+			match:             match.Eval,
+			namespaceMetadata: match.NeedsNamespaceMetadata(),
+			redirect:          overrides,
+		})
+	}
+	p.rules = append(p.rules, builtinRules()...)
+	return p, nil
+}
+
+// NeedsNamespaceMetadata reports whether a rule uses namespace fields other
+// than its name, which callers must then look up.
+func (p *Policy) NeedsNamespaceMetadata() bool {
+	for _, r := range p.rules {
+		if r.namespaceMetadata {
+			return true
+		}
+	}
+	return false
+}
+
+// ExcludedNamespace returns the decision excluding the pods of namespace if it
+// is one of the excluded namespaces, which no rule overrides. It needs neither
+// the pod nor the namespace metadata.
+func (p *Policy) ExcludedNamespace(namespace string) (Decision, bool) {
+	if !NamespaceExcluded(namespace, p.excludeNamespaces) {
+		return Decision{}, false
+	}
+	return Decision{
+		Rule:        string(ReasonNamespace),
+		Description: ReasonNamespace.Description(),
+		Reason:      ReasonNamespace,
+	}, true
+}
+
+// Evaluate returns the decision excluding the pod's namespace, if any, or of
+// the first matching rule for pod. A rule which fails to evaluate stops the
+// evaluation with its error: the pod is neither captured nor excluded by a
+// later rule it was not meant to reach.
+func (p *Policy) Evaluate(pod *Pod, ns *Namespace) (Decision, error) {
+	if d, ok := p.ExcludedNamespace(pod.Namespace); ok {
+		return d, nil
+	}
+	for _, r := range p.rules {
+		matched, err := r.match(pod, ns)
+		if err != nil {
+			return Decision{}, fmt.Errorf("policy rule %s: %v", r.Name, err)
+		}
+		if matched {
+			return r.decision(), nil
+		}
+	}
+	// Unreachable, the built-in rules end with a catch-all.
+	return Decision{Capture: true}, nil
+}
+
+func (r *compiledRule) decision() Decision {
+	d := Decision{Capture: r.Action == ActionInclude, Rule: r.Name, Description: r.Description}
+	if len(r.redirect) > 0 {
+		d.Redirect = r.redirect
+	}
+	if !d.Capture {
+		d.Reason = ReasonPolicy
+		if r.builtin {
+			d.Reason = Reason(r.Name)
+		}
+		if d.Description == "" {
+			d.Description = d.Reason.Description()
+		}
+	}
+	return d
+}
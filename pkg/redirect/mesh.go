@@ -0,0 +1,114 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redirect
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// MeshConfigKey is the key of the mesh config in the istio ConfigMap.
+const MeshConfigKey = "mesh"
+
+// MeshConfig holds the settings of the Istio mesh config which the Redirect
+// defaults derive from.
+type MeshConfig struct {
+	// ProxyListenPort is the port the proxy's outbound listener, which
+	// captured traffic is redirected to, listens on.
+	ProxyListenPort int         `json:"proxyListenPort"`
+	DefaultConfig   ProxyConfig `json:"defaultConfig"`
+}
+
+// ProxyConfig holds the proxy settings of the mesh config's defaultConfig.
+type ProxyConfig struct {
+	StatusPort       int    `json:"statusPort"`
+	ProxyAdminPort   int    `json:"proxyAdminPort"`
+	InterceptionMode string `json:"interceptionMode"`
+}
+
+// ParseMeshConfig parses the YAML mesh config, as held in the "mesh" key of
+// the istio ConfigMap. Settings the plugin does not use are ignored.
+func ParseMeshConfig(data string) (*MeshConfig, error) {
+	mesh := &MeshConfig{}
+	if err := yaml.Unmarshal([]byte(data), mesh); err != nil {
+		return nil, fmt.Errorf("failed parsing mesh config: %v", err)
+	}
+	for _, p := range []struct {
+		name string
+		port int
+	}{
+		{"proxyListenPort", mesh.ProxyListenPort},
+		{"defaultConfig.statusPort", mesh.DefaultConfig.StatusPort},
+		{"defaultConfig.proxyAdminPort", mesh.DefaultConfig.ProxyAdminPort},
+	} {
+		if p.port < 0 || p.port > 65535 {
+			return nil, fmt.Errorf("invalid %s %d", p.name, p.port)
+		}
+	}
+	if mode := mesh.DefaultConfig.InterceptionMode; mode != "" {
+		if err := ValidateInterceptionMode(mode); err != nil {
+			return nil, fmt.Errorf("invalid defaultConfig.interceptionMode: %v", err)
+		}
+	}
+	return mesh, nil
+}
+
+// Defaults returns the Redirect used for a pod without any traffic
+// annotations in the mesh: the listen port replaces DefaultRedirectToPort, the
+// status port DefaultProxyStatusPort and the interception mode
+// DefaultRedirectMode. A nil mesh config returns Defaults().
+func (m *MeshConfig) Defaults() *Redirect {
+	r := Defaults()
+	if m == nil {
+		return r
+	}
+	if m.ProxyListenPort != 0 {
+		r.TargetPort = strconv.Itoa(m.ProxyListenPort)
+	}
+	if m.DefaultConfig.StatusPort != 0 {
+		port := strconv.Itoa(m.DefaultConfig.StatusPort)
+		r.ExcludeInboundPorts = port
+		r.ExcludeOutboundPorts = port
+		r.ProxyInboundPorts = port + "," + proxyHealthAndStatsPorts
+	}
+	if m.DefaultConfig.InterceptionMode != "" {
+		r.RedirectMode = m.DefaultConfig.InterceptionMode
+	}
+	return r
+}
+
+// ReservedPorts returns DefaultReservedPorts with the admin, listen and status
+// ports of the mesh config. A nil mesh config returns DefaultReservedPorts.
+func (m *MeshConfig) ReservedPorts() string {
+	if m == nil {
+		return DefaultReservedPorts
+	}
+	port := func(p int, def string) string {
+		if p == 0 {
+			return def
+		}
+		return strconv.Itoa(p)
+	}
+	return strings.Join([]string{
+		port(m.DefaultConfig.ProxyAdminPort, "15000"),
+		port(m.ProxyListenPort, DefaultRedirectToPort),
+		"15006",
+		port(m.DefaultConfig.StatusPort, DefaultProxyStatusPort),
+		proxyHealthAndStatsPorts,
+	}, ",")
+}
@@ -0,0 +1,558 @@
+// Copyright 2018 Istio authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package redirect defines the parameters used to capture a workload's
+// traffic into an Istio proxy, and parses them from pod annotations.
+package redirect
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.uber.org/multierr"
+)
+
+const (
+	ModeREDIRECT = "REDIRECT"
+	ModeTPROXY   = "TPROXY"
+
+	DefaultProxyStatusPort       = "15020"
+	DefaultRedirectToPort        = "15001"
+	DefaultNoRedirectUID         = "1337"
+	DefaultRedirectMode          = ModeREDIRECT
+	DefaultRedirectIPCidr        = "*"
+	DefaultRedirectExcludeIPCidr = ""
+	DefaultRedirectExcludePort   = DefaultProxyStatusPort
+	DefaultKubevirtInterfaces    = ""
+
+	// proxyHealthAndStatsPorts are the proxy's health check and Prometheus
+	// ports.
+	proxyHealthAndStatsPorts = "15021,15090"
+
+	// DefaultProxyInboundPorts are the proxy's ports always excluded from
+	// inbound capture: the status, health check and Prometheus ports.
+	DefaultProxyInboundPorts = DefaultProxyStatusPort + "," + proxyHealthAndStatsPorts
+
+	// DefaultReservedPorts are the ports the proxy listens on: the admin,
+	// outbound, inbound, status, health check and Prometheus ports.
+	DefaultReservedPorts = "15000,15001,15006,15020,15021,15090"
+)
+
+// Redirect -- the istio-cni redirect object
+type Redirect struct {
+	TargetPort    string `json:"targetPort"`
+	RedirectMode  string `json:"redirectMode"`
+	NoRedirectUID string `json:"noRedirectUID"`
+	// ExcludeOutboundUIDs and ExcludeOutboundGIDs are the users and groups,
+	// besides NoRedirectUID, whose outbound traffic is not captured, e.g.
+	// co-located agents.
+	ExcludeOutboundUIDs string `json:"excludeOutboundUIDs,omitempty"`
+	ExcludeOutboundGIDs string `json:"excludeOutboundGIDs,omitempty"`
+	IncludeIPCidrs      string `json:"includeIPCidrs"`
+	IncludePorts        string `json:"includePorts"`
+	ExcludeIPCidrs      string `json:"excludeIPCidrs"`
+	ExcludeInboundPorts string `json:"excludeInboundPorts"`
+	// ExcludeInboundSourceIPCidrs are the sources whose inbound traffic is
+	// not captured, e.g. a node health checker.
+	ExcludeInboundSourceIPCidrs string `json:"excludeInboundSourceIPCidrs,omitempty"`
+	ExcludeOutboundPorts        string `json:"excludeOutboundPorts"`
+	// IncludeOutboundPorts are the only outbound ports captured, with ranges
+	// such as 8000-8100. All ports are captured if it is empty.
+	IncludeOutboundPorts string `json:"includeOutboundPorts,omitempty"`
+	KubevirtInterfaces   string `json:"kubevirtInterfaces"`
+	// ExcludeInterfaces are the pod interfaces whose traffic is not captured,
+	// e.g. SR-IOV or macvlan secondary networks.
+	ExcludeInterfaces string `json:"excludeInterfaces,omitempty"`
+	// InboundPortTargets maps inbound ports to the proxy listeners their
+	// traffic is redirected to instead of TargetPort, e.g. "9000:15007".
+	InboundPortTargets string `json:"inboundPortTargets,omitempty"`
+	// ProxyInboundPorts are the proxy's own ports, which Resolve adds to
+	// ExcludeInboundPorts whatever the annotations, in sync with the non-cni
+	// injection template. Resolve uses 15020,15021,15090 if it is empty.
+	ProxyInboundPorts string `json:"proxyInboundPorts,omitempty"`
+	// TproxyMark is the firewall mark of the packets captured in TPROXY mode,
+	// routed to the proxy with TproxyRouteTable. TproxyMask limits the mark to
+	// some bits, leaving the others to the node's CNI. Empty values use 1337,
+	// all bits and table 133.
+	TproxyMark       string `json:"tproxyMark,omitempty"`
+	TproxyMask       string `json:"tproxyMask,omitempty"`
+	TproxyRouteTable string `json:"tproxyRouteTable,omitempty"`
+	// OutboundTproxy keeps the original source address of the connections the
+	// proxy makes to the app in TPROXY mode.
+	OutboundTproxy bool `json:"outboundTproxy,omitempty"`
+	// EgressLockdown drops the outbound traffic which is neither captured,
+	// sent by the proxy nor excluded, so that the app cannot bypass the proxy.
+	// EgressLockdownRejectUDP also rejects UDP other than DNS.
+	EgressLockdown          bool `json:"egressLockdown,omitempty"`
+	EgressLockdownRejectUDP bool `json:"egressLockdownRejectUDP,omitempty"`
+}
+
+// Defaults returns the Redirect used for a pod without any traffic annotations.
+func Defaults() *Redirect {
+	return &Redirect{
+		TargetPort:     DefaultRedirectToPort,
+		RedirectMode:   DefaultRedirectMode,
+		NoRedirectUID:  DefaultNoRedirectUID,
+		IncludeIPCidrs: DefaultRedirectIPCidr,
+		// reflect injection-template: istio fill the value only when the annotation is not set
+		IncludePorts:         "*",
+		ExcludeIPCidrs:       DefaultRedirectExcludeIPCidr,
+		ExcludeInboundPorts:  DefaultRedirectExcludePort,
+		ExcludeOutboundPorts: DefaultRedirectExcludePort,
+		KubevirtInterfaces:   DefaultKubevirtInterfaces,
+		ProxyInboundPorts:    DefaultProxyInboundPorts,
+	}
+}
+
+// Error is the validation error of a single annotation.
+type Error struct {
+	// Name is the registry name of the annotation, e.g. "includePorts".
+	Name  string
+	Key   string
+	Value string
+	Err   error
+	// Source is the layer holding the invalid value.
+	Source Source
+}
+
+func (e *Error) Error() string {
+	switch e.Source {
+	case "":
+		// Validate, the value is not from an annotation.
+		return fmt.Sprintf("invalid %s %q: %v", e.Name, e.Value, e.Err)
+	case SourceConfig:
+		return fmt.Sprintf("invalid %s in plugin config %q: %v", e.Name, e.Value, e.Err)
+	case SourceNamespace:
+		return fmt.Sprintf("invalid %s namespace annotation %q: %v", e.Key, e.Value, e.Err)
+	}
+	return fmt.Sprintf("invalid %s annotation %q: %v", e.Key, e.Value, e.Err)
+}
+
+// Source is where a Redirect value came from.
+type Source string
+
+const (
+	SourceDefault Source = "default"
+	// SourceConfig values come from the plugin config.
+	SourceConfig Source = "config"
+	// SourceNamespace values come from the annotations of the pod's namespace.
+	SourceNamespace Source = "namespace"
+	// SourceAnnotation values come from the pod's annotations.
+	SourceAnnotation Source = "annotation"
+)
+
+// Layer is a set of annotations from a single source. Later layers override
+// the values of earlier ones.
+type Layer struct {
+	Source      Source
+	Annotations map[string]string
+}
+
+// Parse returns the Redirect for a pod with the given annotations. Parameters
+// without an annotation take their value from defaults, or from Defaults() if
+// defaults is nil. Every registered annotation present is validated, and the
+// returned error combines the *Error of each invalid one; use
+// multierr.Errors to list them.
+func Parse(annotations map[string]string, defaults *Redirect) (*Redirect, error) {
+	redir, _, err := Resolve(annotations, defaults)
+	return redir, err
+}
+
+// Resolve is Parse which also returns the source of the registered parameters,
+// keyed by registry name.
+func Resolve(annotations map[string]string, defaults *Redirect) (*Redirect, map[string]Source, error) {
+	return ResolveLayers(defaults, Layer{Source: SourceAnnotation, Annotations: annotations})
+}
+
+// ResolveLayers returns the Redirect from defaults overridden by each layer in
+// turn, e.g. the plugin config, then the namespace, then the pod annotations,
+// with the source of the registered parameters keyed by registry name. Only
+// the pod annotations layer validates annotations which do not set a
+// parameter, such as sidecar.istio.io/inject.
+func ResolveLayers(defaults *Redirect, layers ...Layer) (*Redirect, map[string]Source, error) {
+	if defaults == nil {
+		defaults = Defaults()
+	}
+	redir := *defaults
+	sources := map[string]Source{}
+
+	var errs error
+	for _, name := range Names() {
+		param := registry[name]
+		if param.Set != nil {
+			sources[name] = SourceDefault
+		}
+		for _, layer := range layers {
+			if param.Set == nil && layer.Source != SourceAnnotation {
+				continue
+			}
+			val, found := layer.Annotations[param.Key]
+			if !found {
+				continue
+			}
+			if param.Validator != nil {
+				if err := param.Validator(val); err != nil {
+					errs = multierr.Append(errs, &Error{Name: name, Key: param.Key, Value: val, Err: err, Source: layer.Source})
+					continue
+				}
+			}
+			if param.Set != nil {
+				param.Set(&redir, val)
+				sources[name] = layer.Source
+			}
+		}
+	}
+	if errs != nil {
+		return nil, nil, errs
+	}
+
+	// Add 15090 to sync with non-cni injection template
+	// TODO: Revert below once https://github.com/istio/istio/pull/23037 or its follow up is merged.
+	proxyInboundPorts := redir.proxyInboundPorts()
+	redir.ExcludeInboundPorts = strings.TrimSpace(redir.ExcludeInboundPorts)
+	if len(redir.ExcludeInboundPorts) > 0 && redir.ExcludeInboundPorts[len(redir.ExcludeInboundPorts)-1] != ',' {
+		redir.ExcludeInboundPorts += ","
+	}
+	redir.ExcludeInboundPorts += proxyInboundPorts
+	redir.ExcludeInboundPorts = strings.Join(dedupPorts(splitPorts(redir.ExcludeInboundPorts)), ",")
+
+	if err := redir.checkCombinations(sources); err != nil {
+		return nil, nil, err
+	}
+	return &redir, sources, nil
+}
+
+// Validate checks a Redirect built without annotations, e.g. from flags, as
+// ResolveLayers checks the annotations setting it: the value of each
+// registered parameter, the target port, the proxy UID and the TPROXY
+// settings, then the parameters only valid together and the interfaces.
+func (r *Redirect) Validate() error {
+	var errs error
+	if _, err := parsePort(r.TargetPort); err != nil {
+		errs = multierr.Append(errs, fmt.Errorf("targetPort %q invalid: %v", r.TargetPort, err))
+	}
+	if _, err := strconv.ParseUint(r.NoRedirectUID, 10, 32); err != nil {
+		errs = multierr.Append(errs, fmt.Errorf("noRedirectUID %q invalid: must be a numeric UID", r.NoRedirectUID))
+	}
+	values := r.values()
+	for _, name := range Names() {
+		param := registry[name]
+		val, ok := values[name]
+		if !ok || param.Validator == nil {
+			continue
+		}
+		if err := param.Validator(val); err != nil {
+			errs = multierr.Append(errs, &Error{Name: name, Key: param.Key, Value: val, Err: err})
+		}
+	}
+	if err := r.ValidateTPROXY(nil); err != nil {
+		errs = multierr.Append(errs, err)
+	}
+	if errs != nil {
+		return errs
+	}
+	if err := r.checkCombinations(nil); err != nil {
+		return err
+	}
+	scoped := *r
+	_, err := scoped.ScopeInterfaces("", nil)
+	return err
+}
+
+// values returns the string parameters of r, keyed by registry name.
+func (r *Redirect) values() map[string]string {
+	return map[string]string{
+		"redirectMode":                r.RedirectMode,
+		"includeIPCidrs":              r.IncludeIPCidrs,
+		"excludeIPCidrs":              r.ExcludeIPCidrs,
+		"includePorts":                r.IncludePorts,
+		"excludeInboundPorts":         r.ExcludeInboundPorts,
+		"excludeInboundSourceIPCidrs": r.ExcludeInboundSourceIPCidrs,
+		"excludeOutboundUIDs":         r.ExcludeOutboundUIDs,
+		"excludeOutboundGIDs":         r.ExcludeOutboundGIDs,
+		"excludeOutboundPorts":        r.ExcludeOutboundPorts,
+		"includeOutboundPorts":        r.IncludeOutboundPorts,
+		"kubevirtInterfaces":          r.KubevirtInterfaces,
+		"excludeInterfaces":           r.ExcludeInterfaces,
+		"inboundPortTargets":          r.InboundPortTargets,
+	}
+}
+
+// proxyInboundPorts returns ProxyInboundPorts, or the default ones if empty.
+func (r *Redirect) proxyInboundPorts() string {
+	if r.ProxyInboundPorts == "" {
+		return DefaultProxyInboundPorts
+	}
+	return r.ProxyInboundPorts
+}
+
+// checkCombinations checks the parameters which are only valid together,
+// returning the *Error of the parameter at fault with its source in sources.
+func (r *Redirect) checkCombinations(sources map[string]Source) error {
+	if err := r.checkInboundPortTargets(r.proxyInboundPorts()); err != nil {
+		param := registry["inboundPortTargets"]
+		return &Error{Name: "inboundPortTargets", Key: param.Key, Value: r.InboundPortTargets, Err: err,
+			Source: sources["inboundPortTargets"]}
+	}
+	if err := r.checkEgressLockdown(); err != nil {
+		param := registry["egressLockdown"]
+		return &Error{Name: "egressLockdown", Key: param.Key, Value: "true", Err: err,
+			Source: sources["egressLockdown"]}
+	}
+	return nil
+}
+
+// checkEgressLockdown returns an error if egress lockdown would drop outbound
+// traffic which is neither captured nor excluded: the lockdown only lets
+// through the destinations excludeIPCidrs and excludeOutboundPorts exclude.
+func (r *Redirect) checkEgressLockdown() error {
+	if !r.EgressLockdown {
+		return nil
+	}
+	if r.IncludeOutboundPorts != "" {
+		return fmt.Errorf("the outbound ports includeOutboundPorts %q leaves uncaptured would be dropped, "+
+			"exclude them with excludeOutboundPorts instead", r.IncludeOutboundPorts)
+	}
+	if r.IncludeIPCidrs != "*" {
+		return fmt.Errorf("the destinations includeOutboundIPRanges %q leaves uncaptured would be dropped, "+
+			"exclude them with excludeOutboundIPRanges instead", r.IncludeIPCidrs)
+	}
+	return nil
+}
+
+// checkInboundPortTargets returns an error if a mapped inbound port is
+// excluded from capture, or is mapped to one of the proxy's own ports. No port
+// is mapped if includeInboundPorts is empty, as no inbound port is captured.
+func (r *Redirect) checkInboundPortTargets(proxyInboundPorts string) error {
+	if r.InboundPortTargets != "" && strings.TrimSpace(r.IncludePorts) == "" {
+		return fmt.Errorf("inbound ports %q are not captured as includeInboundPorts is empty", r.InboundPortTargets)
+	}
+	excluded := splitList(r.ExcludeInboundPorts)
+	proxyPorts := splitList(proxyInboundPorts)
+	for _, mapping := range splitList(r.InboundPortTargets) {
+		ports := strings.SplitN(mapping, ":", 2)
+		if contains(excluded, ports[0]) {
+			return fmt.Errorf("port %s is excluded from capture by excludeInboundPorts %q", ports[0], r.ExcludeInboundPorts)
+		}
+		if contains(proxyPorts, ports[1]) {
+			return fmt.Errorf("port %s is mapped to the proxy port %s, which is excluded from capture", ports[0], ports[1])
+		}
+	}
+	return nil
+}
+
+// The kinds of PortConflict.
+const (
+	// ConflictContainer is a port of an app container.
+	ConflictContainer = "container"
+	// ConflictIncludePorts is a port of the includeInboundPorts annotation.
+	ConflictIncludePorts = "include_inbound_ports"
+)
+
+// PortConflict is an app port which is also one of the proxy's ports.
+type PortConflict struct {
+	Port string
+	// Kind is ConflictContainer or ConflictIncludePorts.
+	Kind string
+	// Source declares the port: a container of the pod, or the
+	// includeInboundPorts annotation.
+	Source string
+}
+
+func (c PortConflict) String() string {
+	return fmt.Sprintf("port %s of %s is reserved by the proxy", c.Port, c.Source)
+}
+
+// PortConflicts returns the ports of the app containers and of IncludePorts
+// which are reserved by the proxy, i.e. in reserved, ProxyInboundPorts or
+// TargetPort. An empty reserved uses DefaultReservedPorts. containerPorts maps
+// the app containers to their ports.
+func (r *Redirect) PortConflicts(reserved string, containerPorts map[string][]string) []PortConflict {
+	if reserved == "" {
+		reserved = DefaultReservedPorts
+	}
+	var proxyPorts []string
+	for _, port := range append(splitList(reserved+","+r.ProxyInboundPorts), r.TargetPort) {
+		proxyPorts = append(proxyPorts, strings.TrimSpace(port))
+	}
+
+	names := make([]string, 0, len(containerPorts))
+	for name := range containerPorts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var conflicts []PortConflict
+	for _, name := range names {
+		for _, port := range containerPorts[name] {
+			if contains(proxyPorts, port) {
+				conflicts = append(conflicts, PortConflict{Port: port, Kind: ConflictContainer, Source: "container " + name})
+			}
+		}
+	}
+	if r.IncludePorts != "*" {
+		for _, port := range splitList(r.IncludePorts) {
+			if port = strings.TrimSpace(port); contains(proxyPorts, port) {
+				conflicts = append(conflicts, PortConflict{Port: port, Kind: ConflictIncludePorts, Source: registry["includePorts"].Key})
+			}
+		}
+	}
+	return conflicts
+}
+
+// AddExcludeIPCidrs adds cidrs to ExcludeIPCidrs, skipping those already
+// excluded.
+func (r *Redirect) AddExcludeIPCidrs(cidrs ...string) {
+	var all []string
+	if r.ExcludeIPCidrs != "" {
+		all = strings.Split(r.ExcludeIPCidrs, ",")
+	}
+	r.ExcludeIPCidrs = strings.Join(dedupPorts(append(all, cidrs...)), ",")
+}
+
+// AddExcludeInboundPorts adds ports to ExcludeInboundPorts, and removes them
+// from IncludePorts unless all ports are included. It returns the ports which
+// were not excluded yet.
+func (r *Redirect) AddExcludeInboundPorts(ports ...string) []string {
+	excluded := splitList(r.ExcludeInboundPorts)
+	var added []string
+	for _, port := range ports {
+		if !contains(excluded, port) {
+			excluded = append(excluded, port)
+			added = append(added, port)
+		}
+	}
+	r.ExcludeInboundPorts = strings.Join(excluded, ",")
+	if r.IncludePorts != "*" {
+		var included []string
+		for _, port := range splitList(r.IncludePorts) {
+			if !contains(ports, strings.TrimSpace(port)) {
+				included = append(included, port)
+			}
+		}
+		r.IncludePorts = strings.Join(included, ",")
+	}
+	return added
+}
+
+// ScopeInterfaces limits capture to the pod's primary interface. The other
+// interfaces of the pod, e.g. Multus secondary networks, are added to
+// ExcludeInterfaces unless they are KubevirtInterfaces. It returns an error if
+// the primary interface is excluded or is a kubevirt interface, or if an
+// interface is both. Otherwise it returns the KubevirtInterfaces which are not
+// among interfaces, if any are known: either misspelled, or bridges KubeVirt
+// has yet to create.
+func (r *Redirect) ScopeInterfaces(primary string, interfaces []string) ([]string, error) {
+	kubevirt := splitList(r.KubevirtInterfaces)
+	excluded := splitList(r.ExcludeInterfaces)
+	if primary != "" {
+		if contains(excluded, primary) {
+			return nil, fmt.Errorf("excludeInterfaces %q include the primary interface %s", r.ExcludeInterfaces, primary)
+		}
+		if contains(kubevirt, primary) {
+			return nil, fmt.Errorf("kubevirtInterfaces %q include the primary interface %s", r.KubevirtInterfaces, primary)
+		}
+	}
+	var unknown []string
+	for _, iface := range kubevirt {
+		if contains(excluded, iface) {
+			return nil, fmt.Errorf("interface %s is in both kubevirtInterfaces and excludeInterfaces", iface)
+		}
+		if len(interfaces) > 0 && !contains(interfaces, iface) {
+			unknown = append(unknown, iface)
+		}
+	}
+	for _, iface := range interfaces {
+		if iface == "" || iface == primary || iface == loopbackInterface || contains(kubevirt, iface) {
+			continue
+		}
+		excluded = append(excluded, iface)
+	}
+	r.ExcludeInterfaces = strings.Join(dedupPorts(excluded), ",")
+	return unknown, nil
+}
+
+// ValidateTPROXY checks the TPROXY mark, mask and route table, and that the
+// mark only sets bits outside of the reserved marks, e.g. the bits other
+// components of the node use.
+func (r *Redirect) ValidateTPROXY(reserved []string) error {
+	mark, mask := uint32(DefaultTproxyMark), uint32(fullMarkMask)
+	var err error
+	if r.TproxyMark != "" {
+		if mark, err = ParseMark(r.TproxyMark); err != nil {
+			return fmt.Errorf("tproxyMark %q invalid: %v", r.TproxyMark, err)
+		}
+		if mark == 0 {
+			return fmt.Errorf("tproxyMark %q invalid: must not be 0", r.TproxyMark)
+		}
+	}
+	if r.TproxyMask != "" {
+		if mask, err = ParseMark(r.TproxyMask); err != nil {
+			return fmt.Errorf("tproxyMask %q invalid: %v", r.TproxyMask, err)
+		}
+	}
+	if mark&^mask != 0 {
+		return fmt.Errorf("tproxyMark %#x has bits outside of tproxyMask %#x", mark, mask)
+	}
+	if r.TproxyRouteTable != "" {
+		if err := ValidateRouteTable(r.TproxyRouteTable); err != nil {
+			return err
+		}
+	}
+	for _, res := range reserved {
+		bits, err := ParseMark(res)
+		if err != nil {
+			return fmt.Errorf("reserved mark %q invalid: %v", res, err)
+		}
+		if mask&bits != 0 {
+			return fmt.Errorf("tproxyMask %#x overlaps the reserved mark bits %#x", mask, bits)
+		}
+	}
+	return nil
+}
+
+// splitList splits a comma separated list, returning nil for an empty one.
+func splitList(list string) []string {
+	if strings.TrimSpace(list) == "" {
+		return nil
+	}
+	return strings.Split(list, ",")
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func splitPorts(portsString string) []string {
+	return strings.Split(portsString, ",")
+}
+
+func dedupPorts(ports []string) []string {
+	dedup := make(map[string]bool)
+	keys := []string{}
+
+	for _, port := range ports {
+		if !dedup[port] {
+			dedup[port] = true
+			keys = append(keys, port)
+		}
+	}
+	return keys
+}
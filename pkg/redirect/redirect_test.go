@@ -0,0 +1,529 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redirect
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.uber.org/multierr"
+
+	"istio.io/api/annotation"
+)
+
+func TestParseDefaults(t *testing.T) {
+	r, err := Parse(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Defaults()
+	want.ExcludeInboundPorts = "15020,15021,15090"
+	if !reflect.DeepEqual(r, want) {
+		t.Fatalf("expected %+v, got %+v", want, r)
+	}
+
+	r, err = Parse(map[string]string{
+		annotation.SidecarTrafficIncludeInboundPorts.Name:  "8080",
+		annotation.SidecarTrafficExcludeInboundPorts.Name:  "3306",
+		annotation.SidecarTrafficExcludeOutboundPorts.Name: "5432",
+	}, &Redirect{RedirectMode: ModeTPROXY, IncludeIPCidrs: "10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = &Redirect{
+		RedirectMode:         ModeTPROXY,
+		IncludeIPCidrs:       "10.0.0.0/8",
+		IncludePorts:         "8080",
+		ExcludeInboundPorts:  "3306,15020,15021,15090",
+		ExcludeOutboundPorts: "5432",
+	}
+	if !reflect.DeepEqual(r, want) {
+		t.Fatalf("expected %+v, got %+v", want, r)
+	}
+}
+
+func TestParseReturnsAllErrors(t *testing.T) {
+	_, err := Parse(map[string]string{
+		annotation.SidecarInterceptionMode.Name:               "BOGUS",
+		annotation.SidecarTrafficIncludeInboundPorts.Name:     "80,http",
+		annotation.SidecarTrafficExcludeOutboundIPRanges.Name: "10.0.0.0/8",
+	}, nil)
+	errs := multierr.Errors(err)
+	if len(errs) != 2 {
+		t.Fatalf("expected 2 errors, got %v", err)
+	}
+	var names []string
+	for _, e := range errs {
+		verr, ok := e.(*Error)
+		if !ok {
+			t.Fatalf("expected *Error, got %T", e)
+		}
+		names = append(names, verr.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"includePorts", "redirectMode"}) {
+		t.Fatalf("unexpected invalid annotations %v", names)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	key := "example.com/captureUID"
+	err := Register("captureUID", Param{
+		Key: key,
+		Validator: func(v string) error {
+			if v == "0" {
+				return fmt.Errorf("root is not allowed")
+			}
+			return nil
+		},
+		Set: func(r *Redirect, v string) { r.NoRedirectUID = v },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer delete(registry, "captureUID")
+
+	if err := Register("other", Param{Key: key}); err == nil {
+		t.Fatalf("expected duplicate key to be rejected")
+	}
+	if r, err := Parse(map[string]string{key: "2000"}, nil); err != nil || r.NoRedirectUID != "2000" {
+		t.Fatalf("expected registered annotation to set NoRedirectUID, got %+v, %v", r, err)
+	}
+	if _, err := Parse(map[string]string{key: "0"}, nil); err == nil {
+		t.Fatalf("expected registered validator to reject 0")
+	}
+}
+
+func Test_dedupPorts(t *testing.T) {
+	type args struct {
+		ports []string
+	}
+	tests := []struct {
+		name string
+		args args
+		want []string
+	}{
+		{
+			name: "No duplicates",
+			args: args{ports: []string{"1234", "2345"}},
+			want: []string{"1234", "2345"},
+		},
+		{
+			name: "Sequential Duplicates",
+			args: args{ports: []string{"1234", "1234", "2345", "2345"}},
+			want: []string{"1234", "2345"},
+		},
+		{
+			name: "Mixed Duplicates",
+			args: args{ports: []string{"1234", "2345", "1234", "2345"}},
+			want: []string{"1234", "2345"},
+		},
+		{
+			name: "Empty",
+			args: args{ports: []string{}},
+			want: []string{},
+		},
+		{
+			name: "Non-parseable",
+			args: args{ports: []string{"abcd", "2345", "abcd"}},
+			want: []string{"abcd", "2345"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := dedupPorts(tt.args.ports); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("dedupPorts() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveSources(t *testing.T) {
+	_, sources, err := Resolve(map[string]string{
+		annotation.SidecarTrafficIncludeInboundPorts.Name: "8080",
+		annotation.SidecarStatus.Name:                     "{}",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sources["includePorts"] != SourceAnnotation || sources["excludeOutboundPorts"] != SourceDefault {
+		t.Fatalf("unexpected sources %v", sources)
+	}
+	if _, ok := sources["status"]; ok {
+		t.Fatalf("validation only annotation status should have no source")
+	}
+}
+
+func TestResolveLayers(t *testing.T) {
+	config, err := Annotations(map[string]string{"excludeOutboundPorts": "5432", "excludeIPCidrs": "10.0.0.1/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	redir, sources, err := ResolveLayers(nil,
+		Layer{Source: SourceConfig, Annotations: config},
+		Layer{Source: SourceNamespace, Annotations: map[string]string{
+			annotation.SidecarTrafficExcludeOutboundPorts.Name: "3306",
+			annotation.SidecarTrafficIncludeInboundPorts.Name:  "9080",
+			annotation.SidecarInject.Name:                      "not-validated",
+		}},
+		Layer{Source: SourceAnnotation, Annotations: map[string]string{
+			annotation.SidecarTrafficIncludeInboundPorts.Name: "8080",
+		}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if redir.ExcludeIPCidrs != "10.0.0.1/32" || redir.ExcludeOutboundPorts != "3306" || redir.IncludePorts != "8080" {
+		t.Fatalf("unexpected redirect %+v", redir)
+	}
+	want := map[string]Source{
+		"excludeIPCidrs":       SourceConfig,
+		"excludeOutboundPorts": SourceNamespace,
+		"includePorts":         SourceAnnotation,
+		"redirectMode":         SourceDefault,
+	}
+	for name, source := range want {
+		if sources[name] != source {
+			t.Errorf("source of %s = %q, want %q", name, sources[name], source)
+		}
+	}
+
+	_, _, err = ResolveLayers(nil, Layer{Source: SourceNamespace, Annotations: map[string]string{
+		annotation.SidecarTrafficExcludeOutboundPorts.Name: "mysql",
+	}})
+	if err == nil || !strings.Contains(err.Error(), "namespace annotation") {
+		t.Fatalf("expected namespace annotation error, got %v", err)
+	}
+	if _, err := Annotations(map[string]string{"bogus": "1"}); err == nil {
+		t.Fatalf("expected unknown parameter error")
+	}
+}
+
+func TestMeshConfigDefaults(t *testing.T) {
+	mesh, err := ParseMeshConfig(`
+accessLogFile: /dev/stdout
+proxyListenPort: 15101
+defaultConfig:
+  statusPort: 15120
+  proxyAdminPort: 15100
+  interceptionMode: TPROXY
+  discoveryAddress: istiod.istio-system.svc:15012
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := Parse(map[string]string{annotation.SidecarTrafficExcludeInboundPorts.Name: "3306"}, mesh.Defaults())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.RedirectMode != ModeTPROXY || r.TargetPort != "15101" ||
+		r.ExcludeInboundPorts != "3306,15120,15021,15090" || r.ExcludeOutboundPorts != "15120" {
+		t.Fatalf("unexpected redirect %+v", r)
+	}
+	if reserved := mesh.ReservedPorts(); reserved != "15100,15101,15006,15120,15021,15090" {
+		t.Fatalf("unexpected reserved ports %q", reserved)
+	}
+	var none *MeshConfig
+	if none.ReservedPorts() != DefaultReservedPorts || !reflect.DeepEqual(none.Defaults(), Defaults()) {
+		t.Fatalf("expected built-in defaults without a mesh config")
+	}
+
+	for _, bad := range []string{"defaultConfig: [", "defaultConfig:\n  statusPort: 70000", "defaultConfig:\n  interceptionMode: NONE",
+		"proxyListenPort: -1", "defaultConfig:\n  proxyAdminPort: 65536"} {
+		if _, err := ParseMeshConfig(bad); err == nil {
+			t.Errorf("expected error for mesh config %q", bad)
+		}
+	}
+}
+
+func TestAddExcludeIPCidrs(t *testing.T) {
+	r := &Redirect{}
+	r.AddExcludeIPCidrs("169.254.0.0/16")
+	r.AddExcludeIPCidrs("10.96.0.1/32", "169.254.0.0/16", "fd00::1/128")
+	if r.ExcludeIPCidrs != "169.254.0.0/16,10.96.0.1/32,fd00::1/128" {
+		t.Fatalf("unexpected excludeIPCidrs %q", r.ExcludeIPCidrs)
+	}
+}
+
+func TestIncludeOutboundPorts(t *testing.T) {
+	r, err := Parse(map[string]string{IncludeOutboundPortsKey: "80,8000-8100"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.IncludeOutboundPorts != "80,8000-8100" {
+		t.Fatalf("unexpected includeOutboundPorts %q", r.IncludeOutboundPorts)
+	}
+	for _, bad := range []string{"http", "8100-8000", "1-2,3-4,5-6,7-8,9-10,11-12,13-14,15-16"} {
+		if _, err := Parse(map[string]string{IncludeOutboundPortsKey: bad}, nil); err == nil {
+			t.Errorf("expected %q to be invalid", bad)
+		}
+	}
+}
+
+func TestExcludeInboundSourceIPCidrs(t *testing.T) {
+	r, err := Parse(map[string]string{ExcludeInboundSourceIPRangesKey: "130.211.0.0/22,fd00::/8"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.ExcludeInboundSourceIPCidrs != "130.211.0.0/22,fd00::/8" {
+		t.Fatalf("unexpected excludeInboundSourceIPCidrs %q", r.ExcludeInboundSourceIPCidrs)
+	}
+	if _, err := Parse(map[string]string{ExcludeInboundSourceIPRangesKey: "130.211.0.0"}, nil); err == nil {
+		t.Fatalf("expected an address without prefix length to be invalid")
+	}
+}
+
+func TestExcludeOutboundIDs(t *testing.T) {
+	r, err := Parse(map[string]string{ExcludeOutboundUIDsKey: "1500,1501", ExcludeOutboundGIDsKey: "2500"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.ExcludeOutboundUIDs != "1500,1501" || r.ExcludeOutboundGIDs != "2500" {
+		t.Fatalf("unexpected redirect %+v", r)
+	}
+	_, err = Parse(map[string]string{ExcludeOutboundUIDsKey: "fluentd", ExcludeOutboundGIDsKey: "-1"}, nil)
+	if len(multierr.Errors(err)) != 2 {
+		t.Fatalf("expected both id lists to be invalid, got %v", err)
+	}
+}
+
+func TestScopeInterfaces(t *testing.T) {
+	r, err := Parse(map[string]string{
+		ExcludeInterfacesKey:                             "net3",
+		annotation.SidecarTrafficKubevirtInterfaces.Name: "k6t-net2",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknown, err := r.ScopeInterfaces("eth0", []string{"lo", "eth0", "net1", "k6t-net2", "net3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.ExcludeInterfaces != "net3,net1" || len(unknown) != 0 {
+		t.Fatalf("unexpected excludeInterfaces %q, unknown kubevirtInterfaces %v", r.ExcludeInterfaces, unknown)
+	}
+	r = &Redirect{KubevirtInterfaces: "k6t-net2,k6t-net4"}
+	if unknown, err := r.ScopeInterfaces("eth0", []string{"eth0", "k6t-net2"}); err != nil || !reflect.DeepEqual(unknown, []string{"k6t-net4"}) {
+		t.Fatalf("expected k6t-net4 to be unknown, got %v, %v", unknown, err)
+	}
+	if unknown, err := r.ScopeInterfaces("eth0", nil); err != nil || len(unknown) != 0 {
+		t.Fatalf("expected no unknown interfaces without interfaces, got %v, %v", unknown, err)
+	}
+
+	for _, conflict := range []*Redirect{
+		{ExcludeInterfaces: "eth0"},
+		{KubevirtInterfaces: "eth0"},
+		{KubevirtInterfaces: "net1", ExcludeInterfaces: "net1"},
+	} {
+		if _, err := conflict.ScopeInterfaces("eth0", nil); err == nil {
+			t.Errorf("expected %+v to conflict", conflict)
+		}
+	}
+	for _, bad := range []string{"lo", "net1,", "a-very-long-interface", "eth0:1"} {
+		if _, err := Parse(map[string]string{ExcludeInterfacesKey: bad}, nil); err == nil {
+			t.Errorf("expected %q to be invalid", bad)
+		}
+	}
+}
+
+func TestValidateTPROXY(t *testing.T) {
+	tests := []struct {
+		name     string
+		r        Redirect
+		reserved []string
+		err      string
+	}{
+		{name: "defaults"},
+		{name: "masked mark", r: Redirect{TproxyMark: "0x400", TproxyMask: "0xf00", TproxyRouteTable: "200"},
+			reserved: []string{"0xffff0000", "0x4000"}},
+		{name: "default mask overlaps reserved", reserved: []string{"0xffff0000"}, err: "overlaps the reserved mark bits"},
+		{name: "mask overlaps reserved", r: Redirect{TproxyMark: "0x10000", TproxyMask: "0x10000"},
+			reserved: []string{"0xffff0000"}, err: "overlaps the reserved mark bits 0xffff0000"},
+		{name: "mark outside mask", r: Redirect{TproxyMark: "0x1400", TproxyMask: "0xf00"}, err: "outside of tproxyMask"},
+		{name: "zero mark", r: Redirect{TproxyMark: "0"}, err: "must not be 0"},
+		{name: "invalid mark", r: Redirect{TproxyMark: "0x100000000"}, err: "not a 32 bit mark"},
+		{name: "main table", r: Redirect{TproxyRouteTable: "254"}, err: "kernel's main table"},
+		{name: "invalid table", r: Redirect{TproxyRouteTable: "main"}, err: "routeTable"},
+		{name: "invalid reserved", reserved: []string{"calico"}, err: "reserved mark"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.r.ValidateTPROXY(tt.reserved)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("expected error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestEgressLockdown(t *testing.T) {
+	r, err := Parse(map[string]string{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.EgressLockdown || r.EgressLockdownRejectUDP {
+		t.Fatalf("expected no egress lockdown by default, got %+v", r)
+	}
+	r, err = Parse(map[string]string{EgressLockdownKey: "true", EgressLockdownRejectUDPKey: "true"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.EgressLockdown || !r.EgressLockdownRejectUDP {
+		t.Fatalf("expected egress lockdown rejecting UDP, got %+v", r)
+	}
+	if _, err := Parse(map[string]string{EgressLockdownKey: "strict"}, nil); err == nil {
+		t.Fatalf("expected invalid egressLockdown annotation")
+	}
+
+	// Traffic left uncaptured by the include lists would be dropped.
+	for _, tt := range []struct {
+		key, val, err string
+	}{
+		{IncludeOutboundPortsKey, "80,443", `includeOutboundPorts "80,443" leaves uncaptured`},
+		{annotation.SidecarTrafficIncludeOutboundIPRanges.Name, "10.0.0.0/8", `includeOutboundIPRanges "10.0.0.0/8" leaves uncaptured`},
+		{annotation.SidecarTrafficIncludeOutboundIPRanges.Name, "", `includeOutboundIPRanges "" leaves uncaptured`},
+	} {
+		_, err := Parse(map[string]string{EgressLockdownKey: "true", tt.key: tt.val}, nil)
+		if err == nil || !strings.Contains(err.Error(), tt.err) || !strings.Contains(err.Error(), EgressLockdownKey) {
+			t.Errorf("expected error containing %q for %s=%q, got %v", tt.err, tt.key, tt.val, err)
+		}
+	}
+	if _, err := Parse(map[string]string{EgressLockdownKey: "true",
+		annotation.SidecarTrafficExcludeOutboundIPRanges.Name: "10.0.0.0/8"}, nil); err != nil {
+		t.Fatalf("expected excluded destinations to be allowed with egress lockdown, got %v", err)
+	}
+}
+
+func TestInboundPortTargets(t *testing.T) {
+	r, err := Parse(map[string]string{InboundPortTargetsKey: "9000:15007,9443:15008"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.InboundPortTargets != "9000:15007,9443:15008" {
+		t.Fatalf("unexpected inboundPortTargets %q", r.InboundPortTargets)
+	}
+
+	for _, tt := range []struct {
+		annotations map[string]string
+		err         string
+	}{
+		{map[string]string{InboundPortTargetsKey: "9000"}, "not PORT:TARGET"},
+		{map[string]string{InboundPortTargetsKey: "9000:15007:1"}, "not PORT:TARGET"},
+		{map[string]string{InboundPortTargetsKey: "9000:http"}, "failed parsing port"},
+		{map[string]string{InboundPortTargetsKey: "9000:15007,9000:15008"}, "mapped twice"},
+		{map[string]string{InboundPortTargetsKey: "15090:15007"}, "excluded from capture by excludeInboundPorts"},
+		{map[string]string{InboundPortTargetsKey: "9000:15007", annotation.SidecarTrafficExcludeInboundPorts.Name: "9000"},
+			"excluded from capture by excludeInboundPorts"},
+		{map[string]string{InboundPortTargetsKey: "9000:15021"}, "mapped to the proxy port 15021"},
+		{map[string]string{InboundPortTargetsKey: "9000:15007", annotation.SidecarTrafficIncludeInboundPorts.Name: ""},
+			"includeInboundPorts is empty"},
+	} {
+		_, err := Parse(tt.annotations, nil)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("expected %v to fail with %q, got %v", tt.annotations, tt.err, err)
+		}
+	}
+}
+
+func TestPortConflicts(t *testing.T) {
+	r, err := Parse(map[string]string{annotation.SidecarTrafficIncludeInboundPorts.Name: "8080, 15006"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	containerPorts := map[string][]string{
+		"app":     {"8080", "15000"},
+		"metrics": {"15090"},
+		"web":     {"443"},
+	}
+	want := []PortConflict{
+		{Port: "15000", Kind: ConflictContainer, Source: "container app"},
+		{Port: "15090", Kind: ConflictContainer, Source: "container metrics"},
+		{Port: "15006", Kind: ConflictIncludePorts, Source: annotation.SidecarTrafficIncludeInboundPorts.Name},
+	}
+	if got := r.PortConflicts("", containerPorts); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected conflicts %v, got %v", want, got)
+	}
+
+	// The reserved ports replace the defaults, the proxy ports of the
+	// redirect are always reserved.
+	r.ProxyInboundPorts = "15020,15021,15090,9901"
+	want = []PortConflict{
+		{Port: "9901", Kind: ConflictContainer, Source: "container app"},
+		{Port: "15090", Kind: ConflictContainer, Source: "container metrics"},
+	}
+	if got := r.PortConflicts("15001", map[string][]string{"app": {"9901", "15000"}, "metrics": {"15090"}}); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected conflicts %v, got %v", want, got)
+	}
+
+	if got := Defaults().PortConflicts("", map[string][]string{"app": {"8080"}}); len(got) != 0 {
+		t.Fatalf("expected no conflicts, got %v", got)
+	}
+}
+
+func TestAddExcludeInboundPorts(t *testing.T) {
+	r := Defaults()
+	r.ExcludeInboundPorts = "15020,15021,15090"
+	if added := r.AddExcludeInboundPorts("8080", "15021"); !reflect.DeepEqual(added, []string{"8080"}) {
+		t.Fatalf("expected 8080 to be added, got %v", added)
+	}
+	if r.ExcludeInboundPorts != "15020,15021,15090,8080" || r.IncludePorts != "*" {
+		t.Fatalf("unexpected ports %+v", r)
+	}
+
+	r.IncludePorts = "9080, 8080"
+	r.AddExcludeInboundPorts("8080")
+	if r.IncludePorts != "9080" {
+		t.Fatalf("expected 8080 to be removed from includePorts, got %q", r.IncludePorts)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := Defaults().Validate(); err != nil {
+		t.Fatalf("expected the defaults to be valid, got %v", err)
+	}
+	for _, tc := range []struct {
+		name   string
+		modify func(r *Redirect)
+		want   string
+	}{
+		{"value", func(r *Redirect) { r.IncludePorts = "80,http" }, "invalid includePorts \"80,http\""},
+		{"target port", func(r *Redirect) { r.TargetPort = "" }, "targetPort"},
+		{"uid", func(r *Redirect) { r.NoRedirectUID = "istio" }, "noRedirectUID"},
+		{"tproxy", func(r *Redirect) { r.TproxyMark = "0" }, "tproxyMark"},
+		{"egress lockdown", func(r *Redirect) {
+			r.EgressLockdown = true
+			r.IncludeOutboundPorts = "80"
+		}, "invalid egressLockdown"},
+		{"inbound port targets", func(r *Redirect) { r.InboundPortTargets = "15020:15007" }, "invalid inboundPortTargets"},
+		{"interfaces", func(r *Redirect) {
+			r.KubevirtInterfaces = "net1"
+			r.ExcludeInterfaces = "net1"
+		}, "interface net1 is in both"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := Defaults()
+			tc.modify(r)
+			if err := r.Validate(); err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("expected %q error, got %v", tc.want, err)
+			}
+		})
+	}
+}
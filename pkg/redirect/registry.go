@@ -0,0 +1,156 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redirect
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"istio.io/api/annotation"
+)
+
+// ValidationFunc validates the value of an annotation.
+type ValidationFunc func(value string) error
+
+// Param is an annotation understood by Parse.
+type Param struct {
+	// Key is the annotation key, e.g. "traffic.sidecar.istio.io/includeInboundPorts".
+	Key string
+	// Validator checks the annotation value. A nil Validator accepts any value.
+	Validator ValidationFunc
+	// Set applies a valid annotation value to the Redirect. A nil Set only
+	// validates the annotation.
+	Set func(r *Redirect, value string)
+}
+
+const (
+	// IncludeOutboundPortsKey is the annotation listing the only outbound
+	// ports captured.
+	IncludeOutboundPortsKey = "traffic.sidecar.istio.io/includeOutboundPorts"
+	// ExcludeInboundSourceIPRangesKey is the annotation listing the sources
+	// whose inbound traffic is not captured.
+	ExcludeInboundSourceIPRangesKey = "traffic.sidecar.istio.io/excludeInboundSourceIPRanges"
+	// ExcludeOutboundUIDsKey and ExcludeOutboundGIDsKey are the annotations
+	// listing the users and groups whose outbound traffic is not captured.
+	ExcludeOutboundUIDsKey = "traffic.sidecar.istio.io/excludeOutboundUIDs"
+	ExcludeOutboundGIDsKey = "traffic.sidecar.istio.io/excludeOutboundGIDs"
+	// ExcludeInterfacesKey is the annotation listing the pod interfaces whose
+	// traffic is not captured.
+	ExcludeInterfacesKey = "traffic.sidecar.istio.io/excludeInterfaces"
+	// EgressLockdownKey is the annotation dropping the outbound traffic which
+	// bypasses the proxy, and EgressLockdownRejectUDPKey the one also
+	// rejecting UDP other than DNS.
+	EgressLockdownKey          = "traffic.sidecar.istio.io/egressLockdown"
+	EgressLockdownRejectUDPKey = "traffic.sidecar.istio.io/egressLockdownRejectUDP"
+	// InboundPortTargetsKey is the annotation mapping inbound ports to the
+	// proxy listeners their traffic is redirected to.
+	InboundPortTargetsKey = "traffic.sidecar.istio.io/inboundPortTargets"
+)
+
+var (
+	registry = map[string]*Param{
+		"inject": {Key: annotation.SidecarInject.Name},
+		"status": {Key: annotation.SidecarStatus.Name},
+		"redirectMode": {Key: annotation.SidecarInterceptionMode.Name, Validator: ValidateInterceptionMode,
+			Set: func(r *Redirect, v string) { r.RedirectMode = v }},
+		"ports": {Key: annotation.SidecarStatusPort.Name, Validator: ValidatePortList},
+		"includeIPCidrs": {Key: annotation.SidecarTrafficIncludeOutboundIPRanges.Name, Validator: ValidateCIDRListWithWildcard,
+			Set: func(r *Redirect, v string) { r.IncludeIPCidrs = v }},
+		"excludeIPCidrs": {Key: annotation.SidecarTrafficExcludeOutboundIPRanges.Name, Validator: ValidateCIDRList,
+			Set: func(r *Redirect, v string) { r.ExcludeIPCidrs = v }},
+		"includePorts": {Key: annotation.SidecarTrafficIncludeInboundPorts.Name, Validator: ValidatePortListWithWildcard,
+			Set: func(r *Redirect, v string) { r.IncludePorts = v }},
+		"excludeInboundPorts": {Key: annotation.SidecarTrafficExcludeInboundPorts.Name, Validator: ValidatePortList,
+			Set: func(r *Redirect, v string) { r.ExcludeInboundPorts = v }},
+		"excludeInboundSourceIPCidrs": {Key: ExcludeInboundSourceIPRangesKey, Validator: ValidateCIDRList,
+			Set: func(r *Redirect, v string) { r.ExcludeInboundSourceIPCidrs = v }},
+		"excludeOutboundUIDs": {Key: ExcludeOutboundUIDsKey, Validator: ValidateIDList,
+			Set: func(r *Redirect, v string) { r.ExcludeOutboundUIDs = v }},
+		"excludeOutboundGIDs": {Key: ExcludeOutboundGIDsKey, Validator: ValidateIDList,
+			Set: func(r *Redirect, v string) { r.ExcludeOutboundGIDs = v }},
+		"excludeOutboundPorts": {Key: annotation.SidecarTrafficExcludeOutboundPorts.Name, Validator: ValidatePortList,
+			Set: func(r *Redirect, v string) { r.ExcludeOutboundPorts = v }},
+		"includeOutboundPorts": {Key: IncludeOutboundPortsKey, Validator: ValidatePortRangeList,
+			Set: func(r *Redirect, v string) { r.IncludeOutboundPorts = v }},
+		"kubevirtInterfaces": {Key: annotation.SidecarTrafficKubevirtInterfaces.Name, Validator: ValidateInterfaceList,
+			Set: func(r *Redirect, v string) { r.KubevirtInterfaces = v }},
+		"excludeInterfaces": {Key: ExcludeInterfacesKey, Validator: ValidateInterfaceList,
+			Set: func(r *Redirect, v string) { r.ExcludeInterfaces = v }},
+		"inboundPortTargets": {Key: InboundPortTargetsKey, Validator: ValidatePortMap,
+			Set: func(r *Redirect, v string) { r.InboundPortTargets = v }},
+		"egressLockdown": {Key: EgressLockdownKey, Validator: ValidateBool,
+			Set: func(r *Redirect, v string) { r.EgressLockdown, _ = strconv.ParseBool(v) }},
+		"egressLockdownRejectUDP": {Key: EgressLockdownRejectUDPKey, Validator: ValidateBool,
+			Set: func(r *Redirect, v string) { r.EgressLockdownRejectUDP, _ = strconv.ParseBool(v) }},
+	}
+)
+
+// Register adds an annotation to the registry under name, so that Parse
+// validates and applies it. It is not safe to call concurrently with Parse;
+// callers should register their annotations from init.
+func Register(name string, param Param) error {
+	if name == "" || param.Key == "" {
+		return fmt.Errorf("annotation name and key must be set")
+	}
+	if _, ok := registry[name]; ok {
+		return fmt.Errorf("annotation %q is already registered", name)
+	}
+	for other, p := range registry {
+		if p.Key == param.Key {
+			return fmt.Errorf("annotation key %s is already registered as %q", param.Key, other)
+		}
+	}
+	registry[name] = &param
+	return nil
+}
+
+// Lookup returns the registered annotation with the given name.
+func Lookup(name string) (Param, bool) {
+	param, ok := registry[name]
+	if !ok {
+		return Param{}, false
+	}
+	return *param, true
+}
+
+// Names returns the names of all registered annotations, sorted.
+func Names() []string {
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Annotations returns the annotations for parameters keyed by registry name,
+// e.g. {"includePorts": "*"}.
+func Annotations(params map[string]string) (map[string]string, error) {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	annotations := make(map[string]string, len(params))
+	for _, name := range names {
+		param, ok := registry[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown redirect parameter %q", name)
+		}
+		annotations[param.Key] = params[name]
+	}
+	return annotations, nil
+}
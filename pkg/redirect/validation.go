@@ -0,0 +1,241 @@
+// Copyright 2018 Istio authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redirect
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ValidateInterceptionMode validates the interceptionMode annotation
+func ValidateInterceptionMode(mode string) error {
+	switch mode {
+	case ModeREDIRECT:
+	case ModeTPROXY:
+	default:
+		return fmt.Errorf("interceptionMode invalid: %v", mode)
+	}
+	return nil
+}
+
+// ValidateBool validates a boolean annotation, e.g. "true" or "false"
+func ValidateBool(value string) error {
+	if _, err := strconv.ParseBool(value); err != nil {
+		return fmt.Errorf("bool %q invalid: must be true or false", value)
+	}
+	return nil
+}
+
+// ValidateCIDRList validates a comma separated list of CIDRs
+func ValidateCIDRList(cidrs string) error {
+	if len(cidrs) > 0 {
+		for _, cidr := range strings.Split(cidrs, ",") {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				return fmt.Errorf("failed parsing cidr '%s': %v", cidr, err)
+			}
+		}
+	}
+	return nil
+}
+
+// ValidateCIDRListWithWildcard validates the includeIPRanges parameter
+func ValidateCIDRListWithWildcard(ipRanges string) error {
+	if ipRanges != "*" {
+		if e := ValidateCIDRList(ipRanges); e != nil {
+			return fmt.Errorf("IPRanges invalid: %v", e)
+		}
+	}
+	return nil
+}
+
+func parsePort(portStr string) (uint16, error) {
+	port, err := strconv.ParseUint(strings.TrimSpace(portStr), 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("failed parsing port %q: %v", portStr, err)
+	}
+	return uint16(port), nil
+}
+
+// ParsePorts parses a comma separated list of ports
+func ParsePorts(portsString string) ([]int, error) {
+	portsString = strings.TrimSpace(portsString)
+	ports := make([]int, 0)
+	if len(portsString) > 0 {
+		for _, portStr := range splitPorts(portsString) {
+			port, err := parsePort(portStr)
+			if err != nil {
+				return nil, err
+			}
+			ports = append(ports, int(port))
+		}
+	}
+	return ports, nil
+}
+
+// ValidatePortList validates a comma separated list of ports
+func ValidatePortList(ports string) error {
+	if _, err := ParsePorts(ports); err != nil {
+		return fmt.Errorf("portList %q invalid: %v", ports, err)
+	}
+	return nil
+}
+
+// ValidatePortListWithWildcard validates a comma separated list of ports, or '*'
+func ValidatePortListWithWildcard(ports string) error {
+	if ports != "*" {
+		return ValidatePortList(ports)
+	}
+	return nil
+}
+
+// ValidatePortMap validates a comma separated list of PORT:TARGET port
+// mappings, each port mapped at most once
+func ValidatePortMap(mappings string) error {
+	if mappings == "" {
+		return nil
+	}
+	seen := map[uint16]bool{}
+	for _, mapping := range strings.Split(mappings, ",") {
+		ports := strings.Split(mapping, ":")
+		if len(ports) != 2 {
+			return fmt.Errorf("portMap %q invalid: %q is not PORT:TARGET", mappings, mapping)
+		}
+		port, err := parsePort(ports[0])
+		if err != nil {
+			return fmt.Errorf("portMap %q invalid: %v", mappings, err)
+		}
+		if _, err := parsePort(ports[1]); err != nil {
+			return fmt.Errorf("portMap %q invalid: %v", mappings, err)
+		}
+		if seen[port] {
+			return fmt.Errorf("portMap %q invalid: port %d is mapped twice", mappings, port)
+		}
+		seen[port] = true
+	}
+	return nil
+}
+
+// maxMultiportSlots is the number of ports the iptables multiport match takes,
+// a range counting as two.
+const maxMultiportSlots = 15
+
+// ValidatePortRangeList validates a comma separated list of ports and port
+// ranges, e.g. "80,8000-8100", which fits a single iptables multiport match.
+func ValidatePortRangeList(ports string) error {
+	ports = strings.TrimSpace(ports)
+	if ports == "" {
+		return nil
+	}
+	slots := 0
+	for _, item := range splitPorts(ports) {
+		bounds := strings.SplitN(item, "-", 2)
+		lo, err := parsePort(bounds[0])
+		if err != nil {
+			return fmt.Errorf("portRangeList %q invalid: %v", ports, err)
+		}
+		slots++
+		if len(bounds) == 2 {
+			hi, err := parsePort(bounds[1])
+			if err != nil {
+				return fmt.Errorf("portRangeList %q invalid: %v", ports, err)
+			}
+			if hi < lo {
+				return fmt.Errorf("portRangeList %q invalid: range %q is reversed", ports, item)
+			}
+			slots++
+		}
+	}
+	if slots > maxMultiportSlots {
+		return fmt.Errorf("portRangeList %q invalid: more than %d ports, a range counting as two", ports, maxMultiportSlots)
+	}
+	return nil
+}
+
+// ValidateIDList validates a comma separated list of numeric UIDs or GIDs
+func ValidateIDList(ids string) error {
+	ids = strings.TrimSpace(ids)
+	if ids == "" {
+		return nil
+	}
+	for _, id := range strings.Split(ids, ",") {
+		if _, err := strconv.ParseUint(strings.TrimSpace(id), 10, 32); err != nil {
+			return fmt.Errorf("idList %q invalid: %q is not a numeric id", ids, id)
+		}
+	}
+	return nil
+}
+
+// loopbackInterface is never a kubevirt or excluded interface, the proxy
+// relies on it.
+const loopbackInterface = "lo"
+
+// maxInterfaceNameLen is the longest Linux interface name, IFNAMSIZ - 1.
+const maxInterfaceNameLen = 15
+
+// ValidateInterfaceList validates a comma separated list of interface names
+func ValidateInterfaceList(interfaces string) error {
+	if interfaces == "" {
+		return nil
+	}
+	for _, name := range strings.Split(interfaces, ",") {
+		switch {
+		case name == "" || name == "." || name == "..":
+			return fmt.Errorf("interfaceList %q invalid: %q is not an interface name", interfaces, name)
+		case len(name) > maxInterfaceNameLen:
+			return fmt.Errorf("interfaceList %q invalid: %q is longer than %d characters", interfaces, name, maxInterfaceNameLen)
+		case strings.ContainsAny(name, "/: \t\n"):
+			return fmt.Errorf("interfaceList %q invalid: %q contains a '/', ':' or whitespace", interfaces, name)
+		case name == loopbackInterface:
+			return fmt.Errorf("interfaceList %q invalid: the loopback interface cannot be listed", interfaces)
+		}
+	}
+	return nil
+}
+
+const (
+	// DefaultTproxyMark is the firewall mark istio-iptables.sh uses in TPROXY
+	// mode unless told otherwise.
+	DefaultTproxyMark = 1337
+	// fullMarkMask is the mask of a mark given without one.
+	fullMarkMask = 0xffffffff
+)
+
+// ParseMark parses a firewall mark or mask, in decimal or with a 0x prefix in
+// hexadecimal.
+func ParseMark(mark string) (uint32, error) {
+	n, err := strconv.ParseUint(strings.TrimSpace(mark), 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a 32 bit mark", mark)
+	}
+	return uint32(n), nil
+}
+
+// reservedRouteTables are the kernel's local, main and default tables.
+var reservedRouteTables = map[uint64]string{253: "default", 254: "main", 255: "local"}
+
+// ValidateRouteTable validates the number of a routing table for istio's own
+// routes.
+func ValidateRouteTable(table string) error {
+	n, err := strconv.ParseUint(strings.TrimSpace(table), 10, 32)
+	if err != nil || n == 0 {
+		return fmt.Errorf("routeTable %q invalid: must be a number from 1 to %d", table, uint32(fullMarkMask))
+	}
+	if name, ok := reservedRouteTables[n]; ok {
+		return fmt.Errorf("routeTable %q invalid: %d is the kernel's %s table", table, n, name)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package webhook implements a validating admission webhook which checks the
+// traffic annotations of pods before they are created, so that bad values are
+// not only discovered when istio-cni skips capture at ADD time.
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"go.uber.org/multierr"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+
+	"istio.io/cni/pkg/redirect"
+	"istio.io/pkg/log"
+)
+
+const (
+	// ModeReject denies pods with invalid traffic annotations.
+	ModeReject = "reject"
+	// ModeWarn admits pods with invalid traffic annotations, returning an
+	// admission warning for each.
+	ModeWarn = "warn"
+
+	maxRequestBytes = 1 << 20
+)
+
+var podResource = metav1.GroupVersionResource{Version: "v1", Resource: "pods"}
+
+// admissionResponse adds the admission warnings, which the vendored
+// k8s.io/api predates, to the AdmissionResponse.
+type admissionResponse struct {
+	admissionv1.AdmissionResponse
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// admissionReview is an admission.k8s.io v1 or v1beta1 AdmissionReview, which
+// share the same schema.
+type admissionReview struct {
+	metav1.TypeMeta `json:",inline"`
+	Request         *admissionv1.AdmissionRequest `json:"request,omitempty"`
+	Response        *admissionResponse            `json:"response,omitempty"`
+}
+
+// Server validates the traffic annotations of pods in AdmissionReviews.
+type Server struct {
+	// Mode is ModeReject or ModeWarn.
+	Mode string
+}
+
+// NewServer returns a Server for the given mode.
+func NewServer(mode string) (*Server, error) {
+	switch mode {
+	case ModeReject, ModeWarn:
+	default:
+		return nil, fmt.Errorf("invalid webhook mode %q, must be %s or %s", mode, ModeReject, ModeWarn)
+	}
+	return &Server{Mode: mode}, nil
+}
+
+// ServeHTTP handles a single AdmissionReview.
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxRequestBytes))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to read request: %v", err), http.StatusBadRequest)
+		return
+	}
+	review := admissionReview{}
+	if err := json.Unmarshal(body, &review); err != nil || review.Request == nil {
+		http.Error(w, fmt.Sprintf("invalid AdmissionReview: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	review.Response = s.review(review.Request)
+	review.Response.UID = review.Request.UID
+	review.Request = nil
+	out, err := json.Marshal(review)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(out); err != nil {
+		log.Warnf("Failed to write admission response: %v", err)
+	}
+}
+
+// review returns the admission response for req.
+func (s *Server) review(req *admissionv1.AdmissionRequest) *admissionResponse {
+	resp := &admissionResponse{AdmissionResponse: admissionv1.AdmissionResponse{Allowed: true}}
+	if req.Resource != podResource || req.Object.Raw == nil {
+		return resp
+	}
+	pod := corev1.Pod{}
+	if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
+		resp.Allowed = false
+		resp.Result = &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Message: fmt.Sprintf("failed to decode pod: %v", err),
+			Reason:  metav1.StatusReasonBadRequest,
+			Code:    http.StatusBadRequest,
+		}
+		return resp
+	}
+
+	errs := Validate(&pod)
+	if len(errs) == 0 {
+		return resp
+	}
+	name := pod.Name
+	if name == "" {
+		name = pod.GenerateName
+	}
+	log.Infof("Pod %s/%s has invalid traffic annotations: %v", req.Namespace, name, errs.ToAggregate())
+	if s.Mode == ModeWarn {
+		for _, err := range errs {
+			resp.Warnings = append(resp.Warnings, err.Error())
+		}
+		return resp
+	}
+	status := apierrors.NewInvalid(schema.GroupKind{Kind: "Pod"}, name, errs).ErrStatus
+	resp.Allowed = false
+	resp.Result = &status
+	return resp
+}
+
+// Validate returns a field error for each invalid traffic annotation of pod,
+// using the validators of the redirect registry.
+func Validate(pod *corev1.Pod) field.ErrorList {
+	_, err := redirect.Parse(pod.Annotations, nil)
+	if err == nil {
+		return nil
+	}
+	path := field.NewPath("metadata", "annotations")
+	var errs field.ErrorList
+	for _, e := range multierr.Errors(err) {
+		if verr, ok := e.(*redirect.Error); ok {
+			errs = append(errs, field.Invalid(path.Key(verr.Key), verr.Value, verr.Err.Error()))
+		} else {
+			errs = append(errs, field.InternalError(path, e))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,113 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func postReview(t *testing.T, mode, fixture string) admissionReview {
+	t.Helper()
+	s, err := NewServer(mode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	body, err := ioutil.ReadFile(filepath.Join("testdata", fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(srv.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %s", resp.Status)
+	}
+	review := admissionReview{}
+	if err := json.NewDecoder(resp.Body).Decode(&review); err != nil {
+		t.Fatal(err)
+	}
+	if review.Response == nil {
+		t.Fatalf("no response in %+v", review)
+	}
+	return review
+}
+
+func TestWebhookAllowsValidPod(t *testing.T) {
+	review := postReview(t, ModeReject, "valid-pod.json")
+	if !review.Response.Allowed || len(review.Response.Warnings) != 0 {
+		t.Fatalf("expected valid pod to be allowed without warnings, got %+v", review.Response)
+	}
+	if review.Response.UID != "8d7c3c1f-2b5e-4c36-9c1a-6a2f9d6c0001" {
+		t.Fatalf("response UID %q does not match request", review.Response.UID)
+	}
+}
+
+func TestWebhookRejectsInvalidPod(t *testing.T) {
+	for fixture, apiVersion := range map[string]string{
+		"invalid-pod.json":         "admission.k8s.io/v1",
+		"invalid-pod-v1beta1.json": "admission.k8s.io/v1beta1",
+	} {
+		t.Run(fixture, func(t *testing.T) {
+			review := postReview(t, ModeReject, fixture)
+			if review.Response.Allowed {
+				t.Fatalf("expected invalid pod to be rejected")
+			}
+			if review.APIVersion != apiVersion {
+				t.Fatalf("response apiVersion %q does not match request", review.APIVersion)
+			}
+			status := review.Response.Result
+			if status == nil || status.Reason != metav1.StatusReasonInvalid || status.Details == nil {
+				t.Fatalf("expected Invalid status with details, got %+v", status)
+			}
+			var fields []string
+			for _, cause := range status.Details.Causes {
+				fields = append(fields, cause.Field)
+			}
+			want := []string{
+				"metadata.annotations[traffic.sidecar.istio.io/includeInboundPorts]",
+				"metadata.annotations[sidecar.istio.io/interceptionMode]",
+			}
+			if !reflect.DeepEqual(fields, want) {
+				t.Fatalf("expected causes for %v, got %v", want, fields)
+			}
+		})
+	}
+}
+
+func TestWebhookWarnsInvalidPod(t *testing.T) {
+	review := postReview(t, ModeWarn, "invalid-pod.json")
+	if !review.Response.Allowed {
+		t.Fatalf("expected invalid pod to be allowed in warn mode")
+	}
+	if len(review.Response.Warnings) != 2 ||
+		!strings.HasPrefix(review.Response.Warnings[0], "metadata.annotations[traffic.sidecar.istio.io/includeInboundPorts]: Invalid value: \"9080,http\"") {
+		t.Fatalf("unexpected warnings %q", review.Response.Warnings)
+	}
+}
@@ -19,7 +19,7 @@
 # Initialization script responsible for setting up port forwarding for Istio sidecar.
 
 function usage() {
-  echo "${0} -p PORT -u UID -g GID [-m mode] [-b ports] [-d ports] [-i CIDR] [-x CIDR] [-k interfaces] [-t] [-h]"
+  echo "${0} -p PORT -u UID -g GID [-m mode] [-b ports] [-d ports] [-i CIDR] [-x CIDR] [-k interfaces] [-e interfaces] [-f mappings] [-l] [-r] [-n] [-c] [-t] [-h]"
   echo ''
   # shellcheck disable=SC2016
   echo '  -p: Specify the envoy port to which redirect all TCP traffic (default $ENVOY_PORT = 15001)'
@@ -49,17 +49,48 @@ function usage() {
   # shellcheck disable=SC2016
   echo '      outbound traffic (i.e. "*") is being redirected (default to $ISTIO_SERVICE_EXCLUDE_CIDR).'
   echo '  -o: Comma separated list of outbound ports to be excluded from redirection to Envoy (optional).'
+  echo '  -q: Comma separated list of outbound ports or port ranges (e.g. 8000-8100), the only ones redirected'
+  echo '      to Envoy (optional). At most 15 ports, a range counting as two. An empty list redirects all ports.'
+  echo '  -s: Comma separated list of source IP ranges in CIDR form whose inbound traffic is not redirected'
+  echo '      to Envoy (optional).'
   echo '  -k: Comma separated list of virtual interfaces whose inbound traffic (from VM)'
   echo '      will be treated as outbound (optional)'
+  echo '  -e: Comma separated list of interfaces whose inbound and outbound traffic is not redirected to Envoy'
+  echo '      (optional), e.g. secondary networks.'
+  echo '  -f: Comma separated list of PORT:TARGET mappings, redirecting the inbound traffic of PORT to the Envoy'
+  echo '      listener on TARGET rather than the common inbound port (optional), e.g. 9000:15007.'
+  echo '  -l: Egress lockdown, drop the outbound traffic which is neither redirected to Envoy, sent by Envoy'
+  echo '      (matching both the first UID of -u and the first GID of -g) nor excluded from redirection.'
+  echo '  -r: With -l, also reject outbound UDP traffic other than DNS.'
+  echo '  -n: Dry run, print the iptables and ip commands instead of executing them.'
+  echo '  -c: Clean up, remove all Istio rules, chains and routes instead of adding them.'
   echo '  -t: Unit testing, only functions are loaded and no other instructions are executed.'
   echo '  -h: Displays usage information and exits.'
   # shellcheck disable=SC2016
   echo ''
+  # shellcheck disable=SC2016
+  echo 'TPROXY mode marks packets with $ISTIO_INBOUND_TPROXY_MARK (default 1337), limited to the bits of'
+  # shellcheck disable=SC2016
+  echo '$ISTIO_INBOUND_TPROXY_MASK (default all), and routes them with table $ISTIO_INBOUND_TPROXY_ROUTE_TABLE'
+  # shellcheck disable=SC2016
+  echo '(default 133). Setting $ISTIO_OUTBOUND_TPROXY keeps the original source address of the connections'
+  echo 'Envoy makes to the app, routing the replies back to Envoy.'
+  echo ''
 }
 
 function dump {
-    iptables-save
-    ip6tables-save
+    "${IPTABLES_SAVE_CMD}"
+    if [ -n "${IP6TABLES_SAVE_CMD}" ]; then
+        "${IP6TABLES_SAVE_CMD}"
+    fi
+}
+
+#
+# Prints a command with its arguments separated by spaces, for dry runs.
+#
+function dry_run_echo {
+    local IFS=' '
+    echo "$*"
 }
 
 function isValidIP() {
@@ -123,15 +154,40 @@ function isIPv6() {
 #
 IPTABLES_WAIT=30
 #
+# The iptables backend, "legacy" or "nft", whose commands are used for both IPv4 and IPv6. The
+# iptables commands of the PATH are used if it is empty.
+#
+IPTABLES_BACKEND=${ISTIO_IPTABLES_BACKEND-}
+case "${IPTABLES_BACKEND}" in
+  ""|legacy|nft)
+    ;;
+  *)
+    echo "Invalid iptables backend: ${IPTABLES_BACKEND}" >&2
+    exit 1
+    ;;
+esac
+IPTABLES_SUFFIX=${IPTABLES_BACKEND:+-${IPTABLES_BACKEND}}
+#
 # The path to the iptables command.
 #
 # shellcheck disable=SC2230
-IPTABLES_CMD=$(which iptables)
+IPTABLES_CMD=$(which "iptables${IPTABLES_SUFFIX}")
 #
 # The path to the ip6tables command.
 #
 # shellcheck disable=SC2230
-IP6TABLES_CMD=$(which ip6tables)
+IP6TABLES_CMD=$(which "ip6tables${IPTABLES_SUFFIX}")
+#
+# The paths to the iptables-save and ip6tables-save commands.
+#
+# shellcheck disable=SC2230
+IPTABLES_SAVE_CMD=$(which "iptables${IPTABLES_SUFFIX}-save")
+# shellcheck disable=SC2230
+IP6TABLES_SAVE_CMD=$(which "ip6tables${IPTABLES_SUFFIX}-save")
+#
+# If not empty, commands changing the network namespace are printed instead of executed.
+#
+DRY_RUN=
 #
 # If true, retries iptables & ip6tables commands in case they fails.
 #
@@ -165,6 +221,10 @@ function iptables_retry {
 # Function wrapping iptables to retry in case of failure if IPTABLES_RETRY is "true".
 #
 function iptables {
+    if [ -n "${DRY_RUN}" ]; then
+        dry_run_echo iptables "$@"
+        return 0
+    fi
     iptables_retry "$IPTABLES_CMD" "$@"
     return $?
 }
@@ -172,9 +232,118 @@ function iptables {
 # Function wrapping ip6tables to retry in case of failure if IPTABLES_RETRY is "true".
 #
 function ip6tables {
+    if [ -n "${DRY_RUN}" ]; then
+        dry_run_echo ip6tables "$@"
+        return 0
+    fi
     iptables_retry "$IP6TABLES_CMD" "$@"
     return $?
 }
+#
+# Function wrapping ip commands that change the network namespace, so they are only printed on dry runs.
+#
+function ip_change {
+    if [ -n "${DRY_RUN}" ]; then
+        dry_run_echo ip "$@"
+        return 0
+    fi
+    ip "$@"
+}
+#
+# Drops the outbound traffic of the ip(6)tables command $1 which is neither redirected to Envoy, sent by
+# Envoy nor excluded from redirection, so that the app cannot bypass Envoy, e.g. with raw sockets. Traffic
+# redirected to Envoy leaves through the loopback interface.
+#
+function egress_lockdown {
+    local cmd=$1
+    local uid gid port cidr excludedInterface
+    ${cmd} -t filter -N ISTIO_EGRESS
+    ${cmd} -t filter -A OUTPUT -j ISTIO_EGRESS
+    ${cmd} -t filter -A ISTIO_EGRESS -o lo -j RETURN
+    ${cmd} -t filter -A ISTIO_EGRESS -m conntrack --ctstate RELATED,ESTABLISHED -j RETURN
+    # Envoy runs with both the first UID and GID, so an app running with only one of them is not exempt.
+    ${cmd} -t filter -A ISTIO_EGRESS -m owner --uid-owner "${PROXY_UID%%,*}" --gid-owner "${PROXY_GID%%,*}" -j RETURN
+    for uid in ${PROXY_UID#*,}; do
+        [ "${uid}" = "${PROXY_UID}" ] && break
+        ${cmd} -t filter -A ISTIO_EGRESS -m owner --uid-owner "${uid}" -j RETURN
+    done
+    for gid in ${PROXY_GID#*,}; do
+        [ "${gid}" = "${PROXY_GID}" ] && break
+        ${cmd} -t filter -A ISTIO_EGRESS -m owner --gid-owner "${gid}" -j RETURN
+    done
+    for excludedInterface in ${EXCLUDE_INTERFACES}; do
+        ${cmd} -t filter -A ISTIO_EGRESS -o "${excludedInterface}" -j RETURN
+    done
+    for port in ${OUTBOUND_PORTS_EXCLUDE}; do
+        ${cmd} -t filter -A ISTIO_EGRESS -p tcp --dport "${port}" -j RETURN
+    done
+    if [ "${cmd}" = "iptables" ] && [ ${#ipv4_ranges_exclude[@]} -gt 0 ]; then
+        for cidr in "${ipv4_ranges_exclude[@]}"; do
+            ${cmd} -t filter -A ISTIO_EGRESS -d "${cidr}" -j RETURN
+        done
+    fi
+    if [ "${cmd}" = "ip6tables" ] && [ ${#ipv6_ranges_exclude[@]} -gt 0 ]; then
+        for cidr in "${ipv6_ranges_exclude[@]}"; do
+            ${cmd} -t filter -A ISTIO_EGRESS -d "${cidr}" -j RETURN
+        done
+    fi
+    # UDP is not redirected, only DNS is left when it is rejected.
+    ${cmd} -t filter -A ISTIO_EGRESS -p udp --dport 53 -j RETURN
+    if [ -n "${EGRESS_LOCKDOWN_REJECT_UDP}" ]; then
+        ${cmd} -t filter -A ISTIO_EGRESS -p udp -j REJECT
+    else
+        ${cmd} -t filter -A ISTIO_EGRESS -p udp -j RETURN
+    fi
+    ${cmd} -t filter -A ISTIO_EGRESS -j DROP
+}
+#
+# Removes all rules, chains and routes added by this script. Every step is allowed to fail, so
+# cleaning up a partially programmed or clean network namespace succeeds.
+#
+function cleanup {
+    local IFS=' '
+    local cmd save rule words internalInterface chain
+    for cmd in iptables ip6tables; do
+        if [ "${cmd}" = "iptables" ]; then
+            save="${IPTABLES_SAVE_CMD}"
+        else
+            save="${IP6TABLES_SAVE_CMD}"
+        fi
+        # Remove the jumps from built-in chains into the Istio chains.
+        for table in nat mangle filter; do
+            while read -r rule; do
+                [ -z "${rule}" ] && continue
+                read -ra words <<< "${rule/#-A/-D}"
+                ${cmd} -t "${table}" "${words[@]}" || true
+            done <<< "$("${save}" -t "${table}" 2>/dev/null | grep -E '^-A (PREROUTING|OUTPUT) .*-j ISTIO_' || true)"
+        done
+        for internalInterface in ${KUBEVIRT_INTERFACES//,/ }; do
+            ${cmd} -t nat -D PREROUTING -i "${internalInterface}" -j RETURN 2>/dev/null || true
+        done
+        for chain in ISTIO_OUTPUT ISTIO_INBOUND ISTIO_REDIRECT ISTIO_IN_REDIRECT; do
+            ${cmd} -t nat -F "${chain}" 2>/dev/null || true
+        done
+        for chain in ISTIO_OUTPUT ISTIO_INBOUND ISTIO_REDIRECT ISTIO_IN_REDIRECT; do
+            ${cmd} -t nat -X "${chain}" 2>/dev/null || true
+        done
+        for chain in ISTIO_OUTPUT ISTIO_INBOUND ISTIO_DIVERT ISTIO_TPROXY; do
+            ${cmd} -t mangle -F "${chain}" 2>/dev/null || true
+        done
+        for chain in ISTIO_OUTPUT ISTIO_INBOUND ISTIO_DIVERT ISTIO_TPROXY; do
+            ${cmd} -t mangle -X "${chain}" 2>/dev/null || true
+        done
+        ${cmd} -t filter -F ISTIO_EGRESS 2>/dev/null || true
+        ${cmd} -t filter -X ISTIO_EGRESS 2>/dev/null || true
+    done
+    # Remove the IPv6 inbound lockdown added when the pod has no IPv6 address.
+    ip6tables -t filter -D INPUT -m state --state ESTABLISHED -j ACCEPT 2>/dev/null || true
+    ip6tables -t filter -D INPUT -i lo -d ::1 -j ACCEPT 2>/dev/null || true
+    ip6tables -t filter -D INPUT -j REJECT 2>/dev/null || true
+    # Remove the TPROXY routing and the local IPv6 address.
+    ip_change -f inet rule del fwmark "${INBOUND_TPROXY_MARK_SPEC}" lookup "${INBOUND_TPROXY_ROUTE_TABLE}" 2>/dev/null || true
+    ip_change -f inet route flush table "${INBOUND_TPROXY_ROUTE_TABLE}" 2>/dev/null || true
+    ip_change -6 addr del ::6/128 dev lo 2>/dev/null || true
+}
 
 # Use a comma as the separator for multi-value arguments.
 IFS=,
@@ -188,16 +357,28 @@ PROXY_UID=
 PROXY_GID=
 INBOUND_INTERCEPTION_MODE=${ISTIO_INBOUND_INTERCEPTION_MODE}
 INBOUND_TPROXY_MARK=${ISTIO_INBOUND_TPROXY_MARK:-1337}
+INBOUND_TPROXY_MASK=${ISTIO_INBOUND_TPROXY_MASK-}
 INBOUND_TPROXY_ROUTE_TABLE=${ISTIO_INBOUND_TPROXY_ROUTE_TABLE:-133}
+# The mark matched and set by TPROXY mode, only touching the bits of the mask if there is one, so that
+# the marks of other components of the node are kept.
+INBOUND_TPROXY_MARK_SPEC=${INBOUND_TPROXY_MARK}${INBOUND_TPROXY_MASK:+/${INBOUND_TPROXY_MASK}}
+OUTBOUND_TPROXY=${ISTIO_OUTBOUND_TPROXY-}
 INBOUND_PORTS_INCLUDE=${ISTIO_INBOUND_PORTS-}
 INBOUND_PORTS_EXCLUDE=${ISTIO_LOCAL_EXCLUDE_PORTS-}
 OUTBOUND_IP_RANGES_INCLUDE=${ISTIO_SERVICE_CIDR-}
 OUTBOUND_IP_RANGES_EXCLUDE=${ISTIO_SERVICE_EXCLUDE_CIDR-}
 OUTBOUND_PORTS_EXCLUDE=${ISTIO_LOCAL_OUTBOUND_PORTS_EXCLUDE-}
+OUTBOUND_PORTS_INCLUDE=
+INBOUND_SOURCE_IP_RANGES_EXCLUDE=
 KUBEVIRT_INTERFACES=
+EXCLUDE_INTERFACES=
+INBOUND_PORT_TARGETS=
+EGRESS_LOCKDOWN=
+EGRESS_LOCKDOWN_REJECT_UDP=
 ENABLE_INBOUND_IPV6=
+CLEANUP=
 
-while getopts ":p:z:u:g:m:b:d:o:i:x:k:ht" opt; do
+while getopts ":p:z:u:g:m:b:d:o:q:i:x:s:k:e:f:lrncht" opt; do
   case ${opt} in
     p)
       PROXY_PORT=${OPTARG}
@@ -226,12 +407,36 @@ while getopts ":p:z:u:g:m:b:d:o:i:x:k:ht" opt; do
     x)
       OUTBOUND_IP_RANGES_EXCLUDE=${OPTARG}
       ;;
+    s)
+      INBOUND_SOURCE_IP_RANGES_EXCLUDE=${OPTARG}
+      ;;
     o)
       OUTBOUND_PORTS_EXCLUDE=${OPTARG}
       ;;
+    q)
+      OUTBOUND_PORTS_INCLUDE=${OPTARG//-/:}
+      ;;
     k)
       KUBEVIRT_INTERFACES=${OPTARG}
       ;;
+    e)
+      EXCLUDE_INTERFACES=${OPTARG}
+      ;;
+    f)
+      INBOUND_PORT_TARGETS=${OPTARG}
+      ;;
+    l)
+      EGRESS_LOCKDOWN=true
+      ;;
+    r)
+      EGRESS_LOCKDOWN_REJECT_UDP=true
+      ;;
+    n)
+      DRY_RUN=true
+      ;;
+    c)
+      CLEANUP=true
+      ;;
     t)
       echo "Unit testing is specified..."
       return
@@ -248,7 +453,14 @@ while getopts ":p:z:u:g:m:b:d:o:i:x:k:ht" opt; do
   esac
 done
 
-trap dump EXIT
+if [ -n "${CLEANUP}" ]; then
+  cleanup
+  exit 0
+fi
+
+if [ -z "${DRY_RUN}" ]; then
+  trap dump EXIT
+fi
 
 # TODO: more flexibility - maybe a whitelist of users to be captured for output instead of a blacklist.
 if [ -z "${PROXY_UID}" ]; then
@@ -304,6 +516,20 @@ for range in "${EXCLUDE[@]}"; do
     fi
 done
 
+IFS=',' read -ra SOURCE_EXCLUDE <<< "$INBOUND_SOURCE_IP_RANGES_EXCLUDE"
+ipv6_source_ranges_exclude=()
+ipv4_source_ranges_exclude=()
+for range in "${SOURCE_EXCLUDE[@]}"; do
+    r=${range%$pl}
+    if isValidIP "$r"; then
+        if isIPv4 "$r"; then
+            ipv4_source_ranges_exclude+=("$range")
+        elif isIPv6 "$r"; then
+            ipv6_source_ranges_exclude+=("$range")
+        fi
+    fi
+done
+
 ipv6_ranges_include=()
 ipv4_ranges_include=()
 if [ "${OUTBOUND_IP_RANGES_INCLUDE}" == "*" ]; then
@@ -326,10 +552,13 @@ fi
 echo "Environment:"
 echo "------------"
 echo "ENVOY_PORT=${ENVOY_PORT-}"
+echo "ISTIO_IPTABLES_BACKEND=${ISTIO_IPTABLES_BACKEND-}"
 echo "INBOUND_CAPTURE_PORT=${INBOUND_CAPTURE_PORT-}"
 echo "ISTIO_INBOUND_INTERCEPTION_MODE=${ISTIO_INBOUND_INTERCEPTION_MODE-}"
 echo "ISTIO_INBOUND_TPROXY_MARK=${ISTIO_INBOUND_TPROXY_MARK-}"
+echo "ISTIO_INBOUND_TPROXY_MASK=${ISTIO_INBOUND_TPROXY_MASK-}"
 echo "ISTIO_INBOUND_TPROXY_ROUTE_TABLE=${ISTIO_INBOUND_TPROXY_ROUTE_TABLE-}"
+echo "ISTIO_OUTBOUND_TPROXY=${ISTIO_OUTBOUND_TPROXY-}"
 echo "ISTIO_INBOUND_PORTS=${ISTIO_INBOUND_PORTS-}"
 echo "ISTIO_LOCAL_EXCLUDE_PORTS=${ISTIO_LOCAL_EXCLUDE_PORTS-}"
 echo "ISTIO_SERVICE_CIDR=${ISTIO_SERVICE_CIDR-}"
@@ -342,13 +571,21 @@ echo "PROXY_INBOUND_CAPTURE_PORT=${PROXY_INBOUND_CAPTURE_PORT}"
 echo "PROXY_UID=${PROXY_UID}"
 echo "INBOUND_INTERCEPTION_MODE=${INBOUND_INTERCEPTION_MODE}"
 echo "INBOUND_TPROXY_MARK=${INBOUND_TPROXY_MARK}"
+echo "INBOUND_TPROXY_MASK=${INBOUND_TPROXY_MASK}"
 echo "INBOUND_TPROXY_ROUTE_TABLE=${INBOUND_TPROXY_ROUTE_TABLE}"
+echo "OUTBOUND_TPROXY=${OUTBOUND_TPROXY}"
 echo "INBOUND_PORTS_INCLUDE=${INBOUND_PORTS_INCLUDE}"
 echo "INBOUND_PORTS_EXCLUDE=${INBOUND_PORTS_EXCLUDE}"
 echo "OUTBOUND_IP_RANGES_INCLUDE=${OUTBOUND_IP_RANGES_INCLUDE}"
 echo "OUTBOUND_IP_RANGES_EXCLUDE=${OUTBOUND_IP_RANGES_EXCLUDE}"
 echo "OUTBOUND_PORTS_EXCLUDE=${OUTBOUND_PORTS_EXCLUDE}"
+echo "OUTBOUND_PORTS_INCLUDE=${OUTBOUND_PORTS_INCLUDE}"
+echo "INBOUND_SOURCE_IP_RANGES_EXCLUDE=${INBOUND_SOURCE_IP_RANGES_EXCLUDE}"
 echo "KUBEVIRT_INTERFACES=${KUBEVIRT_INTERFACES}"
+echo "EXCLUDE_INTERFACES=${EXCLUDE_INTERFACES}"
+echo "INBOUND_PORT_TARGETS=${INBOUND_PORT_TARGETS}"
+echo "EGRESS_LOCKDOWN=${EGRESS_LOCKDOWN}"
+echo "EGRESS_LOCKDOWN_REJECT_UDP=${EGRESS_LOCKDOWN_REJECT_UDP}"
 echo "ENABLE_INBOUND_IPV6=${ENABLE_INBOUND_IPV6}"
 echo
 
@@ -358,7 +595,7 @@ set +o nounset
 # Add local ipv6 address to lo. Used in redirecting unknown ipv6 traffic to original dst.
 # This address does not show up in neigh table so each Pod/Vm will only see its own. Think about 127.0.0.6.
 if [ -n "${ENABLE_INBOUND_IPV6}" ]; then
-  ip -6 addr add ::6/128 dev lo
+  ip_change -6 addr add ::6/128 dev lo
 fi
 
 set -o errexit
@@ -390,21 +627,21 @@ if [ -n "${INBOUND_PORTS_INCLUDE}" ]; then
     # interface.
     # Mark all inbound packets.
     iptables -t mangle -N ISTIO_DIVERT
-    iptables -t mangle -A ISTIO_DIVERT -j MARK --set-mark "${INBOUND_TPROXY_MARK}"
+    iptables -t mangle -A ISTIO_DIVERT -j MARK --set-mark "${INBOUND_TPROXY_MARK_SPEC}"
     iptables -t mangle -A ISTIO_DIVERT -j ACCEPT
 
     # Route all packets marked in chain ISTIO_DIVERT using routing table ${INBOUND_TPROXY_ROUTE_TABLE}.
-    ip -f inet rule add fwmark "${INBOUND_TPROXY_MARK}" lookup "${INBOUND_TPROXY_ROUTE_TABLE}"
+    ip_change -f inet rule add fwmark "${INBOUND_TPROXY_MARK_SPEC}" lookup "${INBOUND_TPROXY_ROUTE_TABLE}"
     # In routing table ${INBOUND_TPROXY_ROUTE_TABLE}, create a single default rule to route all traffic to
     # the loopback interface.
-    ip -f inet route add local default dev lo table "${INBOUND_TPROXY_ROUTE_TABLE}" || ip route show table all
+    ip_change -f inet route add local default dev lo table "${INBOUND_TPROXY_ROUTE_TABLE}" || ip route show table all
 
     # Create a new chain for redirecting inbound traffic to the common Envoy
     # port.
     # In the ISTIO_INBOUND chain, '-j RETURN' bypasses Envoy and
     # '-j ISTIO_TPROXY' redirects to Envoy.
     iptables -t mangle -N ISTIO_TPROXY
-    iptables -t mangle -A ISTIO_TPROXY ! -d 127.0.0.1/32 -p tcp -j TPROXY --tproxy-mark "${INBOUND_TPROXY_MARK}/0xffffffff" --on-port "${PROXY_PORT}"
+    iptables -t mangle -A ISTIO_TPROXY ! -d 127.0.0.1/32 -p tcp -j TPROXY --tproxy-mark "${INBOUND_TPROXY_MARK}/${INBOUND_TPROXY_MASK:-0xffffffff}" --on-port "${PROXY_PORT}"
 
     table=mangle
   else
@@ -413,6 +650,42 @@ if [ -n "${INBOUND_PORTS_INCLUDE}" ]; then
   iptables -t ${table} -N ISTIO_INBOUND
   iptables -t ${table} -A PREROUTING -p tcp -j ISTIO_INBOUND
 
+  if [ "${INBOUND_INTERCEPTION_MODE}" = "TPROXY" ] && [ -n "${OUTBOUND_TPROXY}" ]; then
+    # Envoy connects to the app from the original source address, with the TPROXY mark on its socket.
+    # Save the mark on the connection, and do not capture Envoy's packets or other local traffic.
+    iptables -t mangle -A ISTIO_INBOUND -p tcp -m mark --mark "${INBOUND_TPROXY_MARK_SPEC}" -j CONNMARK --save-mark --nfmask "${INBOUND_TPROXY_MASK:-0xffffffff}" --ctmask "${INBOUND_TPROXY_MASK:-0xffffffff}"
+    iptables -t mangle -A ISTIO_INBOUND -p tcp -m mark --mark "${INBOUND_TPROXY_MARK_SPEC}" -j RETURN
+    iptables -t mangle -A ISTIO_INBOUND -p tcp -i lo -s 127.0.0.6/32 -j RETURN
+    iptables -t mangle -A ISTIO_INBOUND -p tcp -i lo -m mark ! --mark "${INBOUND_TPROXY_MARK_SPEC}" -j RETURN
+    # Restore the mark on the app's replies, so that they are routed back to Envoy with table
+    # ${INBOUND_TPROXY_ROUTE_TABLE} rather than to the original source.
+    iptables -t mangle -N ISTIO_OUTPUT
+    iptables -t mangle -A OUTPUT -p tcp -j ISTIO_OUTPUT
+    iptables -t mangle -A ISTIO_OUTPUT -p tcp -m connmark --mark "${INBOUND_TPROXY_MARK_SPEC}" -j CONNMARK --restore-mark --nfmask "${INBOUND_TPROXY_MASK:-0xffffffff}" --ctmask "${INBOUND_TPROXY_MASK:-0xffffffff}"
+  fi
+
+  # Do not redirect the inbound traffic of excluded interfaces.
+  for excludedInterface in ${EXCLUDE_INTERFACES}; do
+    iptables -t ${table} -A ISTIO_INBOUND -i "${excludedInterface}" -j RETURN
+  done
+
+  # Apply inbound source IPv4 exclusions, e.g. health checkers.
+  if [ ${#ipv4_source_ranges_exclude[@]} -gt 0 ]; then
+    for cidr in "${ipv4_source_ranges_exclude[@]}"; do
+      iptables -t ${table} -A ISTIO_INBOUND -s "${cidr}" -j RETURN
+    done
+  fi
+
+  # Redirect the mapped inbound ports to their own Envoy listeners.
+  for mapping in ${INBOUND_PORT_TARGETS}; do
+    if [ "${INBOUND_INTERCEPTION_MODE}" = "TPROXY" ]; then
+      iptables -t mangle -A ISTIO_INBOUND -p tcp --dport "${mapping%%:*}" -m conntrack --ctstate RELATED,ESTABLISHED -j ISTIO_DIVERT || echo "No conntrack match support"
+      iptables -t mangle -A ISTIO_INBOUND ! -d 127.0.0.1/32 -p tcp --dport "${mapping%%:*}" -j TPROXY --tproxy-mark "${INBOUND_TPROXY_MARK}/${INBOUND_TPROXY_MASK:-0xffffffff}" --on-port "${mapping#*:}"
+    else
+      iptables -t nat -A ISTIO_INBOUND -p tcp --dport "${mapping%%:*}" -j REDIRECT --to-port "${mapping#*:}"
+    fi
+  done
+
   if [ "${INBOUND_PORTS_INCLUDE}" == "*" ]; then
     # Makes sure SSH is not redirected
     iptables -t ${table} -A ISTIO_INBOUND -p tcp --dport 22 -j RETURN
@@ -454,6 +727,11 @@ iptables -t nat -N ISTIO_OUTPUT
 # Jump to the ISTIO_OUTPUT chain from OUTPUT chain for all tcp traffic.
 iptables -t nat -A OUTPUT -p tcp -j ISTIO_OUTPUT
 
+# Do not redirect the outbound traffic of excluded interfaces.
+for excludedInterface in ${EXCLUDE_INTERFACES}; do
+  iptables -t nat -A ISTIO_OUTPUT -o "${excludedInterface}" -j RETURN
+done
+
 # Apply port based exclusions. Must be applied before connections back to self
 # are redirected.
 if [ -n "${OUTBOUND_PORTS_EXCLUDE}" ]; then
@@ -498,6 +776,11 @@ done
 # localhost.
 iptables -t nat -A ISTIO_OUTPUT -d 127.0.0.1/32 -j RETURN
 
+# Only redirect the included outbound ports, if any.
+if [ -n "${OUTBOUND_PORTS_INCLUDE}" ]; then
+  iptables -t nat -A ISTIO_OUTPUT -p tcp -m multiport ! --dports "${OUTBOUND_PORTS_INCLUDE}" -j RETURN
+fi
+
 # Apply outbound IPv4 exclusions. Must be applied before inclusions.
 if [ ${#ipv4_ranges_exclude[@]} -gt 0 ]; then
   for cidr in "${ipv4_ranges_exclude[@]}"; do
@@ -551,6 +834,23 @@ if [ -n "${ENABLE_INBOUND_IPV6}" ]; then
     ip6tables -t ${table} -N ISTIO_INBOUND
     ip6tables -t ${table} -A PREROUTING -p tcp -j ISTIO_INBOUND
 
+    # Do not redirect the inbound traffic of excluded interfaces.
+    for excludedInterface in ${EXCLUDE_INTERFACES}; do
+      ip6tables -t ${table} -A ISTIO_INBOUND -i "${excludedInterface}" -j RETURN
+    done
+
+    # Apply inbound source IPv6 exclusions.
+    if [ ${#ipv6_source_ranges_exclude[@]} -gt 0 ]; then
+      for cidr in "${ipv6_source_ranges_exclude[@]}"; do
+        ip6tables -t ${table} -A ISTIO_INBOUND -s "${cidr}" -j RETURN
+      done
+    fi
+
+    # Redirect the mapped inbound ports to their own Envoy listeners.
+    for mapping in ${INBOUND_PORT_TARGETS}; do
+      ip6tables -t nat -A ISTIO_INBOUND -p tcp --dport "${mapping%%:*}" -j REDIRECT --to-port "${mapping#*:}"
+    done
+
     if [ "${INBOUND_PORTS_INCLUDE}" == "*" ]; then
         # Makes sure SSH is not redirected
         ip6tables -t ${table} -A ISTIO_INBOUND -p tcp --dport 22 -j RETURN
@@ -576,6 +876,11 @@ if [ -n "${ENABLE_INBOUND_IPV6}" ]; then
   # Jump to the ISTIO_OUTPUT chain from OUTPUT chain for all tcp traffic.
   ip6tables -t nat -A OUTPUT -p tcp -j ISTIO_OUTPUT
 
+  # Do not redirect the outbound traffic of excluded interfaces.
+  for excludedInterface in ${EXCLUDE_INTERFACES}; do
+    ip6tables -t nat -A ISTIO_OUTPUT -o "${excludedInterface}" -j RETURN
+  done
+
   # Apply port based exclusions. Must be applied before connections back to self
   # are redirected.
   if [ -n "${OUTBOUND_PORTS_EXCLUDE}" ]; then
@@ -619,6 +924,11 @@ if [ -n "${ENABLE_INBOUND_IPV6}" ]; then
   # container-to-container traffic both of which explicitly use
   # localhost.
   ip6tables -t nat -A ISTIO_OUTPUT -d ::1/128 -j RETURN
+
+  # Only redirect the included outbound ports, if any.
+  if [ -n "${OUTBOUND_PORTS_INCLUDE}" ]; then
+    ip6tables -t nat -A ISTIO_OUTPUT -p tcp -m multiport ! --dports "${OUTBOUND_PORTS_INCLUDE}" -j RETURN
+  fi
   
   # Apply outbound IPv6 exclusions. Must be applied before inclusions.
   if [ ${#ipv6_ranges_exclude[@]} -gt 0 ]; then
@@ -654,3 +964,15 @@ else
   ip6tables -t filter -A INPUT -i lo -d ::1 -j ACCEPT || true
   ip6tables -t filter -A INPUT -j REJECT || true
 fi
+
+# Drop the outbound traffic bypassing Envoy, for both IPv4 and IPv6 whether or not IPv6 is redirected.
+if [ -n "${EGRESS_LOCKDOWN}" ]; then
+  IPTABLES_RETRY=true
+  egress_lockdown iptables
+  # A node without ip6tables has no IPv6 rules to lock down.
+  if [ -n "${DRY_RUN}" ] || [ -n "${IP6TABLES_CMD}" ]; then
+    egress_lockdown ip6tables
+  else
+    echo "ip6tables${IPTABLES_SUFFIX} is not installed, skipping the IPv6 egress lockdown"
+  fi
+fi